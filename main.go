@@ -2,18 +2,86 @@ package main
 
 import (
 	"log"
+	"net/http"
+	"os"
+	"strings"
 
 	"github.com/ability-sh/abi-ac-driver/driver"
 	"github.com/ability-sh/abi-app-store/srv"
 	_ "github.com/ability-sh/abi-db/client/service"
+	"github.com/ability-sh/abi-lib/dynamic"
+	"github.com/ability-sh/abi-lib/json"
 	_ "github.com/ability-sh/abi-micro/http"
 	_ "github.com/ability-sh/abi-micro/logger"
 	_ "github.com/ability-sh/abi-micro/redis"
+	"github.com/ability-sh/abi-micro/runtime"
 	_ "github.com/ability-sh/abi-micro/smtp"
 )
 
+func getConfig() (interface{}, error) {
+
+	if os.Getenv("AC_ENV") == "unit" {
+
+		var config interface{} = nil
+
+		err := json.Unmarshal([]byte(os.Getenv("AC_CONFIG")), &config)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return config, nil
+	}
+
+	return driver.GetConfig("./config.yaml")
+}
+
 func main() {
-	err := driver.Run(driver.NewReflectExecutor(&srv.Server{}))
+
+	s := &srv.Server{}
+
+	config, err := getConfig()
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	p := runtime.NewPayload()
+
+	err = p.SetConfig(config)
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	defer p.Exit()
+
+	alias := dynamic.StringValue(dynamic.Get(config, "alias"), "/")
+
+	if !strings.HasSuffix(alias, "/") {
+		alias = alias + "/"
+	}
+
+	proxies, err := parseTrustedProxies(dynamic.StringValue(dynamic.Get(config, "trusted-proxies"), ""))
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	http.Handle(alias+"container/info/stream", srv.NewContainerInfoStream(s, p, func(r *http.Request) string {
+		return getClientIp(r, proxies)
+	}))
+
+	webhook := srv.NewWebhookWorker(s, p)
+
+	defer webhook.Recycle()
+
+	notify := srv.NewNotifyWorker(s, p)
+
+	defer notify.Recycle()
+
+	err = run(p, config, srv.NewRateLimitExecutor(s, driver.NewReflectExecutor(s)))
+
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ability-sh/abi-ac-driver/driver"
+	"github.com/ability-sh/abi-lib/dynamic"
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-lib/json"
+	"github.com/ability-sh/abi-micro/micro"
+	unit "unit.nginx.org/go"
+)
+
+/**
+* 与 driver.Run 相同, 但使用调用方创建的 payload
+* 流式接口和后台任务与 RPC 共用同一组服务, 每个服务只初始化一次
+**/
+func run(p micro.Payload, config interface{}, executor driver.Executor) error {
+
+	AC_APPID := os.Getenv("AC_APPID")
+	AC_VER := os.Getenv("AC_VER")
+	AC_ABILITY := os.Getenv("AC_ABILITY")
+
+	AC_ENV := os.Getenv("AC_ENV")
+	AC_ADDR := os.Getenv("AC_ADDR")
+	AC_HTTP_BODY_SIZE, _ := strconv.ParseInt(os.Getenv("AC_HTTP_BODY_SIZE"), 10, 64)
+
+	if AC_HTTP_BODY_SIZE == 0 {
+		AC_HTTP_BODY_SIZE = 1024 * 1024 * 500
+	}
+
+	info, _ := driver.GetAppInfo()
+
+	proxies, err := parseTrustedProxies(dynamic.StringValue(dynamic.Get(config, "trusted-proxies"), ""))
+
+	if err != nil {
+		return err
+	}
+
+	alias := dynamic.StringValue(dynamic.Get(config, "alias"), "/")
+
+	if !strings.HasSuffix(alias, "/") {
+		alias = alias + "/"
+	}
+
+	alias_n := len(alias)
+
+	s_state := alias + "__stat"
+
+	http.HandleFunc(alias, func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path == s_state {
+			setDataResponse(w, map[string]interface{}{"appid": AC_APPID, "ver": AC_VER, "ability": AC_ABILITY, "env": AC_ENV})
+			return
+		}
+
+		if strings.HasSuffix(r.URL.Path, ".json") {
+
+			var name = r.URL.Path[alias_n:]
+
+			trace := r.Header.Get("Trace")
+
+			if trace == "" {
+				trace = micro.NewTrace()
+				w.Header().Add("Trace", trace)
+			}
+
+			dynamic.Each(dynamic.Get(info, "cors"), func(key interface{}, value interface{}) bool {
+				w.Header().Add(dynamic.StringValue(key, ""), dynamic.StringValue(value, ""))
+				return true
+			})
+
+			sessionKey := dynamic.StringValue(dynamic.Get(info, "sessionKey"), "abi-ac")
+
+			ctx, err := p.NewContext(name, trace)
+
+			if err != nil {
+				setErrorResponse(w, err)
+				return
+			}
+
+			defer ctx.Recycle()
+
+			clientIp := getClientIp(r, proxies)
+			sessionId := getSessionId(r, w, sessionKey)
+
+			ctx.SetValue("clientIp", clientIp)
+			ctx.SetValue("sessionId", sessionId)
+
+			ctx.AddTag("clientIp", clientIp)
+			ctx.AddTag("sessionId", sessionId)
+
+			var inputData interface{} = nil
+			ctype := r.Header.Get("Content-Type")
+
+			if strings.Contains(ctype, "multipart/form-data") {
+				inputData = map[string]interface{}{}
+				r.ParseMultipartForm(AC_HTTP_BODY_SIZE)
+				if r.MultipartForm != nil {
+					for key, values := range r.MultipartForm.Value {
+						dynamic.Set(inputData, key, values[0])
+					}
+					for key, values := range r.MultipartForm.File {
+						dynamic.Set(inputData, key, values[0])
+					}
+				}
+			} else if strings.Contains(ctype, "json") {
+
+				b, err := ioutil.ReadAll(r.Body)
+				defer r.Body.Close()
+
+				if err == nil {
+					json.Unmarshal(b, &inputData)
+				}
+
+			} else {
+
+				inputData = map[string]interface{}{}
+
+				r.ParseForm()
+
+				for key, values := range r.Form {
+					dynamic.Set(inputData, key, values[0])
+				}
+
+			}
+
+			rs, err := executor.Exec(ctx, name, inputData)
+
+			if err != nil {
+				setErrorResponse(w, err)
+				return
+			}
+
+			setDataResponse(w, rs)
+
+			return
+		}
+
+		w.WriteHeader(404)
+		w.Write([]byte("Not Found"))
+	})
+
+	if AC_ADDR == "" {
+		AC_ADDR = ":8084"
+	}
+
+	if AC_ENV == "unit" {
+		return unit.ListenAndServe(AC_ADDR, nil)
+	}
+
+	log.Println("HTTPD", AC_ADDR)
+
+	return http.ListenAndServe(AC_ADDR, nil)
+}
+
+func setErrorResponse(w http.ResponseWriter, err error) {
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	e, ok := err.(*errors.Error)
+	if ok {
+		b, _ := json.Marshal(e)
+		w.Write(b)
+	} else {
+		b, _ := json.Marshal(map[string]interface{}{"errno": 500, "errmsg": err.Error()})
+		w.Write(b)
+	}
+}
+
+func setDataResponse(w http.ResponseWriter, data interface{}) {
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	b, _ := json.Marshal(map[string]interface{}{"errno": 200, "data": data})
+	w.Write(b)
+}
+
+/**
+* 解析 trusted-proxies, 逗号分隔的 IP 或 CIDR
+**/
+func parseTrustedProxies(text string) ([]*net.IPNet, error) {
+
+	rs := []*net.IPNet{}
+
+	for _, v := range strings.Split(text, ",") {
+
+		v = strings.TrimSpace(v)
+
+		if v == "" {
+			continue
+		}
+
+		if !strings.Contains(v, "/") {
+			if strings.Contains(v, ":") {
+				v = v + "/128"
+			} else {
+				v = v + "/32"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(v)
+
+		if err != nil {
+			return nil, fmt.Errorf("trusted-proxies: %s", err.Error())
+		}
+
+		rs = append(rs, n)
+	}
+
+	return rs, nil
+}
+
+func isTrustedProxy(proxies []*net.IPNet, addr string) bool {
+
+	ip := net.ParseIP(addr)
+
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/**
+* 只有直接连接的地址是可信代理时才使用 X-Forwarded-For, 从右向左跳过可信代理, 第一个不可信的地址为客户端地址
+**/
+func getClientIp(r *http.Request, proxies []*net.IPNet) string {
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if !isTrustedProxy(proxies, ip) {
+		return ip
+	}
+
+	vs := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+
+	for i := len(vs) - 1; i >= 0; i-- {
+
+		v := strings.TrimSpace(vs[i])
+
+		if v == "" {
+			continue
+		}
+
+		if net.ParseIP(v) == nil {
+			break
+		}
+
+		ip = v
+
+		if !isTrustedProxy(proxies, v) {
+			break
+		}
+	}
+
+	return ip
+}
+
+func getSessionId(r *http.Request, w http.ResponseWriter, sessionKey string) string {
+
+	c, _ := r.Cookie(sessionKey)
+
+	if c != nil {
+		return c.Value
+	}
+
+	sessionId := micro.NewTrace()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionKey,
+		Value:    sessionId,
+		HttpOnly: true,
+		Path:     "/",
+	})
+
+	return sessionId
+}
@@ -3,72 +3,159 @@ package srv
 import (
 	"fmt"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/ability-sh/abi-db/client/service"
 	"github.com/ability-sh/abi-db/source"
 	"github.com/ability-sh/abi-lib/dynamic"
 	"github.com/ability-sh/abi-lib/errors"
-	"github.com/ability-sh/abi-lib/json"
-	"github.com/ability-sh/abi-micro/grpc"
 	"github.com/ability-sh/abi-micro/micro"
 	"github.com/ability-sh/abi-micro/oss"
-	"github.com/ability-sh/abi-micro/redis"
 )
 
 var re_ver, _ = regexp.Compile(`^[0-9]+\.[0-9]+(\.[0-9]+)?(\-[0-9]+)?$`)
 
-func (s *Server) getAppMember(ctx micro.Context, id string, uid string) (*Member, error) {
-
-	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+/**
+* 比较版本号 major.minor[.patch][-build], a 较新时返回 1, 相同返回 0, 较旧返回 -1, 空版本最旧
+**/
+func compareVer(a string, b string) int {
 
-	if err != nil {
-		return nil, err
+	if a == "" || b == "" {
+		if a != "" {
+			return 1
+		}
+		if b != "" {
+			return -1
+		}
+		return 0
 	}
 
-	redis, err := redis.GetRedis(ctx, SERVICE_REDIS)
-
-	if err != nil {
-		return nil, err
+	parse := func(v string) []int {
+		rs := []int{0, 0, 0, 0}
+		i := strings.Index(v, "-")
+		if i >= 0 {
+			rs[3], _ = strconv.Atoi(v[i+1:])
+			v = v[:i]
+		}
+		for n, x := range strings.SplitN(v, ".", 3) {
+			rs[n], _ = strconv.Atoi(x)
+		}
+		return rs
 	}
 
-	u := Member{}
+	x, y := parse(a), parse(b)
 
-	key_am := fmt.Sprintf("%sam_%s_%s", config.Prefix, id, uid)
-	{
-		text, err := redis.Get(key_am)
-		if err == nil && text != "" {
-			err = json.Unmarshal([]byte(text), &u)
-			if err == nil {
-				return &u, nil
+	for n := 0; n < len(x); n++ {
+		if x[n] != y[n] {
+			if x[n] > y[n] {
+				return 1
 			}
+			return -1
 		}
 	}
 
-	client, err := service.GetClient(ctx, config.Db)
+	return 0
+}
 
-	if err != nil {
-		return nil, err
+/**
+* 应用版本中的能力, 排除 appid 和 ver
+**/
+func appAbilities(info map[string]interface{}) []string {
+
+	abilities := []string{}
+
+	for key, _ := range info {
+		if key != "appid" && key != "ver" {
+			abilities = append(abilities, key)
+		}
 	}
 
-	cc := grpc.NewGRPCContext(ctx)
+	sort.Strings(abilities)
+
+	return abilities
+}
 
-	collection := client.Collection(config.Collection)
+func (s *objectStore) PublishAppVer(ctx micro.Context, id string, ver string, info map[string]interface{}, abilities []string, staged bool, uid string) (*App, map[string]int, error) {
 
-	text, err := collection.Get(cc, fmt.Sprintf("app/%s/member/%s", id, uid))
+	var app *App = nil
+	newer := false
+
+	err := s.update(ctx, func(tx *storeTx) error {
+
+		k_info := fmt.Sprintf("app/%s/%s/info.json", id, ver)
+
+		_, err := tx.Get(k_info)
+
+		if err == nil {
+			return errors.Errorf(ERRNO_APP_VER, "The app version already exists and cannot be uploaded")
+		}
+
+		if !IsErrno(err, ERRNO_NOT_FOUND) {
+			return err
+		}
+
+		app = &App{}
+
+		err = tx.MustObject(fmt.Sprintf("app/%s/info.json", id), app, "App that does not exist")
+
+		if err != nil {
+			return err
+		}
+
+		newer = !staged && compareVer(ver, app.Ver) > 0
+
+		if newer {
+
+			rollout := &Rollout{}
+
+			ok, err := tx.GetObject(fmt.Sprintf("app/%s/rollout.json", id), rollout)
+
+			if err != nil {
+				return err
+			}
+
+			if ok && (rollout.State == ROLLOUT_STATE_RUNNING || rollout.State == ROLLOUT_STATE_PAUSED) {
+				return errors.Errorf(ERRNO_CONFLICT, "The app has an active rollout %s, upload as staged or abort the rollout", rollout.Id)
+			}
+		}
+
+		err = tx.PutObject(k_info, info)
+
+		if err != nil {
+			return err
+		}
+
+		if newer {
+
+			app.Ver = ver
+			app.Abilities = abilities
+
+			return tx.PutObject(fmt.Sprintf("app/%s/info.json", id), app)
+		}
+
+		return nil
+	})
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	redis.Set(key_am, string(text), time.Duration(config.CacheExpires)*time.Second)
+	if !newer {
+		return app, map[string]int{}, nil
+	}
 
-	json.Unmarshal(text, &u)
+	containers, err := s.bumpDeploy(ctx, id, uid, time.Now().Unix())
 
-	return &u, nil
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return app, containers, nil
 }
 
-func (s *Server) addAppMember(ctx micro.Context, id string, uid string, role string) (*Member, error) {
+func (s *Server) getAppMember(ctx micro.Context, id string, uid string) (*Member, error) {
 
 	config, err := GetConfigService(ctx, SERVICE_CONFIG)
 
@@ -76,25 +163,28 @@ func (s *Server) addAppMember(ctx micro.Context, id string, uid string, role str
 		return nil, err
 	}
 
-	client, err := service.GetClient(ctx, config.Db)
+	u := Member{}
+
+	err = config.Cache().GetObject(ctx, "app_member", fmt.Sprintf("%sam_%s_%s", config.Prefix, id, uid), &u, s.memberLoader(ctx, "app", id, uid))
 
 	if err != nil {
 		return nil, err
 	}
 
-	redis, err := redis.GetRedis(ctx, SERVICE_REDIS)
+	return &u, nil
+}
+
+func (s *Server) addAppMember(ctx micro.Context, id string, uid string, role string) (*Member, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
 
 	if err != nil {
 		return nil, err
 	}
 
-	cc := grpc.NewGRPCContext(ctx)
-
-	collection := client.Collection(config.Collection)
-
 	member := &Member{Id: uid, Role: role}
 
-	err = collection.PutObject(cc, fmt.Sprintf("app/%s/member/%s", id, uid), member)
+	err = config.Store().PutMember(ctx, "app", id, member)
 
 	if err != nil {
 		return nil, err
@@ -102,7 +192,7 @@ func (s *Server) addAppMember(ctx micro.Context, id string, uid string, role str
 
 	key_cm := fmt.Sprintf("%sam_%s_%s", config.Prefix, id, uid)
 
-	redis.Del(key_cm)
+	config.Cache().Del(ctx, key_cm)
 
 	return member, nil
 }
@@ -115,23 +205,7 @@ func (s *Server) removeAppMember(ctx micro.Context, id string, uid string) error
 		return err
 	}
 
-	client, err := service.GetClient(ctx, config.Db)
-
-	if err != nil {
-		return err
-	}
-
-	redis, err := redis.GetRedis(ctx, SERVICE_REDIS)
-
-	if err != nil {
-		return err
-	}
-
-	cc := grpc.NewGRPCContext(ctx)
-
-	collection := client.Collection(config.Collection)
-
-	err = collection.Del(cc, fmt.Sprintf("app/%s/member/%s", id, uid))
+	err = config.Store().DelMember(ctx, "app", id, uid)
 
 	if err != nil {
 		return err
@@ -139,7 +213,7 @@ func (s *Server) removeAppMember(ctx micro.Context, id string, uid string) error
 
 	key_cm := fmt.Sprintf("%sam_%s_%s", config.Prefix, id, uid)
 
-	redis.Del(key_cm)
+	config.Cache().Del(ctx, key_cm)
 
 	return nil
 }
@@ -152,76 +226,42 @@ func (s *Server) getApp(ctx micro.Context, id string) (*App, error) {
 		return nil, err
 	}
 
-	redis, err := redis.GetRedis(ctx, SERVICE_REDIS)
-
-	if err != nil {
-		return nil, err
-	}
-
 	u := App{}
 
-	key_c := fmt.Sprintf("%sa_%s", config.Prefix, id)
-
-	{
-		text, err := redis.Get(key_c)
-		if err == nil && text != "" {
-			err = json.Unmarshal([]byte(text), &u)
-			if err == nil {
-				return &u, nil
-			}
-		}
-	}
-
-	client, err := service.GetClient(ctx, config.Db)
-
-	if err != nil {
-		return nil, err
-	}
-
-	cc := grpc.NewGRPCContext(ctx)
-
-	collection := client.Collection(config.Collection)
-
-	text, err := collection.Get(cc, fmt.Sprintf("app/%s/info.json", id))
+	err = config.Cache().GetObject(ctx, "app", fmt.Sprintf("%sa_%s", config.Prefix, id), &u, s.loader(ctx, fmt.Sprintf("app/%s/info.json", id)))
 
 	if err != nil {
 		return nil, err
 	}
 
-	redis.Set(key_c, string(text), time.Duration(config.CacheExpires)*time.Second)
-
-	json.Unmarshal(text, &u)
-
 	return &u, nil
 }
 
 func (s *Server) AppCreate(ctx micro.Context, task *AppCreateTask) (*App, error) {
 
-	uid, err := s.getUid(ctx, task.Token)
+	if task.Visibility == "" {
+		task.Visibility = VISIBILITY_PRIVATE
+	}
 
-	if err != nil {
-		return nil, err
+	if !isVisibility(task.Visibility) {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter visibility is incorrect")
 	}
 
-	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+	uid, err := s.getUid(ctx, task.Token)
 
 	if err != nil {
 		return nil, err
 	}
 
-	client, err := service.GetClient(ctx, config.Db)
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
 
 	if err != nil {
 		return nil, err
 	}
 
-	cc := grpc.NewGRPCContext(ctx)
+	app := &App{Id: config.NewID(ctx), Info: task.Info, Visibility: task.Visibility}
 
-	collection := client.Collection(config.Collection)
-
-	app := &App{Id: config.NewID(ctx), Info: task.Info}
-
-	err = collection.PutObject(cc, fmt.Sprintf("app/%s/info.json", app.Id), app)
+	err = config.Store().PutApp(ctx, app)
 
 	if err != nil {
 		return nil, err
@@ -233,6 +273,21 @@ func (s *Server) AppCreate(ctx micro.Context, task *AppCreateTask) (*App, error)
 		return nil, err
 	}
 
+	if app.Visibility == VISIBILITY_PUBLIC {
+
+		err = s.updateCatalog(ctx, app.Id, true)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.indexApp(ctx, app)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return app, nil
 }
 
@@ -242,6 +297,16 @@ func (s *Server) AppSet(ctx micro.Context, task *AppSetTask) (*App, error) {
 		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
 	}
 
+	if task.Visibility != "" && !isVisibility(task.Visibility) {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter visibility is incorrect")
+	}
+
+	err := checkPatch(task.Info, task.PatchType, task.Patch)
+
+	if err != nil {
+		return nil, err
+	}
+
 	uid, err := s.getUid(ctx, task.Token)
 
 	if err != nil {
@@ -264,40 +329,36 @@ func (s *Server) AppSet(ctx micro.Context, task *AppSetTask) (*App, error) {
 		return nil, err
 	}
 
-	client, err := service.GetClient(ctx, config.Db)
+	app, err := config.Store().UpdateApp(ctx, task.Id, func(app *App) error {
 
-	if err != nil {
-		return nil, err
-	}
+		if task.ExpectedRev != 0 && app.Rev != task.ExpectedRev {
+			return errors.Errorf(ERRNO_CONFLICT, "The app has been modified, current rev is %d", app.Rev)
+		}
 
-	cc := grpc.NewGRPCContext(ctx)
+		if task.Patch != nil {
 
-	collection := client.Collection(config.Collection)
+			info, err := applyPatch(app.Info, task.PatchType, task.Patch)
 
-	text, err := collection.Exec(cc, `
-	(function(){
-		var id = ${id};
-		var info = ${info};
-		var k_info = collection + 'app/' + id + '/info.json';
-		var text = get(k_info);
-		if(!text) {
-			throw 'app does not exist'
+			if err != nil {
+				return err
+			}
+
+			app.Info = info
+
+		} else if task.Info != nil {
+			app.Info = task.Info
 		}
-		var object = JSON.parse(text);
-		if(info) {
-			object.info = info
-			text = JSON.stringify(object);
-			put(k_info,text)
+
+		if task.Visibility != "" {
+			app.Visibility = task.Visibility
 		}
-		return text;
-	})()
-	`, map[string]interface{}{"id": task.Id, "info": task.Info})
 
-	if err != nil {
-		return nil, err
-	}
+		if task.Info != nil || task.Patch != nil || task.Visibility != "" {
+			app.Rev = app.Rev + 1
+		}
 
-	redis, err := redis.GetRedis(ctx, SERVICE_REDIS)
+		return nil
+	})
 
 	if err != nil {
 		return nil, err
@@ -305,11 +366,22 @@ func (s *Server) AppSet(ctx micro.Context, task *AppSetTask) (*App, error) {
 
 	key_c := fmt.Sprintf("%sa_%s", config.Prefix, task.Id)
 
-	redis.Del(key_c)
+	config.Cache().Del(ctx, key_c)
 
-	app := &App{}
+	if task.Info != nil || task.Patch != nil || task.Visibility != "" {
 
-	json.Unmarshal([]byte(text), &app)
+		err = s.updateCatalog(ctx, app.Id, app.Visibility == VISIBILITY_PUBLIC)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.indexApp(ctx, app)
+
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return app, nil
 }
@@ -375,7 +447,17 @@ func (s *Server) AppMemberAdd(ctx micro.Context, task *AppMemberAddTask) (*Membe
 		return &Member{Id: uid, Role: ROLE_OWNER}, nil
 	}
 
-	return s.addAppMember(ctx, task.Id, u.Id, task.Role)
+	m, err := s.addAppMember(ctx, task.Id, u.Id, task.Role)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.emitEvent(ctx, WEBHOOK_SCOPE_APP, task.Id, EVENT_MEMBER_CHANGED, map[string]interface{}{"action": "add", "uid": m.Id, "role": m.Role})
+
+	s.notify(ctx, EVENT_MEMBER_CHANGED, []string{m.Id}, map[string]string{"action": "added", "scope": "app", "id": task.Id, "role": m.Role})
+
+	return m, nil
 }
 
 func (s *Server) AppMemberRemove(ctx micro.Context, task *AppMemberAddTask) (interface{}, error) {
@@ -420,6 +502,10 @@ func (s *Server) AppMemberRemove(ctx micro.Context, task *AppMemberAddTask) (int
 		return nil, err
 	}
 
+	s.emitEvent(ctx, WEBHOOK_SCOPE_APP, task.Id, EVENT_MEMBER_CHANGED, map[string]interface{}{"action": "remove", "uid": u.Id})
+
+	s.notify(ctx, EVENT_MEMBER_CHANGED, []string{u.Id}, map[string]string{"action": "removed", "scope": "app", "id": task.Id})
+
 	return nil, nil
 }
 
@@ -459,17 +545,7 @@ func (s *Server) AppVerUp(ctx micro.Context, task *AppVerUpTask) (*AppVerUpResul
 		return nil, err
 	}
 
-	client, err := service.GetClient(ctx, config.Db)
-
-	if err != nil {
-		return nil, err
-	}
-
-	cc := grpc.NewGRPCContext(ctx)
-
-	collection := client.Collection(config.Collection)
-
-	_, err = collection.Get(cc, fmt.Sprintf("app/%s/%s/info.json", task.Id, task.Ver))
+	_, err = config.Store().Get(ctx, fmt.Sprintf("app/%s/%s/info.json", task.Id, task.Ver))
 
 	if !IsErrno(err, ERRNO_NOT_FOUND) {
 		return nil, errors.Errorf(ERRNO_APP_VER, "The app version already exists and cannot be uploaded")
@@ -522,16 +598,6 @@ func (s *Server) AppVerDone(ctx micro.Context, task *AppVerDoneTask) (interface{
 		return nil, err
 	}
 
-	client, err := service.GetClient(ctx, config.Db)
-
-	if err != nil {
-		return nil, err
-	}
-
-	cc := grpc.NewGRPCContext(ctx)
-
-	collection := client.Collection(config.Collection)
-
 	info := map[string]interface{}{}
 
 	dynamic.Each(task.Info, func(key interface{}, value interface{}) bool {
@@ -539,28 +605,51 @@ func (s *Server) AppVerDone(ctx micro.Context, task *AppVerDoneTask) (interface{
 		return true
 	})
 
+	abilities := appAbilities(info)
+
 	info["appid"] = task.Id
 	info["ver"] = task.Ver
 
-	_, err = collection.Exec(cc, `
-	(function(){
-		var id = ${id};
-		var info = ${info};
-		var ver = ${ver};
-		var k_info = collection + 'app/' + id + '/' + ver + '/info.json';
-		var text = get(k_info);
-		if(text) {
-			throw 'The app version already exists and cannot be uploaded'
-		}
-		text = JSON.stringify(info);
-		put(k_info,text)
-	})()
-	`, map[string]interface{}{"id": task.Id, "info": info, "ver": task.Ver})
+	app, containers, err := config.Store().PublishAppVer(ctx, task.Id, task.Ver, info, abilities, task.Staged, uid)
 
 	if err != nil {
 		return nil, err
 	}
 
+	config.Cache().Del(ctx, fmt.Sprintf("%sa_%s", config.Prefix, task.Id), fmt.Sprintf("%sav_%s_%s", config.Prefix, task.Id, task.Ver))
+
+	for cid, ver := range containers {
+
+		config.Cache().Del(ctx, fmt.Sprintf("%sc_%s", config.Prefix, cid))
+
+		err = s.publishContainerVer(ctx, cid, ver)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.emitEvent(ctx, WEBHOOK_SCOPE_APP, task.Id, EVENT_VERSION_PUBLISHED, map[string]interface{}{"appid": task.Id, "ver": task.Ver, "staged": task.Staged, "latest": app.Ver == task.Ver})
+
+	if !task.Staged {
+		s.notifyMembers(ctx, "app", task.Id, false, EVENT_VERSION_PUBLISHED, map[string]string{"appid": task.Id, "ver": task.Ver})
+	}
+
+	if app.Visibility == VISIBILITY_PUBLIC {
+
+		err = s.updateCatalog(ctx, app.Id, true)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.indexApp(ctx, app)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return info, nil
 }
 
@@ -596,49 +685,17 @@ func (s *Server) AppVerInfoGet(ctx micro.Context, task *AppVerInfoGetTask) (inte
 		return nil, err
 	}
 
-	redis, err := redis.GetRedis(ctx, SERVICE_REDIS)
-
-	if err != nil {
-		return nil, err
-	}
-
 	var info interface{} = nil
 
-	key_av := fmt.Sprintf("%sav_%s_%s", config.Prefix, task.Id, task.Ver)
-
-	{
-		text, err := redis.Get(key_av)
-		if err == nil && text != "" {
-			err = json.Unmarshal([]byte(text), &info)
-			if err == nil {
-				return info, nil
-			}
-		}
-	}
-
-	client, err := service.GetClient(ctx, config.Db)
-
-	if err != nil {
-		return nil, err
-	}
-
-	cc := grpc.NewGRPCContext(ctx)
-
-	collection := client.Collection(config.Collection)
-
-	text, err := collection.Get(cc, fmt.Sprintf("app/%s/%s/info.json", task.Id, task.Ver))
+	err = config.Cache().GetObject(ctx, "app_ver", fmt.Sprintf("%sav_%s_%s", config.Prefix, task.Id, task.Ver), &info, s.loader(ctx, fmt.Sprintf("app/%s/%s/info.json", task.Id, task.Ver)))
 
 	if err != nil {
-		if err == source.ErrNoSuchKey {
+		if IsErrno(err, ERRNO_NOT_FOUND) || err == source.ErrNoSuchKey {
 			return nil, errors.Errorf(ERRNO_APP_VER, "App version that doesn't exist")
 		}
 		return nil, err
 	}
 
-	redis.Set(key_av, string(text), time.Duration(config.CacheExpires)*time.Second)
-
-	json.Unmarshal(text, &info)
-
 	return info, nil
 }
 
@@ -674,21 +731,20 @@ func (s *Server) AppApprove(ctx micro.Context, task *AppApproveTask) (interface{
 		return nil, err
 	}
 
-	client, err := service.GetClient(ctx, config.Db)
+	err = config.Store().Put(ctx, fmt.Sprintf("app/%s/approve/%s", task.Id, task.ContainerId), []byte("{}"))
 
 	if err != nil {
 		return nil, err
 	}
 
-	cc := grpc.NewGRPCContext(ctx)
+	config.Cache().Del(ctx, fmt.Sprintf("%sap_%s_%s", config.Prefix, task.Id, task.ContainerId))
 
-	collection := client.Collection(config.Collection)
+	data := map[string]interface{}{"appid": task.Id, "containerId": task.ContainerId}
 
-	err = collection.Put(cc, fmt.Sprintf("app/%s/approve/%s", task.Id, task.ContainerId), []byte("{}"))
+	s.emitEvent(ctx, WEBHOOK_SCOPE_APP, task.Id, EVENT_APP_APPROVED, data)
+	s.emitEvent(ctx, WEBHOOK_SCOPE_CONTAINER, task.ContainerId, EVENT_APP_APPROVED, data)
 
-	if err != nil {
-		return nil, err
-	}
+	s.notifyMembers(ctx, "container", task.ContainerId, true, EVENT_APP_APPROVED, map[string]string{"appid": task.Id, "containerId": task.ContainerId})
 
 	return map[string]interface{}{}, nil
 }
@@ -725,21 +781,18 @@ func (s *Server) AppUnapprove(ctx micro.Context, task *AppUnapproveTask) (interf
 		return nil, err
 	}
 
-	client, err := service.GetClient(ctx, config.Db)
+	err = config.Store().Del(ctx, fmt.Sprintf("app/%s/approve/%s", task.Id, task.ContainerId))
 
 	if err != nil {
 		return nil, err
 	}
 
-	cc := grpc.NewGRPCContext(ctx)
-
-	collection := client.Collection(config.Collection)
+	config.Cache().Del(ctx, fmt.Sprintf("%sap_%s_%s", config.Prefix, task.Id, task.ContainerId))
 
-	err = collection.Del(cc, fmt.Sprintf("app/%s/approve/%s", task.Id, task.ContainerId))
+	data := map[string]interface{}{"appid": task.Id, "containerId": task.ContainerId}
 
-	if err != nil {
-		return nil, err
-	}
+	s.emitEvent(ctx, WEBHOOK_SCOPE_APP, task.Id, EVENT_APP_UNAPPROVED, data)
+	s.emitEvent(ctx, WEBHOOK_SCOPE_CONTAINER, task.ContainerId, EVENT_APP_UNAPPROVED, data)
 
 	return map[string]interface{}{}, nil
 }
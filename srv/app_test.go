@@ -0,0 +1,488 @@
+package srv
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ability-sh/abi-lib/dynamic"
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+func TestCompareVer(t *testing.T) {
+
+	cases := []struct {
+		a string
+		b string
+		r int
+	}{
+		{"1.0", "1.0.0", 0},
+		{"1.0.1", "1.0", 1},
+		{"1.10", "1.9", 1},
+		{"1.0.0-2", "1.0.0-10", -1},
+		{"1.0", "", 1},
+		{"", "1.0", -1},
+		{"", "", 0},
+	}
+
+	for _, c := range cases {
+		if r := compareVer(c.a, c.b); r != c.r {
+			t.Fatalf("compareVer(%q, %q) = %d, expected %d", c.a, c.b, r, c.r)
+		}
+	}
+}
+
+func TestAppSet(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	token := e.login("owner@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		app, err := e.s.AppCreate(ctx, &AppCreateTask{Token: token, Info: map[string]interface{}{"title": "Demo"}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		app, err = e.s.AppSet(ctx, &AppSetTask{Token: token, Id: app.Id, PatchType: PATCH_MERGE, Patch: map[string]interface{}{"tags": []interface{}{"tool"}}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if app.Rev != 1 || dynamic.StringValue(dynamic.Get(app.Info, "title"), "") != "Demo" || dynamic.Get(app.Info, "tags") == nil {
+			t.Fatalf("unexpected app %+v", app)
+		}
+
+		_, err = e.s.AppSet(ctx, &AppSetTask{Token: token, Id: app.Id, Visibility: VISIBILITY_PUBLIC, ExpectedRev: 2})
+
+		assertErrno(t, err, ERRNO_CONFLICT)
+
+		_, err = e.s.AppSet(ctx, &AppSetTask{Token: token, Id: app.Id, PatchType: PATCH_JSON, Patch: []interface{}{
+			map[string]interface{}{"op": "remove", "path": "/missing"},
+		}})
+
+		assertErrno(t, err, ERRNO_INPUT_DATA)
+
+		app, err = e.s.AppSet(ctx, &AppSetTask{Token: token, Id: app.Id, Visibility: VISIBILITY_PUBLIC, ExpectedRev: 1})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if app.Rev != 2 || app.Visibility != VISIBILITY_PUBLIC {
+			t.Fatalf("unexpected app %+v", app)
+		}
+
+		rs, err := e.s.AppCatalog(ctx, &AppCatalogTask{})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rs.Total != 1 || rs.Items[0].Id != app.Id {
+			t.Fatalf("unexpected catalog %+v", rs)
+		}
+	})
+}
+
+func TestAppVerDone(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	token := e.login("owner@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		app, err := e.s.AppCreate(ctx, &AppCreateTask{Token: token, Visibility: VISIBILITY_PUBLIC})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := func(ver string, staged bool) error {
+			_, err := e.s.AppVerDone(ctx, &AppVerDoneTask{Token: token, Id: app.Id, Ver: ver, Staged: staged, Info: map[string]interface{}{"web": map[string]interface{}{}}})
+			return err
+		}
+
+		latest := func() string {
+			a, err := e.s.getApp(ctx, app.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return a.Ver
+		}
+
+		for _, ver := range []string{"1.2", "1.10", "1.9"} {
+			if err := done(ver, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if v := latest(); v != "1.10" {
+			t.Fatalf("expected latest 1.10, got %s", v)
+		}
+
+		assertErrno(t, done("1.9", false), ERRNO_APP_VER)
+
+		if err := done("2.0", true); err != nil {
+			t.Fatal(err)
+		}
+
+		if v := latest(); v != "1.10" {
+			t.Fatalf("a staged version must not become latest, got %s", v)
+		}
+	})
+}
+
+func TestRollout(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	token := e.login("owner@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		app, err := e.s.AppCreate(ctx, &AppCreateTask{Token: token, Visibility: VISIBILITY_PUBLIC})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, v := range []struct {
+			ver    string
+			staged bool
+		}{{"1.0", false}, {"2.0", true}, {"0.9", true}} {
+			_, err = e.s.AppVerDone(ctx, &AppVerDoneTask{Token: token, Id: app.Id, Ver: v.ver, Staged: v.staged, Info: map[string]interface{}{"web": map[string]interface{}{}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, err = e.s.RolloutCreate(ctx, &RolloutCreateTask{Token: token, Appid: app.Id, Ver: "0.9", Steps: []int{50, 100}})
+
+		assertErrno(t, err, ERRNO_CONFLICT)
+
+		r, err := e.s.RolloutCreate(ctx, &RolloutCreateTask{Token: token, Appid: app.Id, Ver: "2.0", Steps: []int{50, 100}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.BaseVer != "1.0" || r.State != ROLLOUT_STATE_RUNNING {
+			t.Fatalf("unexpected rollout %+v", r)
+		}
+
+		_, err = e.s.AppVerDone(ctx, &AppVerDoneTask{Token: token, Id: app.Id, Ver: "3.0", Info: map[string]interface{}{"web": map[string]interface{}{}}})
+
+		assertErrno(t, err, ERRNO_CONFLICT)
+
+		for i := 0; i < 2; i++ {
+			r, err = e.s.RolloutAdvance(ctx, &RolloutTask{Token: token, Appid: app.Id})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if r.State != ROLLOUT_STATE_COMPLETED {
+			t.Fatalf("unexpected rollout %+v", r)
+		}
+
+		a, err := e.s.getApp(ctx, app.Id)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if a.Ver != "2.0" || len(a.Abilities) != 1 || a.Abilities[0] != "web" {
+			t.Fatalf("unexpected app %+v", a)
+		}
+	})
+}
+
+func TestRolloutState(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	token := e.login("owner@example.com")
+
+	appid := ""
+
+	e.ctx(func(ctx micro.Context) {
+
+		app, err := e.s.AppCreate(ctx, &AppCreateTask{Token: token, Visibility: VISIBILITY_PUBLIC})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		appid = app.Id
+
+		for _, v := range []struct {
+			ver    string
+			staged bool
+		}{{"1.0", false}, {"2.0", true}} {
+			_, err = e.s.AppVerDone(ctx, &AppVerDoneTask{Token: token, Id: app.Id, Ver: v.ver, Staged: v.staged, Info: map[string]interface{}{"web": map[string]interface{}{}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		c, err := e.s.ContainerCreate(ctx, &ContainerCreateTask{Token: token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err = e.s.ContainerAppSet(ctx, &ContainerAppSetTask{Token: token, Id: c.Id, Appid: app.Id, Channel: CHANNEL_LATEST, Ability: "web"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.RolloutGet(ctx, &RolloutTask{Token: token, Appid: app.Id})
+
+		assertErrno(t, err, ERRNO_NOT_FOUND)
+
+		_, err = e.s.RolloutPause(ctx, &RolloutTask{Token: token, Appid: app.Id})
+
+		assertErrno(t, err, ERRNO_NOT_FOUND)
+
+		_, err = e.s.RolloutCreate(ctx, &RolloutCreateTask{Token: token, Appid: app.Id, Ver: "2.0", Steps: []int{100}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err = e.s.getContainer(ctx, c.Id)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		now := time.Now().Unix()
+
+		apps := []*ContainerAppStatus{{Appid: app.Id, Ver: "2.0", Ability: "web", Health: "down"}}
+
+		_, err = e.s.ContainerReport(ctx, &ContainerReportTask{Id: c.Id, Timestamp: now, Nonce: "n1", Ver: c.Ver, Apps: apps, Sign: e.config(ctx).Sign(c.Secret, map[string]interface{}{
+			"id":        c.Id,
+			"timestamp": now,
+			"nonce":     "n1",
+			"ver":       c.Ver,
+			"health":    "",
+			"agentVer":  "",
+			"apps":      signApps(apps),
+		})})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rs, err := e.s.RolloutGet(ctx, &RolloutTask{Token: token, Appid: app.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rs.Rollout.Ver != "2.0" || rs.Health.Total != 1 || rs.Health.Targeted != 1 || rs.Health.Online != 1 || rs.Health.Updated != 1 || rs.Health.Unhealthy != 1 {
+			t.Fatalf("unexpected rollout %+v %+v", rs.Rollout, rs.Health)
+		}
+
+		r, err := e.s.RolloutPause(ctx, &RolloutTask{Token: token, Appid: app.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.State != ROLLOUT_STATE_PAUSED {
+			t.Fatalf("unexpected rollout %+v", r)
+		}
+
+		_, err = e.s.RolloutAdvance(ctx, &RolloutTask{Token: token, Appid: app.Id})
+
+		assertErrno(t, err, ERRNO_CONFLICT)
+
+		_, err = e.s.RolloutPause(ctx, &RolloutTask{Token: token, Appid: app.Id})
+
+		assertErrno(t, err, ERRNO_CONFLICT)
+
+		r, err = e.s.RolloutResume(ctx, &RolloutTask{Token: token, Appid: app.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.State != ROLLOUT_STATE_RUNNING {
+			t.Fatalf("unexpected rollout %+v", r)
+		}
+
+		_, err = e.s.RolloutResume(ctx, &RolloutTask{Token: token, Appid: app.Id})
+
+		assertErrno(t, err, ERRNO_CONFLICT)
+
+		r, err = e.s.RolloutAbort(ctx, &RolloutTask{Token: token, Appid: app.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.State != ROLLOUT_STATE_ABORTED {
+			t.Fatalf("unexpected rollout %+v", r)
+		}
+
+		_, err = e.s.RolloutAbort(ctx, &RolloutTask{Token: token, Appid: app.Id})
+
+		assertErrno(t, err, ERRNO_NOT_FOUND)
+
+		// 中止后不再有目标容器, 最新版本不变
+		rs, err = e.s.RolloutGet(ctx, &RolloutTask{Token: token, Appid: app.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rs.Rollout.State != ROLLOUT_STATE_ABORTED || rs.Health.Total != 1 || rs.Health.Targeted != 0 {
+			t.Fatalf("unexpected rollout %+v %+v", rs.Rollout, rs.Health)
+		}
+
+		a, err := e.s.getApp(ctx, app.Id)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if a.Ver != "1.0" {
+			t.Fatalf("unexpected app %+v", a)
+		}
+	})
+
+	other := e.login("other@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		_, err := e.s.RolloutGet(ctx, &RolloutTask{Token: other, Appid: appid})
+
+		assertErrno(t, err, ERRNO_NOT_FOUND)
+
+		_, err = e.s.RolloutAbort(ctx, &RolloutTask{Token: other, Appid: appid})
+
+		assertErrno(t, err, ERRNO_NOT_FOUND)
+	})
+}
+
+func TestAppMember(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	token := e.login("owner@example.com")
+
+	other := e.login("other@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		app, err := e.s.AppCreate(ctx, &AppCreateTask{Token: token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.AppGet(ctx, &AppGetTask{Token: other, Id: app.Id})
+
+		assertErrno(t, err, ERRNO_NOT_FOUND)
+
+		m, err := e.s.AppMemberAdd(ctx, &AppMemberAddTask{Token: token, Id: app.Id, Email: "other@example.com", Role: ROLE_READ_ONLY})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m.Role != ROLE_READ_ONLY {
+			t.Fatalf("unexpected member %+v", m)
+		}
+
+		a, err := e.s.AppGet(ctx, &AppGetTask{Token: other, Id: app.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if a.Id != app.Id {
+			t.Fatalf("unexpected app %+v", a)
+		}
+
+		_, err = e.s.AppMemberAdd(ctx, &AppMemberAddTask{Token: other, Id: app.Id, Email: "third@example.com", Role: ROLE_READ_ONLY})
+
+		assertErrno(t, err, ERRNO_NO_PERMISSION)
+
+		_, err = e.s.AppMemberRemove(ctx, &AppMemberAddTask{Token: token, Id: app.Id, Email: "owner@example.com"})
+
+		assertErrno(t, err, ERRNO_MEMBER)
+
+		_, err = e.s.AppMemberRemove(ctx, &AppMemberAddTask{Token: token, Id: app.Id, Email: "other@example.com"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.AppGet(ctx, &AppGetTask{Token: other, Id: app.Id})
+
+		assertErrno(t, err, ERRNO_NOT_FOUND)
+	})
+}
+
+func TestAppVerUp(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	token := e.login("owner@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		app, err := e.s.AppCreate(ctx, &AppCreateTask{Token: token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.AppVerUp(ctx, &AppVerUpTask{Token: token, Id: app.Id, Ver: "1.0"})
+
+		assertErrno(t, err, ERRNO_INPUT_DATA)
+
+		rs, err := e.s.AppVerUp(ctx, &AppVerUpTask{Token: token, Id: app.Id, Ver: "1.0", Ability: "web"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(rs.Url, "app/"+app.Id+"/1.0/web.zip") {
+			t.Fatalf("unexpected url %s", rs.Url)
+		}
+
+		_, err = e.s.AppVerInfoGet(ctx, &AppVerInfoGetTask{Token: token, Id: app.Id, Ver: "1.0"})
+
+		assertErrno(t, err, ERRNO_APP_VER)
+
+		_, err = e.s.AppVerDone(ctx, &AppVerDoneTask{Token: token, Id: app.Id, Ver: "1.0", Info: map[string]interface{}{"web": map[string]interface{}{"size": 1}}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := e.s.AppVerInfoGet(ctx, &AppVerInfoGetTask{Token: token, Id: app.Id, Ver: "1.0"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if dynamic.IntValue(dynamic.Get(dynamic.Get(info, "web"), "size"), 0) != 1 {
+			t.Fatalf("unexpected info %+v", info)
+		}
+
+		// 已经完成的版本不能再上传
+		_, err = e.s.AppVerUp(ctx, &AppVerUpTask{Token: token, Id: app.Id, Ver: "1.0", Ability: "web"})
+
+		assertErrno(t, err, ERRNO_APP_VER)
+	})
+}
@@ -0,0 +1,481 @@
+package srv
+
+import (
+	"container/list"
+	"context"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-micro/micro"
+	"github.com/ability-sh/abi-micro/redis"
+	R "github.com/go-redis/redis/v8"
+)
+
+/**
+* Redis 中表示不存在的值
+**/
+const CACHE_NOT_FOUND = "\x00"
+
+/**
+* 缓存失效广播频道 {prefix}ci, 消息为换行分隔的 key
+**/
+const CACHE_CHANNEL = "ci"
+
+type cacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+type cacheCall struct {
+	wg    sync.WaitGroup
+	value []byte
+	err   error
+}
+
+type cacheCounter struct {
+	localHit    int64
+	redisHit    int64
+	negativeHit int64
+	miss        int64
+	redisError  int64
+}
+
+/**
+* 读取 {key}@v 中的版本号 v 和 {key}@{v} 中的值
+**/
+var cacheGetScript = R.NewScript(`
+local v = redis.call('GET', KEYS[1] .. '@v') or '0'
+return {v, redis.call('GET', KEYS[1] .. '@' .. v)}
+`)
+
+/**
+* 两级缓存, 进程内 LRU 在前, Redis 在后
+* 同一进程内同一个 key 只有一个请求回源, 不存在的 key 缓存 negative 秒, Redis 过期时间加随机抖动
+* Redis 中的值保存在 {key}@{版本号}, 删除时版本号加一并广播, 其它进程收到后删除进程内缓存
+* 回源期间 key 被删除时, 旧值写入旧版本, 不会被读到
+**/
+type Cache struct {
+	size     int
+	local    time.Duration
+	expires  time.Duration
+	negative time.Duration
+	jitter   float64
+	channel  string
+
+	lock    sync.Mutex
+	items   map[string]*list.Element
+	lru     *list.List
+	calls   map[string]*cacheCall
+	counter map[string]*cacheCounter
+	gen     int64
+	ps      *R.PubSub
+}
+
+func newCache(config *ConfigService) *Cache {
+	return &Cache{
+		size:     config.CacheLocalSize,
+		local:    time.Duration(config.CacheLocalExpires) * time.Second,
+		expires:  time.Duration(config.CacheExpires) * time.Second,
+		negative: time.Duration(config.CacheNegativeExpires) * time.Second,
+		jitter:   float64(config.CacheJitter) / 100,
+		channel:  config.Prefix + CACHE_CHANNEL,
+		items:    map[string]*list.Element{},
+		lru:      list.New(),
+		calls:    map[string]*cacheCall{},
+		counter:  map[string]*cacheCounter{},
+	}
+}
+
+/**
+* 订阅失效广播, 每个进程只建立一个订阅, 失败时下次调用重试
+* 断线期间丢失的广播由进程内缓存的过期时间兜底
+**/
+func (c *Cache) subscribe(ctx micro.Context) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.ps != nil || c.size <= 0 || c.local <= 0 {
+		return
+	}
+
+	client, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		ctx.Println("cache", "subscribe", err)
+		return
+	}
+
+	c.ps = client.Subscribe(context.Background(), c.channel)
+
+	go c.run(c.ps)
+}
+
+func (c *Cache) run(ps *R.PubSub) {
+	for msg := range ps.Channel() {
+		c.invalidate(strings.Split(msg.Payload, "\n"))
+	}
+}
+
+/**
+* 删除进程内缓存, 正在回源的请求不再写入进程内缓存
+**/
+func (c *Cache) invalidate(keys []string) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.gen++
+
+	for _, key := range keys {
+		if e, ok := c.items[key]; ok {
+			c.lru.Remove(e)
+			delete(c.items, key)
+		}
+	}
+}
+
+func (c *Cache) getCounter(kind string) *cacheCounter {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	n, ok := c.counter[kind]
+
+	if !ok {
+		n = &cacheCounter{}
+		c.counter[kind] = n
+	}
+
+	return n
+}
+
+func (c *Cache) ttl(d time.Duration) time.Duration {
+	if c.jitter <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Float64()*c.jitter*float64(d))
+}
+
+func (c *Cache) getLocal(key string) ([]byte, bool) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.items[key]
+
+	if !ok {
+		return nil, false
+	}
+
+	item := e.Value.(*cacheEntry)
+
+	if time.Now().After(item.expires) {
+		c.lru.Remove(e)
+		delete(c.items, key)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(e)
+
+	return item.value, true
+}
+
+/**
+* gen 为开始读取时的失效计数, 期间有失效广播时不写入
+**/
+func (c *Cache) setLocal(key string, value []byte, gen int64) {
+
+	if c.size <= 0 || c.local <= 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.gen != gen {
+		return
+	}
+
+	if e, ok := c.items[key]; ok {
+		item := e.Value.(*cacheEntry)
+		item.value = value
+		item.expires = time.Now().Add(c.local)
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.items[key] = c.lru.PushFront(&cacheEntry{key: key, value: value, expires: time.Now().Add(c.local)})
+
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.items, e.Value.(*cacheEntry).key)
+	}
+}
+
+func cacheValue(value []byte) ([]byte, error) {
+	if value == nil {
+		return nil, errors.Errorf(ERRNO_NOT_FOUND, "Not found")
+	}
+	return value, nil
+}
+
+/**
+* 读取缓存, 未命中时调用 load 回源, load 返回 ERRNO_NOT_FOUND 时缓存为不存在
+* Redis 出错时记录日志并直接回源
+**/
+func (c *Cache) Get(ctx micro.Context, kind string, key string, load func() ([]byte, error)) ([]byte, error) {
+
+	c.subscribe(ctx)
+
+	n := c.getCounter(kind)
+
+	if value, ok := c.getLocal(key); ok {
+		if value == nil {
+			atomic.AddInt64(&n.negativeHit, 1)
+		} else {
+			atomic.AddInt64(&n.localHit, 1)
+		}
+		return cacheValue(value)
+	}
+
+	c.lock.Lock()
+
+	if call, ok := c.calls[key]; ok {
+		c.lock.Unlock()
+		call.wg.Wait()
+		return call.value, call.err
+	}
+
+	call := &cacheCall{}
+	call.wg.Add(1)
+	c.calls[key] = call
+
+	gen := c.gen
+
+	c.lock.Unlock()
+
+	call.value, call.err = c.get(ctx, n, key, gen, load)
+
+	c.lock.Lock()
+	delete(c.calls, key)
+	c.lock.Unlock()
+
+	call.wg.Done()
+
+	return call.value, call.err
+}
+
+func (c *Cache) get(ctx micro.Context, n *cacheCounter, key string, gen int64, load func() ([]byte, error)) ([]byte, error) {
+
+	client, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		atomic.AddInt64(&n.redisError, 1)
+		ctx.Println("cache", err)
+		client = nil
+	}
+
+	ver := ""
+
+	if client != nil {
+
+		rs, err := cacheGetScript.Run(context.Background(), client, []string{key}).Slice()
+
+		if err == nil && len(rs) == 2 {
+
+			ver, _ = rs[0].(string)
+
+			if text, ok := rs[1].(string); ok {
+
+				if text == CACHE_NOT_FOUND {
+					atomic.AddInt64(&n.negativeHit, 1)
+					c.setLocal(key, nil, gen)
+					return cacheValue(nil)
+				}
+
+				atomic.AddInt64(&n.redisHit, 1)
+				c.setLocal(key, []byte(text), gen)
+				return []byte(text), nil
+			}
+
+		} else {
+			atomic.AddInt64(&n.redisError, 1)
+			ctx.Println("cache", key, err)
+		}
+	}
+
+	atomic.AddInt64(&n.miss, 1)
+
+	value, err := load()
+
+	if err != nil {
+
+		if !IsErrno(err, ERRNO_NOT_FOUND) {
+			return nil, err
+		}
+
+		if ver != "" && c.negative > 0 {
+			err = client.Set(context.Background(), key+"@"+ver, CACHE_NOT_FOUND, c.ttl(c.negative)).Err()
+			if err != nil {
+				atomic.AddInt64(&n.redisError, 1)
+				ctx.Println("cache", key, err)
+			}
+		}
+
+		c.setLocal(key, nil, gen)
+
+		return cacheValue(nil)
+	}
+
+	if ver != "" {
+		err = client.Set(context.Background(), key+"@"+ver, string(value), c.ttl(c.expires)).Err()
+		if err != nil {
+			atomic.AddInt64(&n.redisError, 1)
+			ctx.Println("cache", key, err)
+		}
+	}
+
+	c.setLocal(key, value, gen)
+
+	return value, nil
+}
+
+/**
+* 读取缓存并解析 JSON
+**/
+func (c *Cache) GetObject(ctx micro.Context, kind string, key string, object interface{}, load func() ([]byte, error)) error {
+
+	value, err := c.Get(ctx, kind, key, load)
+
+	if err != nil {
+		return err
+	}
+
+	return unmarshalObject(value, object)
+}
+
+/**
+* 删除缓存, 在写入数据之后调用
+* Redis 中的版本号加一, 版本号的过期时间长于值的最长过期时间, 然后广播给所有进程删除进程内缓存
+**/
+func (c *Cache) Del(ctx micro.Context, keys ...string) {
+
+	if len(keys) == 0 {
+		return
+	}
+
+	c.subscribe(ctx)
+
+	c.invalidate(keys)
+
+	client, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		ctx.Println("cache", err)
+		return
+	}
+
+	expires := 2 * c.expires
+
+	if c.jitter > 1 {
+		expires = time.Duration(float64(c.expires) * (1 + c.jitter) * 2)
+	}
+
+	_, err = client.TxPipelined(context.Background(), func(p R.Pipeliner) error {
+		for _, key := range keys {
+			p.Incr(context.Background(), key+"@v")
+			p.Expire(context.Background(), key+"@v", expires)
+		}
+		p.Publish(context.Background(), c.channel, strings.Join(keys, "\n"))
+		return nil
+	})
+
+	if err != nil {
+		ctx.Println("cache", keys, err)
+	}
+}
+
+/**
+* 只删除进程内缓存, 用于收到其他通知时进程内缓存的删除广播可能还没有到达
+**/
+func (c *Cache) Evict(keys ...string) {
+	c.invalidate(keys)
+}
+
+func (c *Cache) Recycle() {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.ps != nil {
+		c.ps.Close()
+		c.ps = nil
+	}
+}
+
+func (c *Cache) Stats() map[string]*CacheStats {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	rs := map[string]*CacheStats{}
+
+	for kind, n := range c.counter {
+		rs[kind] = &CacheStats{
+			LocalHit:    atomic.LoadInt64(&n.localHit),
+			RedisHit:    atomic.LoadInt64(&n.redisHit),
+			NegativeHit: atomic.LoadInt64(&n.negativeHit),
+			Miss:        atomic.LoadInt64(&n.miss),
+			RedisError:  atomic.LoadInt64(&n.redisError),
+		}
+	}
+
+	return rs
+}
+
+/**
+* 从存储回源
+**/
+func (s *Server) loader(ctx micro.Context, key string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+
+		config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return config.Store().Get(ctx, key)
+	}
+}
+
+/**
+* 缓存命中统计, 只有管理员可以调用
+**/
+func (s *Server) CacheStatsGet(ctx micro.Context, task *CacheStatsGetTask) (map[string]*CacheStats, error) {
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !config.IsAdmin(uid) {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
+
+	return config.Cache().Stats(), nil
+}
@@ -0,0 +1,199 @@
+package srv
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+func TestCache(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	var loads int64 = 0
+
+	load := func() ([]byte, error) {
+		atomic.AddInt64(&loads, 1)
+		return []byte("v"), nil
+	}
+
+	notFound := func() ([]byte, error) {
+		atomic.AddInt64(&loads, 1)
+		return nil, errors.Errorf(ERRNO_NOT_FOUND, "Not found")
+	}
+
+	e.ctx(func(ctx micro.Context) {
+
+		cache := e.config(ctx).Cache()
+
+		get := func(key string, load func() ([]byte, error)) ([]byte, error) {
+			return cache.Get(ctx, "test", key, load)
+		}
+
+		for i := 0; i < 2; i++ {
+			v, err := get("test_k", load)
+			if err != nil || string(v) != "v" {
+				t.Fatalf("unexpected value %s %v", v, err)
+			}
+		}
+
+		// 进程内缓存失效后从 Redis 读取
+		cache.Evict("test_k")
+
+		_, err := get("test_k", load)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if loads != 1 {
+			t.Fatalf("expected 1 load, got %d", loads)
+		}
+
+		cache.Del(ctx, "test_k")
+
+		_, err = get("test_k", load)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if loads != 2 {
+			t.Fatalf("expected 2 loads, got %d", loads)
+		}
+
+		for i := 0; i < 2; i++ {
+			_, err = get("test_missing", notFound)
+			assertErrno(t, err, ERRNO_NOT_FOUND)
+		}
+
+		if loads != 3 {
+			t.Fatalf("expected 3 loads, got %d", loads)
+		}
+
+		s := cache.Stats()["test"]
+
+		if s == nil || s.Miss != 3 || s.LocalHit != 1 || s.RedisHit != 1 || s.NegativeHit != 1 {
+			t.Fatalf("unexpected stats %+v", s)
+		}
+	})
+
+	// 同一个 key 的并发读取只回源一次
+	loads = 0
+
+	wait := make(chan bool)
+
+	slow := func() ([]byte, error) {
+		atomic.AddInt64(&loads, 1)
+		<-wait
+		return []byte("v"), nil
+	}
+
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.ctx(func(ctx micro.Context) {
+				e.config(ctx).Cache().Get(ctx, "test", "test_slow", slow)
+			})
+		}()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	close(wait)
+
+	wg.Wait()
+
+	if loads != 1 {
+		t.Fatalf("expected 1 load, got %d", loads)
+	}
+}
+
+func TestCacheStatsGet(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	token := e.login("dev@example.com")
+
+	admin := e.loginAdmin("admin@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		_, err := e.s.CacheStatsGet(ctx, &CacheStatsGetTask{Token: token})
+
+		assertErrno(t, err, ERRNO_NO_PERMISSION)
+
+		e.config(ctx).Cache().Get(ctx, "test", "test_k", func() ([]byte, error) {
+			return []byte("v"), nil
+		})
+
+		rs, err := e.s.CacheStatsGet(ctx, &CacheStatsGetTask{Token: admin})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rs["test"] == nil || rs["test"].Miss != 1 {
+			t.Fatalf("unexpected stats %v", rs)
+		}
+	})
+}
+
+func TestCacheBroadcast(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	e.ctx(func(ctx micro.Context) {
+
+		config := e.config(ctx)
+
+		// 另一个实例, 共用 Redis
+		other := newCache(config)
+
+		defer other.Recycle()
+
+		value := "v1"
+
+		load := func() ([]byte, error) {
+			return []byte(value), nil
+		}
+
+		v, err := config.Cache().Get(ctx, "test", "test_k", load)
+
+		if err != nil || string(v) != "v1" {
+			t.Fatalf("unexpected value %s %v", v, err)
+		}
+
+		value = "v2"
+
+		other.Del(ctx, "test_k")
+
+		deadline := time.Now().Add(2 * time.Second)
+
+		for {
+
+			v, err = config.Cache().Get(ctx, "test", "test_k", load)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(v) == "v2" {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatal("the local cache was not invalidated by the broadcast")
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
@@ -0,0 +1,164 @@
+package srv
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ability-sh/abi-lib/dynamic"
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+func isVisibility(visibility string) bool {
+	return visibility == VISIBILITY_PRIVATE || visibility == VISIBILITY_PUBLIC || visibility == VISIBILITY_UNLISTED
+}
+
+/**
+* 更新公开应用目录, listed 为 false 时从目录中移除
+**/
+func (s *Server) updateCatalog(ctx micro.Context, id string, listed bool) error {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return err
+	}
+
+	return config.Store().SetCatalog(ctx, id, listed, time.Now().UnixMilli())
+}
+
+func (s *objectStore) SetCatalog(ctx micro.Context, id string, listed bool, mtime int64) error {
+	return s.update(ctx, func(tx *storeTx) error {
+
+		catalog := map[string]int64{}
+
+		_, err := tx.GetObject("catalog/app.json", &catalog)
+
+		if err != nil {
+			return err
+		}
+
+		_, ok := catalog[id]
+
+		if listed {
+			catalog[id] = mtime
+		} else if !ok {
+			return nil
+		} else {
+			delete(catalog, id)
+		}
+
+		return tx.PutObject("catalog/app.json", catalog)
+	})
+}
+
+func (s *Server) getCatalog(ctx micro.Context) (map[string]int64, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	catalog := map[string]int64{}
+
+	text, err := config.Store().Get(ctx, "catalog/app.json")
+
+	if err != nil {
+		if IsErrno(err, ERRNO_NOT_FOUND) {
+			return catalog, nil
+		}
+		return nil, err
+	}
+
+	unmarshalObject(text, &catalog)
+
+	return catalog, nil
+}
+
+func newAppCatalogItem(app *App) *AppCatalogItem {
+
+	tags := []string{}
+
+	dynamic.Each(dynamic.Get(app.Info, "tags"), func(key interface{}, value interface{}) bool {
+		tag := dynamic.StringValue(value, "")
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+		return true
+	})
+
+	return &AppCatalogItem{
+		Id:          app.Id,
+		Title:       dynamic.StringValue(dynamic.Get(app.Info, "title"), ""),
+		Description: dynamic.StringValue(dynamic.Get(app.Info, "description"), ""),
+		Tags:        tags,
+		Ver:         app.Ver,
+		Abilities:   app.Abilities,
+	}
+}
+
+func (s *Server) AppCatalog(ctx micro.Context, task *AppCatalogTask) (*AppCatalogResult, error) {
+
+	catalog, err := s.getCatalog(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+
+	for id, _ := range catalog {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		if catalog[ids[i]] == catalog[ids[j]] {
+			return ids[i] < ids[j]
+		}
+		return catalog[ids[i]] > catalog[ids[j]]
+	})
+
+	offset := task.Offset
+	limit := task.Limit
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	rs := &AppCatalogResult{Items: []*AppCatalogItem{}, Total: len(ids)}
+
+	if offset >= len(ids) {
+		return rs, nil
+	}
+
+	if offset+limit < len(ids) {
+		ids = ids[offset : offset+limit]
+	} else {
+		ids = ids[offset:]
+	}
+
+	// 只读取当前页的应用, 目录由 AppSet 等修改可见性的方法维护, 读取时跳过不再公开的应用, 不修改目录
+	for _, id := range ids {
+
+		app, err := s.getApp(ctx, id)
+
+		if err != nil {
+			if IsErrno(err, ERRNO_NOT_FOUND) {
+				continue
+			}
+			return nil, err
+		}
+
+		if app.Visibility != VISIBILITY_PUBLIC {
+			continue
+		}
+
+		rs.Items = append(rs.Items, newAppCatalogItem(app))
+	}
+
+	return rs, nil
+}
@@ -0,0 +1,87 @@
+package srv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+func TestAppCatalog(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	token := e.login("owner@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		ids := []string{}
+
+		for _, visibility := range []string{VISIBILITY_PUBLIC, VISIBILITY_PUBLIC, VISIBILITY_PRIVATE, VISIBILITY_PUBLIC} {
+
+			app, err := e.s.AppCreate(ctx, &AppCreateTask{Token: token, Visibility: visibility, Info: map[string]interface{}{"title": visibility}})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ids = append(ids, app.Id)
+
+			time.Sleep(2 * time.Millisecond)
+		}
+
+		rs, err := e.s.AppCatalog(ctx, &AppCatalogTask{Limit: 2})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rs.Total != 3 || len(rs.Items) != 2 || rs.Items[0].Id != ids[3] || rs.Items[1].Id != ids[1] {
+			t.Fatalf("unexpected catalog %+v", rs)
+		}
+
+		rs, err = e.s.AppCatalog(ctx, &AppCatalogTask{Offset: 2, Limit: 2})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rs.Total != 3 || len(rs.Items) != 1 || rs.Items[0].Id != ids[0] {
+			t.Fatalf("unexpected catalog %+v", rs)
+		}
+
+		// 修改可见性时从目录中移除
+		_, err = e.s.AppSet(ctx, &AppSetTask{Token: token, Id: ids[1], Visibility: VISIBILITY_UNLISTED})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 目录中残留的应用在读取时跳过, 不修改目录
+		err = e.config(ctx).Store().SetCatalog(ctx, "missing", true, time.Now().UnixMilli())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rs, err = e.s.AppCatalog(ctx, &AppCatalogTask{})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rs.Total != 3 || len(rs.Items) != 2 || rs.Items[0].Id != ids[3] || rs.Items[1].Id != ids[0] {
+			t.Fatalf("unexpected catalog %+v", rs)
+		}
+
+		catalog, err := e.s.getCatalog(ctx)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := catalog["missing"]; !ok || len(catalog) != 3 {
+			t.Fatalf("unexpected catalog index %v", catalog)
+		}
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"math/rand"
+	nethttp "net/http"
 	"sort"
 	"strconv"
 	"strings"
@@ -20,11 +21,22 @@ const (
 )
 
 type ConfigService struct {
-	name   string
-	config interface{}
+	name      string
+	config    interface{}
+	directory UserDirectory
+	signer    *jwtSigner
+	transport MailTransport
+	limits    map[string][]*rateLimit
+	cache     *Cache
+	store     Store
+
+	webhookClient *nethttp.Client
+
+	emailTemplates map[string]*mailTemplate
 
 	Db             string `json:"db"`
 	Collection     string `json:"collection"`
+	StoreDriver    string `json:"store"` //存储 db, memory, memory 只用于测试
 	Prefix         string `json:"prefix"`
 	CodeLength     int    `json:"code-length"`
 	EmailSubject   string `json:"email-subject"`
@@ -32,12 +44,80 @@ type ConfigService struct {
 	EmailBodyType  string `json:"email-body-type"`
 	EmailExpires   int    `json:"email-expires"`    //邮件超时时间(秒)
 	EmailReExpires int    `json:"email-re-expires"` //重发邮件间隔时间(秒)
-	EmailEnabled   bool   `json:"email-enabled"`
-	TokenExpires   int    `json:"token-expires"`
+	MailTransport  string `json:"mail-transport"`   //发送方式 smtp, file, memory, file 和 memory 只用于开发和测试
+	MailOutbox     string `json:"mail-outbox"`      //file 发送方式的 Maildir 目录
+	Dev            bool   `json:"dev"`              //开发模式, 只有开发模式可以使用 file 和 memory 发送方式
+	EmailTemplates string `json:"email-templates"`  //验证码邮件模版目录, 每个语言一个子目录
+	EmailLocale    string `json:"email-locale"`     //没有匹配的语言时使用的模版
+	Admins         string `json:"admins"`           //管理员 uid, 多个使用逗号分隔
+	TokenExpires   int    `json:"token-expires"`    //会话空闲超时时间(秒), 使用中自动延长
+	TokenMode      string `json:"token-mode"`       //会话令牌 redis, jwt
+	TokenMaxAge    int    `json:"token-max-age"`    //会话最长有效期(秒), 从登录开始计算, 使用中也不再延长
+	TokenSlideWait int    `json:"token-slide-wait"` //使用中延长会话的最小间隔(秒)
 	UserSvc        string `json:"user-svc"`
+	UserDirectory  string `json:"user-directory"` //用户目录 http, db, ldap
 	CacheExpires   int    `json:"cache-expires"`
 	AppUpExpires   int    `json:"app-up-expires"`
 	AppGetExpires  int    `json:"app-get-expires"`
+
+	ContainerOfflineExpires   int `json:"container-offline-expires"`   //心跳超时后标记为离线(秒)
+	ContainerWaitMax          int `json:"container-wait-max"`          //长轮询最长等待时间(秒)
+	ContainerHistoryRetention int `json:"container-history-retention"` //保留的容器历史版本数
+	ContainerReportWindow     int `json:"container-report-window"`     //状态上报的时间戳与服务器时间允许的误差(秒)
+
+	CacheLocalSize       int `json:"cache-local-size"`       //进程内缓存条数, 小于 0 时不使用进程内缓存
+	CacheLocalExpires    int `json:"cache-local-expires"`    //进程内缓存时间(秒)
+	CacheNegativeExpires int `json:"cache-negative-expires"` //不存在的 key 的缓存时间(秒)
+	CacheJitter          int `json:"cache-jitter"`           //缓存时间随机增加的百分比, 小于 0 时不增加
+
+	RateLimits map[string]string `json:"rate-limits"` //{方法名: "ip:10/60,uid:100/60"}, * 为没有单独配置的方法
+
+	SecretKey string `json:"secret-key"` //容器密钥加密主密钥(base64, 32字节)
+
+	WebhookRetry             int `json:"webhook-retry"`              //Webhook 最大投递次数
+	WebhookBackoff           int `json:"webhook-backoff"`            //Webhook 首次重试间隔(秒), 之后每次翻倍
+	WebhookTimeout           int `json:"webhook-timeout"`            //Webhook 请求超时时间(秒)
+	WebhookDeliveryRetention int `json:"webhook-delivery-retention"` //每个 Webhook 保留的投递记录数
+
+	WebhookAllowHosts string `json:"webhook-allow-hosts"` //允许解析到内网地址的 Webhook 主机名, 多个使用逗号分隔
+
+	LdapAddr         string `json:"ldap-addr"` //ldap://host:389 或 ldaps://host:636
+	LdapBindDN       string `json:"ldap-bind-dn"`
+	LdapBindPassword string `json:"ldap-bind-password"`
+	LdapBaseDN       string `json:"ldap-base-dn"`
+	LdapFilter       string `json:"ldap-filter"` //附加的搜索条件
+	LdapIdAttr       string `json:"ldap-id-attr"`
+	LdapMailAttr     string `json:"ldap-mail-attr"`
+	LdapStartTLS     bool   `json:"ldap-start-tls"` //ldap:// 连接后升级为 TLS
+	LdapTimeout      int    `json:"ldap-timeout"`   //连接和每次操作的超时时间(秒)
+
+	OidcIssuer       string `json:"oidc-issuer"` //为空时不启用 OIDC 登录
+	OidcClientId     string `json:"oidc-client-id"`
+	OidcClientSecret string `json:"oidc-client-secret"`
+	OidcRedirectUri  string `json:"oidc-redirect-uri"`
+	OidcScope        string `json:"oidc-scope"`
+
+	TotpIssuer string `json:"totp-issuer"` //身份验证器中显示的签发方名称
+
+	WebauthnRpId   string `json:"webauthn-rp-id"` //为空时不启用通行密钥登录
+	WebauthnRpName string `json:"webauthn-rp-name"`
+	WebauthnOrigin string `json:"webauthn-origin"` //如 https://store.example.com
+
+	JwtExpires int               `json:"jwt-expires"` //访问令牌有效期(秒), 刷新令牌使用 token-expires
+	JwtIssuer  string            `json:"jwt-issuer"`
+	JwtKid     string            `json:"jwt-kid"`  //当前签名使用的密钥
+	JwtKeys    map[string]string `json:"jwt-keys"` //{kid: PEM 私钥}, 轮换时保留旧密钥直到旧令牌过期
+
+	NotifyEnabled         bool   `json:"notify-enabled"` //是否发送通知邮件, 用户还需在通知设置中订阅
+	NotifyBodyType        string `json:"notify-body-type"`
+	NotifyMemberSubject   string `json:"notify-member-subject"`
+	NotifyMemberBody      string `json:"notify-member-body"`
+	NotifyVersionSubject  string `json:"notify-version-subject"`
+	NotifyVersionBody     string `json:"notify-version-body"`
+	NotifyApprovedSubject string `json:"notify-approved-subject"`
+	NotifyApprovedBody    string `json:"notify-approved-body"`
+	NotifyOfflineSubject  string `json:"notify-offline-subject"`
+	NotifyOfflineBody     string `json:"notify-offline-body"`
 }
 
 func newConfigService(name string, config interface{}) *ConfigService {
@@ -63,10 +143,29 @@ func (s *ConfigService) Config() interface{} {
 **/
 func (s *ConfigService) OnInit(ctx micro.Context) error {
 
+	s.JwtKeys = map[string]string{}
+	s.RateLimits = map[string]string{}
+
 	dynamic.SetValue(s, s.config)
 
 	rand.Seed(time.Now().UnixNano())
 
+	if s.StoreDriver == "" {
+		s.StoreDriver = STORE_DB
+	}
+
+	if s.ContainerHistoryRetention <= 0 {
+		s.ContainerHistoryRetention = 20
+	}
+
+	store, err := newStore(s)
+
+	if err != nil {
+		return err
+	}
+
+	s.store = store
+
 	if s.CodeLength <= 0 {
 		s.CodeLength = 6
 	}
@@ -91,14 +190,94 @@ func (s *ConfigService) OnInit(ctx micro.Context) error {
 		s.EmailReExpires = 60
 	}
 
+	if s.EmailLocale == "" {
+		s.EmailLocale = "en"
+	}
+
+	s.EmailLocale = strings.ToLower(s.EmailLocale)
+
+	emailTemplates, err := loadMailTemplates(s.EmailTemplates)
+
+	if err != nil {
+		return err
+	}
+
+	s.emailTemplates = emailTemplates
+
+	if s.MailTransport == "" {
+		s.MailTransport = MAIL_TRANSPORT_SMTP
+	}
+
+	if s.MailOutbox == "" {
+		s.MailOutbox = "./outbox"
+	}
+
+	if s.MailTransport != MAIL_TRANSPORT_SMTP && !s.Dev {
+		return fmt.Errorf("mail-transport %s requires dev: true", s.MailTransport)
+	}
+
+	transport, err := newMailTransport(s)
+
+	if err != nil {
+		return err
+	}
+
+	s.transport = transport
+
+	limits, err := parseRateLimits(s.RateLimits)
+
+	if err != nil {
+		return err
+	}
+
+	s.limits = limits
+
 	if s.TokenExpires <= 0 {
 		s.TokenExpires = 30 * 24 * 3600
 	}
 
+	if s.TokenMaxAge <= 0 {
+		s.TokenMaxAge = 90 * 24 * 3600
+	}
+
+	if s.TokenSlideWait <= 0 {
+		s.TokenSlideWait = 3600
+	}
+
+	if s.TokenMode == "" {
+		s.TokenMode = TOKEN_MODE_REDIS
+	}
+
+	if s.JwtExpires <= 0 {
+		s.JwtExpires = 900
+	}
+
+	if s.JwtIssuer == "" {
+		s.JwtIssuer = "abi-app-store"
+	}
+
 	if s.CacheExpires <= 0 {
 		s.CacheExpires = 300
 	}
 
+	if s.CacheLocalSize == 0 {
+		s.CacheLocalSize = 10000
+	}
+
+	if s.CacheLocalExpires <= 0 {
+		s.CacheLocalExpires = 5
+	}
+
+	if s.CacheNegativeExpires <= 0 {
+		s.CacheNegativeExpires = 30
+	}
+
+	if s.CacheJitter == 0 {
+		s.CacheJitter = 10
+	}
+
+	s.cache = newCache(s)
+
 	if s.AppUpExpires <= 0 {
 		s.AppUpExpires = 300
 	}
@@ -107,6 +286,127 @@ func (s *ConfigService) OnInit(ctx micro.Context) error {
 		s.AppGetExpires = 300
 	}
 
+	if s.ContainerOfflineExpires <= 0 {
+		s.ContainerOfflineExpires = 300
+	}
+
+	if s.ContainerReportWindow <= 0 {
+		s.ContainerReportWindow = 300
+	}
+
+	if s.ContainerWaitMax <= 0 {
+		s.ContainerWaitMax = 60
+	}
+
+	if s.WebhookRetry <= 0 {
+		s.WebhookRetry = 5
+	}
+
+	if s.WebhookBackoff <= 0 {
+		s.WebhookBackoff = 10
+	}
+
+	if s.WebhookTimeout <= 0 {
+		s.WebhookTimeout = 10
+	}
+
+	if s.WebhookDeliveryRetention <= 0 {
+		s.WebhookDeliveryRetention = 100
+	}
+
+	s.webhookClient = newWebhookClient(s)
+
+	if s.NotifyBodyType == "" {
+		s.NotifyBodyType = "text/plain"
+	}
+
+	if s.NotifyMemberSubject == "" {
+		s.NotifyMemberSubject = "You have been ${action} as a member of ${scope} ${id}"
+	}
+
+	if s.NotifyMemberBody == "" {
+		s.NotifyMemberBody = "You have been ${action} as a member of ${scope} ${id}, role: ${role}"
+	}
+
+	if s.NotifyVersionSubject == "" {
+		s.NotifyVersionSubject = "App ${appid} ${ver} has been published"
+	}
+
+	if s.NotifyVersionBody == "" {
+		s.NotifyVersionBody = "App ${appid} ${ver} has been published"
+	}
+
+	if s.NotifyApprovedSubject == "" {
+		s.NotifyApprovedSubject = "App ${appid} has been approved for container ${containerId}"
+	}
+
+	if s.NotifyApprovedBody == "" {
+		s.NotifyApprovedBody = "App ${appid} has been approved for container ${containerId}"
+	}
+
+	if s.NotifyOfflineSubject == "" {
+		s.NotifyOfflineSubject = "Container ${containerId} is offline"
+	}
+
+	if s.NotifyOfflineBody == "" {
+		s.NotifyOfflineBody = "Container ${containerId} has not reported since ${lastSeen}"
+	}
+
+	if s.OidcScope == "" {
+		s.OidcScope = "openid email"
+	}
+
+	if s.TotpIssuer == "" {
+		s.TotpIssuer = "abi-app-store"
+	}
+
+	if s.WebauthnRpName == "" {
+		s.WebauthnRpName = "abi-app-store"
+	}
+
+	if s.UserDirectory == "" {
+		s.UserDirectory = DIRECTORY_HTTP
+	}
+
+	if s.LdapFilter == "" {
+		s.LdapFilter = "(objectClass=person)"
+	}
+
+	if s.LdapIdAttr == "" {
+		s.LdapIdAttr = "uid"
+	}
+
+	if s.LdapMailAttr == "" {
+		s.LdapMailAttr = "mail"
+	}
+
+	if s.LdapTimeout <= 0 {
+		s.LdapTimeout = 10
+	}
+
+	directory, err := newUserDirectory(s)
+
+	if err != nil {
+		return err
+	}
+
+	s.directory = directory
+
+	if s.TokenMode != TOKEN_MODE_REDIS && s.TokenMode != TOKEN_MODE_JWT {
+		return fmt.Errorf("not support token-mode %s", s.TokenMode)
+	}
+
+	if len(s.JwtKeys) > 0 || s.TokenMode == TOKEN_MODE_JWT {
+
+		signer, err := newJwtSigner(s.JwtKid, s.JwtKeys)
+
+		if err != nil {
+			return err
+		}
+
+		s.signer = signer
+	}
+
 	return nil
 }
 
@@ -118,7 +418,36 @@ func (s *ConfigService) OnValid(ctx micro.Context) error {
 }
 
 func (s *ConfigService) Recycle() {
+	if s.cache != nil {
+		s.cache.Recycle()
+	}
+}
+
+func (s *ConfigService) Directory() UserDirectory {
+	return s.directory
+}
+
+func (s *ConfigService) Transport() MailTransport {
+	return s.transport
+}
+
+func (s *ConfigService) Cache() *Cache {
+	return s.cache
+}
+
+func (s *ConfigService) Store() Store {
+	return s.store
+}
+
+func (s *ConfigService) IsAdmin(uid string) bool {
+
+	for _, v := range strings.Split(s.Admins, ",") {
+		if uid != "" && strings.TrimSpace(v) == uid {
+			return true
+		}
+	}
 
+	return false
 }
 
 func (s *ConfigService) NewID(ctx micro.Context) string {
@@ -12,6 +12,7 @@ const (
 	ERRNO_SIGN            = 604
 	ERRNO_MEMBER          = 605
 	ERRNO_APP_VER         = 606
+	ERRNO_CONFLICT        = 607
 )
 
 const (
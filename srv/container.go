@@ -4,63 +4,48 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/ability-sh/abi-db/client/service"
 	"github.com/ability-sh/abi-lib/dynamic"
 	"github.com/ability-sh/abi-lib/errors"
-	"github.com/ability-sh/abi-lib/json"
-	"github.com/ability-sh/abi-micro/grpc"
 	"github.com/ability-sh/abi-micro/micro"
 	"github.com/ability-sh/abi-micro/oss"
-	"github.com/ability-sh/abi-micro/redis"
 )
 
+/**
+* 获取容器成员, 容器要求两步验证时当前会话需已完成两步验证
+**/
 func (s *Server) getContainerMember(ctx micro.Context, id string, uid string) (*Member, error) {
 
-	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+	member, err := s.loadContainerMember(ctx, id, uid)
 
 	if err != nil {
 		return nil, err
 	}
 
-	redis, err := redis.GetRedis(ctx, SERVICE_REDIS)
+	err = s.checkContainerMfa(ctx, id)
 
 	if err != nil {
 		return nil, err
 	}
 
-	u := Member{}
+	return member, nil
+}
 
-	key_cm := fmt.Sprintf("%scm_%s_%s", config.Prefix, id, uid)
-	{
-		text, err := redis.Get(key_cm)
-		if err == nil && text != "" {
-			err = json.Unmarshal([]byte(text), &u)
-			if err == nil {
-				return &u, nil
-			}
-		}
-	}
+func (s *Server) loadContainerMember(ctx micro.Context, id string, uid string) (*Member, error) {
 
-	client, err := service.GetClient(ctx, config.Db)
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
 
 	if err != nil {
 		return nil, err
 	}
 
-	cc := grpc.NewGRPCContext(ctx)
-
-	collection := client.Collection(config.Collection)
+	u := Member{}
 
-	text, err := collection.Get(cc, fmt.Sprintf("container/%s/%s", id, uid))
+	err = config.Cache().GetObject(ctx, "container_member", fmt.Sprintf("%scm_%s_%s", config.Prefix, id, uid), &u, s.memberLoader(ctx, "container", id, uid))
 
 	if err != nil {
 		return nil, err
 	}
 
-	redis.Set(key_cm, string(text), time.Duration(config.CacheExpires)*time.Second)
-
-	json.Unmarshal(text, &u)
-
 	return &u, nil
 }
 
@@ -72,25 +57,9 @@ func (s *Server) addContainerMember(ctx micro.Context, id string, uid string, ro
 		return nil, err
 	}
 
-	client, err := service.GetClient(ctx, config.Db)
-
-	if err != nil {
-		return nil, err
-	}
-
-	redis, err := redis.GetRedis(ctx, SERVICE_REDIS)
-
-	if err != nil {
-		return nil, err
-	}
-
-	cc := grpc.NewGRPCContext(ctx)
-
-	collection := client.Collection(config.Collection)
-
 	member := &Member{Id: uid, Role: role}
 
-	err = collection.PutObject(cc, fmt.Sprintf("container/%s/%s", id, uid), member)
+	err = config.Store().PutMember(ctx, "container", id, member)
 
 	if err != nil {
 		return nil, err
@@ -98,7 +67,7 @@ func (s *Server) addContainerMember(ctx micro.Context, id string, uid string, ro
 
 	key_cm := fmt.Sprintf("%scm_%s_%s", config.Prefix, id, uid)
 
-	redis.Del(key_cm)
+	config.Cache().Del(ctx, key_cm)
 
 	return member, nil
 }
@@ -111,23 +80,7 @@ func (s *Server) removeContainerMember(ctx micro.Context, id string, uid string)
 		return err
 	}
 
-	client, err := service.GetClient(ctx, config.Db)
-
-	if err != nil {
-		return err
-	}
-
-	redis, err := redis.GetRedis(ctx, SERVICE_REDIS)
-
-	if err != nil {
-		return err
-	}
-
-	cc := grpc.NewGRPCContext(ctx)
-
-	collection := client.Collection(config.Collection)
-
-	err = collection.Del(cc, fmt.Sprintf("container/%s/%s", id, uid))
+	err = config.Store().DelMember(ctx, "container", id, uid)
 
 	if err != nil {
 		return err
@@ -135,7 +88,7 @@ func (s *Server) removeContainerMember(ctx micro.Context, id string, uid string)
 
 	key_cm := fmt.Sprintf("%scm_%s_%s", config.Prefix, id, uid)
 
-	redis.Del(key_cm)
+	config.Cache().Del(ctx, key_cm)
 
 	return nil
 }
@@ -148,87 +101,151 @@ func (s *Server) getContainer(ctx micro.Context, id string) (*Container, error)
 		return nil, err
 	}
 
-	redis, err := redis.GetRedis(ctx, SERVICE_REDIS)
+	u := Container{}
+
+	err = config.Cache().GetObject(ctx, "container", fmt.Sprintf("%sc_%s", config.Prefix, id), &u, s.loader(ctx, fmt.Sprintf("container/%s/meta.json", id)))
 
 	if err != nil {
 		return nil, err
 	}
 
-	u := Container{}
+	return &u, nil
+}
 
-	key_c := fmt.Sprintf("%sc_%s", config.Prefix, id)
+func (s *Server) ContainerCreate(ctx micro.Context, task *ContainerCreateTask) (*Container, error) {
 
-	{
-		text, err := redis.Get(key_c)
-		if err == nil && text != "" {
-			err = json.Unmarshal([]byte(text), &u)
-			if err == nil {
-				return &u, nil
-			}
-		}
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
 	}
 
-	client, err := service.GetClient(ctx, config.Db)
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
 
 	if err != nil {
 		return nil, err
 	}
 
-	cc := grpc.NewGRPCContext(ctx)
+	container := &Container{Id: config.NewID(ctx), Secret: config.NewSecret(), Info: task.Info, Ver: 1, Labels: task.Labels}
 
-	collection := client.Collection(config.Collection)
+	err = config.Store().PutContainer(ctx, container)
+
+	if err != nil {
+		return nil, err
+	}
 
-	text, err := collection.Get(cc, fmt.Sprintf("container/%s/meta.json", id))
+	_, err = s.addContainerMember(ctx, container.Id, uid, ROLE_OWNER)
 
 	if err != nil {
 		return nil, err
 	}
 
-	redis.Set(key_c, string(text), time.Duration(config.CacheExpires)*time.Second)
+	if len(container.Labels) > 0 {
 
-	json.Unmarshal(text, &u)
+		err = s.indexContainerLabels(ctx, container.Id, container.Labels)
 
-	return &u, nil
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return container, nil
 }
 
-func (s *Server) ContainerCreate(ctx micro.Context, task *ContainerCreateTask) (*Container, error) {
+/**
+* 修改容器信息, 修改前的信息保存到 container/{id}/history/{ver}.json
+**/
+func (s *Server) setContainer(ctx micro.Context, task *ContainerSetTask, uid string) (*Container, error) {
 
-	uid, err := s.getUid(ctx, task.Token)
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
 
 	if err != nil {
 		return nil, err
 	}
 
-	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+	secret := ""
 
-	if err != nil {
-		return nil, err
+	if task.Secret {
+		secret = config.NewSecret()
 	}
 
-	client, err := service.GetClient(ctx, config.Db)
+	secrets, err := s.encryptSecrets(config, task.Secrets)
 
 	if err != nil {
 		return nil, err
 	}
 
-	cc := grpc.NewGRPCContext(ctx)
+	container, err := config.Store().UpdateContainer(ctx, task.Id, uid, func(container *Container) error {
+
+		if task.ExpectedVer != 0 && container.Ver != task.ExpectedVer {
+			return errors.Errorf(ERRNO_CONFLICT, "The container has been modified, current ver is %d", container.Ver)
+		}
+
+		if task.Patch != nil {
+
+			info, err := applyPatch(container.Info, task.PatchType, task.Patch)
+
+			if err != nil {
+				return err
+			}
+
+			container.Info = info
 
-	collection := client.Collection(config.Collection)
+		} else if task.Info != nil {
+			container.Info = task.Info
+		}
+
+		if secret != "" {
+			container.Secret = secret
+		}
 
-	container := &Container{Id: config.NewID(ctx), Secret: config.NewSecret(), Info: task.Info, Ver: 1}
+		if task.Labels != nil {
+			container.Labels = task.Labels
+		}
+
+		if secrets != nil {
 
-	err = collection.PutObject(cc, fmt.Sprintf("container/%s/meta.json", container.Id), container)
+			if container.Secrets == nil {
+				container.Secrets = map[string]string{}
+			}
+
+			for key, value := range secrets {
+				if value == nil {
+					delete(container.Secrets, key)
+				} else {
+					container.Secrets[key] = dynamic.StringValue(value, "")
+				}
+			}
+		}
+
+		return nil
+	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = s.addContainerMember(ctx, container.Id, uid, ROLE_OWNER)
+	key_c := fmt.Sprintf("%sc_%s", config.Prefix, task.Id)
+
+	config.Cache().Del(ctx, key_c)
+
+	err = s.publishContainerVer(ctx, container.Id, container.Ver)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if task.Labels != nil {
+
+		err = s.indexContainerLabels(ctx, container.Id, container.Labels)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	container.Secrets = maskSecrets(container.Secrets)
+
 	return container, nil
 }
 
@@ -238,6 +255,12 @@ func (s *Server) ContainerSet(ctx micro.Context, task *ContainerSetTask) (*Conta
 		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
 	}
 
+	err := checkPatch(task.Info, task.PatchType, task.Patch)
+
+	if err != nil {
+		return nil, err
+	}
+
 	uid, err := s.getUid(ctx, task.Token)
 
 	if err != nil {
@@ -254,96 +277,93 @@ func (s *Server) ContainerSet(ctx micro.Context, task *ContainerSetTask) (*Conta
 		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
 	}
 
-	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+	container, err := s.setContainer(ctx, task, uid)
 
 	if err != nil {
 		return nil, err
 	}
 
-	client, err := service.GetClient(ctx, config.Db)
+	return memberContainer(container, member.Role), nil
+}
+
+func (s *Server) ContainerGet(ctx micro.Context, task *ContainerGetTask) (*Container, error) {
+
+	if task.Id == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
 
 	if err != nil {
 		return nil, err
 	}
 
-	secret := ""
+	member, err := s.getContainerMember(ctx, task.Id, uid)
 
-	if task.Secret {
-		secret = config.NewSecret()
+	if err != nil {
+		return nil, err
 	}
 
-	cc := grpc.NewGRPCContext(ctx)
-
-	collection := client.Collection(config.Collection)
+	if member.Role != ROLE_OWNER && member.Role != ROLE_READ_WRITE && member.Role != ROLE_READ_ONLY {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
 
-	text, err := collection.Exec(cc, `
-	(function(){
-		var id = ${id};
-		var info = ${info};
-		var secret = ${secret};
-		var k_meta = collection + 'container/' + id + '/meta.json';
-		var text = get(k_meta);
-		if(!text) {
-			throw 'container does not exist'
-		}
-		var object = JSON.parse(text);
-		if(secret) {
-			object.secret = secret;
-		}
-		object.ver = object.ver + 1;
-		if(info) {
-			object.info = info
-		}
-		text = JSON.stringify(object);
-		put(k_meta,text)
-		return text;
-	})()
-	`, map[string]interface{}{"id": task.Id, "info": task.Info, "secret": secret})
+	container, err := s.getContainer(ctx, task.Id)
 
 	if err != nil {
 		return nil, err
 	}
 
-	redis, err := redis.GetRedis(ctx, SERVICE_REDIS)
+	memberContainer(container, member.Role)
+
+	container.Status, err = s.getContainerStatus(ctx, task.Id)
 
 	if err != nil {
 		return nil, err
 	}
 
-	key_c := fmt.Sprintf("%sc_%s", config.Prefix, task.Id)
-
-	redis.Del(key_c)
+	return container, nil
+}
 
-	container := &Container{}
+/**
+* 容器端获取的配置, 密钥解密后返回, encrypt 为 true 时使用容器密钥重新加密
+**/
+func (s *Server) newContainerInfoResult(ctx micro.Context, container *Container, encrypt bool) (*ContainerInfoGetResult, error) {
 
-	json.Unmarshal([]byte(text), &container)
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
 
-	return container, nil
-}
+	if err != nil {
+		return nil, err
+	}
 
-func (s *Server) ContainerGet(ctx micro.Context, task *ContainerGetTask) (*Container, error) {
+	info, err := s.resolveContainerInfo(ctx, container)
 
-	if task.Id == "" {
-		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	if err != nil {
+		return nil, err
 	}
 
-	uid, err := s.getUid(ctx, task.Token)
+	apps, err := s.resolveContainerApps(ctx, container)
 
 	if err != nil {
 		return nil, err
 	}
 
-	member, err := s.getContainerMember(ctx, task.Id, uid)
+	secrets, err := s.decryptSecrets(config, container.Secrets)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if member.Role != ROLE_OWNER && member.Role != ROLE_READ_WRITE && member.Role != ROLE_READ_ONLY {
-		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	if encrypt {
+		for key, value := range secrets {
+			secrets[key], err = encryptForContainer(container.Secret, value)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	return s.getContainer(ctx, task.Id)
+	return &ContainerInfoGetResult{Ver: container.Ver, Info: info, Apps: apps, Secrets: secrets, Encrypted: encrypt && len(secrets) > 0}, nil
 }
 
 func (s *Server) ContainerInfoGet(ctx micro.Context, task *ContainerInfoGetTask) (*ContainerInfoGetResult, error) {
@@ -380,8 +400,23 @@ func (s *Server) ContainerInfoGet(ctx micro.Context, task *ContainerInfoGetTask)
 		return nil, errors.Errorf(ERRNO_SIGN, "Signature error")
 	}
 
+	if task.Ver >= container.Ver && task.Wait > 0 {
+
+		wait := task.Wait
+
+		if wait > config.ContainerWaitMax {
+			wait = config.ContainerWaitMax
+		}
+
+		container, err = s.waitContainer(ctx, task.Id, task.Ver, time.Duration(wait)*time.Second, nil)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if task.Ver < container.Ver {
-		return &ContainerInfoGetResult{Ver: container.Ver, Info: container.Info}, nil
+		return s.newContainerInfoResult(ctx, container, task.Encrypt)
 	} else {
 		return &ContainerInfoGetResult{Ver: container.Ver}, nil
 	}
@@ -424,7 +459,17 @@ func (s *Server) ContainerMemberAdd(ctx micro.Context, task *ContainerMemberAddT
 		return &Member{Id: uid, Role: ROLE_OWNER}, nil
 	}
 
-	return s.addContainerMember(ctx, task.Id, u.Id, task.Role)
+	m, err := s.addContainerMember(ctx, task.Id, u.Id, task.Role)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.emitEvent(ctx, WEBHOOK_SCOPE_CONTAINER, task.Id, EVENT_MEMBER_CHANGED, map[string]interface{}{"action": "add", "uid": m.Id, "role": m.Role})
+
+	s.notify(ctx, EVENT_MEMBER_CHANGED, []string{m.Id}, map[string]string{"action": "added", "scope": "container", "id": task.Id, "role": m.Role})
+
+	return m, nil
 }
 
 func (s *Server) ContainerMemberRemove(ctx micro.Context, task *ContainerMemberAddTask) (interface{}, error) {
@@ -469,6 +514,10 @@ func (s *Server) ContainerMemberRemove(ctx micro.Context, task *ContainerMemberA
 		return nil, err
 	}
 
+	s.emitEvent(ctx, WEBHOOK_SCOPE_CONTAINER, task.Id, EVENT_MEMBER_CHANGED, map[string]interface{}{"action": "remove", "uid": u.Id})
+
+	s.notify(ctx, EVENT_MEMBER_CHANGED, []string{u.Id}, map[string]string{"action": "removed", "scope": "container", "id": task.Id})
+
 	return nil, nil
 }
 
@@ -524,26 +573,48 @@ func (s *Server) ContainerAppGet(ctx micro.Context, task *ContainerAppGetTask) (
 		return nil, errors.Errorf(ERRNO_SIGN, "Signature error")
 	}
 
-	client, err := service.GetClient(ctx, config.Db)
+	app, err := s.getApp(ctx, task.Appid)
 
 	if err != nil {
+		if IsErrno(err, ERRNO_NOT_FOUND) {
+			return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+		}
 		return nil, err
 	}
 
-	cc := grpc.NewGRPCContext(ctx)
+	approved, err := s.isAppApproved(ctx, app, task.Id)
 
-	collection := client.Collection(config.Collection)
+	if err != nil {
+		return nil, err
+	}
+
+	if !approved {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
 
-	_, err = collection.Get(cc, fmt.Sprintf("app/%s/approve/%s", task.Appid, task.Id))
+	rollout, err := s.getRollout(ctx, task.Appid)
 
 	if err != nil {
-		if IsErrno(err, ERRNO_NOT_FOUND) {
-			return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
-		}
 		return nil, err
 	}
 
-	info, err := collection.GetObject(cc, fmt.Sprintf("app/%s/%s/info.json", task.Appid, task.Ver))
+	if rollout != nil && rollout.isActive() && rollout.Ver == task.Ver && !rollout.isTarget(container) {
+
+		pinned := false
+
+		for _, a := range container.Apps {
+			if a.Appid == task.Appid && a.Ver == task.Ver {
+				pinned = true
+				break
+			}
+		}
+
+		if !pinned {
+			return nil, errors.Errorf(ERRNO_NO_PERMISSION, "The app version is not rolled out to the container")
+		}
+	}
+
+	info, err := config.Store().GetObject(ctx, fmt.Sprintf("app/%s/%s/info.json", task.Appid, task.Ver))
 
 	if err != nil {
 		if IsErrno(err, ERRNO_NOT_FOUND) {
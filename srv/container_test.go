@@ -0,0 +1,400 @@
+package srv
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ability-sh/abi-lib/dynamic"
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+func TestContainerHistory(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	token := e.login("owner@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		c, err := e.s.ContainerCreate(ctx, &ContainerCreateTask{Token: token, Info: map[string]interface{}{"title": "v1"}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ver := c.Ver
+
+		c, err = e.s.ContainerSet(ctx, &ContainerSetTask{Token: token, Id: c.Id, PatchType: PATCH_MERGE, Patch: map[string]interface{}{"title": "v2"}, ExpectedVer: ver})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.Ver != ver+1 || dynamic.StringValue(dynamic.Get(c.Info, "title"), "") != "v2" {
+			t.Fatalf("unexpected container %+v", c)
+		}
+
+		_, err = e.s.ContainerSet(ctx, &ContainerSetTask{Token: token, Id: c.Id, Info: map[string]interface{}{}, ExpectedVer: ver})
+
+		assertErrno(t, err, ERRNO_CONFLICT)
+
+		items, err := e.s.ContainerHistoryList(ctx, &ContainerHistoryListTask{Token: token, Id: c.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(items) == 0 || items[0].Ver != ver {
+			t.Fatalf("unexpected history %+v", items)
+		}
+
+		h, err := e.s.ContainerHistoryGet(ctx, &ContainerHistoryGetTask{Token: token, Id: c.Id, Ver: ver})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if h.Ver != ver || dynamic.StringValue(dynamic.Get(h.Info, "title"), "") != "v1" {
+			t.Fatalf("unexpected history %+v", h)
+		}
+
+		_, err = e.s.ContainerHistoryGet(ctx, &ContainerHistoryGetTask{Token: token, Id: c.Id, Ver: ver + 100})
+
+		assertErrno(t, err, ERRNO_NOT_FOUND)
+
+		_, err = e.s.ContainerHistoryGet(ctx, &ContainerHistoryGetTask{Token: token, Id: c.Id})
+
+		assertErrno(t, err, ERRNO_INPUT_DATA)
+
+		c, err = e.s.ContainerRollback(ctx, &ContainerRollbackTask{Token: token, Id: c.Id, Ver: ver})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.Ver != ver+2 || dynamic.StringValue(dynamic.Get(c.Info, "title"), "") != "v1" {
+			t.Fatalf("unexpected container %+v", c)
+		}
+	})
+}
+
+func TestContainerAppLatest(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	token := e.login("owner@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		app, err := e.s.AppCreate(ctx, &AppCreateTask{Token: token, Visibility: VISIBILITY_PUBLIC})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.AppVerDone(ctx, &AppVerDoneTask{Token: token, Id: app.Id, Ver: "1.0", Info: map[string]interface{}{"web": map[string]interface{}{}}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := e.s.ContainerCreate(ctx, &ContainerCreateTask{Token: token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err = e.s.ContainerAppSet(ctx, &ContainerAppSetTask{Token: token, Id: c.Id, Appid: app.Id, Channel: CHANNEL_LATEST, Ability: "web"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(c.Apps) != 1 || c.Apps[0].Channel != CHANNEL_LATEST {
+			t.Fatalf("unexpected container %+v", c)
+		}
+
+		ver := c.Ver
+
+		_, err = e.s.AppVerDone(ctx, &AppVerDoneTask{Token: token, Id: app.Id, Ver: "1.1", Info: map[string]interface{}{"web": map[string]interface{}{}}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err = e.s.getContainer(ctx, c.Id)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.Ver != ver+1 {
+			t.Fatalf("expected container ver %d, got %d", ver+1, c.Ver)
+		}
+
+		c, err = e.s.ContainerAppRemove(ctx, &ContainerAppRemoveTask{Token: token, Id: c.Id, Appid: app.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(c.Apps) != 0 || c.Ver != ver+2 {
+			t.Fatalf("unexpected container %+v", c)
+		}
+	})
+}
+
+func TestContainerSecrets(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	token := e.login("owner@example.com")
+	reader := e.login("reader@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		c, err := e.s.ContainerCreate(ctx, &ContainerCreateTask{Token: token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		secret := c.Secret
+
+		_, err = e.s.ContainerSet(ctx, &ContainerSetTask{Token: token, Id: c.Id, Secrets: map[string]interface{}{"db": "p@ss"}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.ContainerMemberAdd(ctx, &ContainerMemberAddTask{Token: token, Id: c.Id, Email: "reader@example.com", Role: ROLE_READ_ONLY})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err = e.s.ContainerGet(ctx, &ContainerGetTask{Token: token, Id: c.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.Secret != secret || c.Secrets["db"] != SECRET_MASK {
+			t.Fatalf("unexpected container for the owner %+v", c)
+		}
+
+		c, err = e.s.ContainerGet(ctx, &ContainerGetTask{Token: reader, Id: c.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.Secret != "" || c.Secrets["db"] != SECRET_MASK {
+			t.Fatalf("unexpected container for a reader %+v", c)
+		}
+
+		ts := time.Now().Unix()
+
+		_, err = e.s.ContainerInfoGet(ctx, &ContainerInfoGetTask{Id: c.Id, Timestamp: ts, Sign: "bad"})
+
+		assertErrno(t, err, ERRNO_SIGN)
+
+		rs, err := e.s.ContainerInfoGet(ctx, &ContainerInfoGetTask{Id: c.Id, Timestamp: ts, Sign: e.config(ctx).Sign(secret, map[string]interface{}{"id": c.Id, "timestamp": ts, "ver": 0})})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rs.Ver != c.Ver || rs.Secrets["db"] != "p@ss" {
+			t.Fatalf("unexpected info %+v", rs)
+		}
+
+		_, err = e.s.ContainerMemberRemove(ctx, &ContainerMemberAddTask{Token: token, Id: c.Id, Email: "owner@example.com"})
+
+		assertErrno(t, err, ERRNO_MEMBER)
+
+		_, err = e.s.ContainerMemberRemove(ctx, &ContainerMemberAddTask{Token: token, Id: c.Id, Email: "reader@example.com"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.ContainerGet(ctx, &ContainerGetTask{Token: reader, Id: c.Id})
+
+		assertErrno(t, err, ERRNO_NOT_FOUND)
+	})
+}
+
+func TestContainerAppApproval(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	token := e.login("owner@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		app, err := e.s.AppCreate(ctx, &AppCreateTask{Token: token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.AppVerDone(ctx, &AppVerDoneTask{Token: token, Id: app.Id, Ver: "1.0", Info: map[string]interface{}{"web": map[string]interface{}{}}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cs := []*Container{}
+
+		for i := 0; i < 2; i++ {
+
+			c, err := e.s.ContainerCreate(ctx, &ContainerCreateTask{Token: token})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = e.s.AppApprove(ctx, &AppApproveTask{Token: token, Id: app.Id, ContainerId: c.Id})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c, err = e.s.ContainerAppSet(ctx, &ContainerAppSetTask{Token: token, Id: c.Id, Appid: app.Id, Channel: CHANNEL_LATEST, Ability: "web"})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cs = append(cs, c)
+		}
+
+		// 跟随渠道的容器都递增版本
+		_, err = e.s.AppVerDone(ctx, &AppVerDoneTask{Token: token, Id: app.Id, Ver: "1.1", Info: map[string]interface{}{"web": map[string]interface{}{}}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range cs {
+
+			v, err := e.s.getContainer(ctx, c.Id)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if v.Ver != c.Ver+1 {
+				t.Fatalf("expected container ver %d, got %d", c.Ver+1, v.Ver)
+			}
+		}
+
+		c := cs[0]
+
+		info := func() *ContainerInfoGetResult {
+
+			ts := time.Now().Unix()
+
+			rs, err := e.s.ContainerInfoGet(ctx, &ContainerInfoGetTask{Id: c.Id, Timestamp: ts, Sign: e.config(ctx).Sign(c.Secret, map[string]interface{}{"id": c.Id, "timestamp": ts, "ver": 0})})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return rs
+		}
+
+		rs := info()
+
+		if len(rs.Apps) != 1 || rs.Apps[0].Ver != "1.1" {
+			t.Fatalf("unexpected apps %+v", rs.Apps)
+		}
+
+		// 取消审批后不再下发应用
+		_, err = e.s.AppUnapprove(ctx, &AppUnapproveTask{Token: token, Id: app.Id, ContainerId: c.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rs = info()
+
+		if len(rs.Apps) != 0 {
+			t.Fatalf("expected no apps after the approval was removed, got %+v", rs.Apps)
+		}
+	})
+}
+
+func TestContainerAppGet(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	token := e.login("owner@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		app, err := e.s.AppCreate(ctx, &AppCreateTask{Token: token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.AppVerDone(ctx, &AppVerDoneTask{Token: token, Id: app.Id, Ver: "1.0", Info: map[string]interface{}{"web": map[string]interface{}{}}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := e.s.ContainerCreate(ctx, &ContainerCreateTask{Token: token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		get := func(ver string, ability string) (*ContainerAppGetResult, error) {
+			ts := time.Now().Unix()
+			return e.s.ContainerAppGet(ctx, &ContainerAppGetTask{Id: c.Id, Appid: app.Id, Ver: ver, Ability: ability, Timestamp: ts, Sign: e.config(ctx).Sign(c.Secret, map[string]interface{}{
+				"id":        c.Id,
+				"timestamp": ts,
+				"ver":       ver,
+				"appid":     app.Id,
+				"ability":   ability,
+			})})
+		}
+
+		_, err = e.s.ContainerAppGet(ctx, &ContainerAppGetTask{Id: c.Id, Appid: app.Id, Ver: "1.0", Ability: "web", Timestamp: time.Now().Unix(), Sign: "bad"})
+
+		assertErrno(t, err, ERRNO_SIGN)
+
+		// 没有审批的应用不能下载
+		_, err = get("1.0", "web")
+
+		assertErrno(t, err, ERRNO_NO_PERMISSION)
+
+		_, err = e.s.AppApprove(ctx, &AppApproveTask{Token: token, Id: app.Id, ContainerId: c.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rs, err := get("1.0", "web")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rs.Info == nil || !strings.Contains(rs.Url, "app/"+app.Id+"/1.0/web.zip") {
+			t.Fatalf("unexpected result %+v", rs)
+		}
+
+		_, err = get("1.0", "api")
+
+		assertErrno(t, err, ERRNO_NOT_FOUND)
+
+		_, err = get("2.0", "web")
+
+		assertErrno(t, err, ERRNO_NOT_FOUND)
+	})
+}
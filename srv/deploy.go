@@ -0,0 +1,422 @@
+package srv
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ability-sh/abi-lib/dynamic"
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+/**
+* 递增跟随渠道的容器版本并记录历史, 返回 {容器ID: 新版本}
+* 每个容器在单独的事务中修改, 跟随的容器很多时不会因为事务过大或冲突而失败, 单个容器失败只记录日志
+**/
+func (s *objectStore) bumpDeploy(ctx micro.Context, appid string, uid string, mtime int64) (map[string]int, error) {
+
+	containers := map[string]int{}
+
+	deploy := map[string]string{}
+
+	text, err := s.Get(ctx, fmt.Sprintf("app/%s/deploy.json", appid))
+
+	if err != nil {
+		if IsErrno(err, ERRNO_NOT_FOUND) {
+			return containers, nil
+		}
+		return nil, err
+	}
+
+	unmarshalObject(text, &deploy)
+
+	for cid, _ := range deploy {
+
+		var container *Container = nil
+
+		err := s.update(ctx, func(tx *storeTx) error {
+
+			c, err := s.updateContainer(tx, cid, uid, mtime, func(container *Container) error {
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+
+			container = c
+
+			return nil
+		})
+
+		if err != nil {
+			if !IsErrno(err, ERRNO_NOT_FOUND) {
+				ctx.Println("deploy", appid, cid, err)
+			}
+			continue
+		}
+
+		containers[cid] = container.Ver
+	}
+
+	return containers, nil
+}
+
+/**
+* 在事务中修改应用的渠道索引, channel 为空时移除
+**/
+func indexDeploy(tx *storeTx, appid string, id string, channel string) error {
+
+	key := fmt.Sprintf("app/%s/deploy.json", appid)
+
+	deploy := map[string]string{}
+
+	ok, err := tx.GetObject(key, &deploy)
+
+	if err != nil {
+		return err
+	}
+
+	if channel == "" {
+		if !ok {
+			return nil
+		}
+		delete(deploy, id)
+	} else {
+		deploy[id] = channel
+	}
+
+	return tx.PutObject(key, deploy)
+}
+
+func (s *objectStore) SetContainerApp(ctx micro.Context, id string, entry *ContainerApp, uid string) (*Container, error) {
+
+	var container *Container = nil
+
+	err := s.update(ctx, func(tx *storeTx) error {
+
+		var prev *ContainerApp = nil
+
+		c, err := s.updateContainer(tx, id, uid, time.Now().Unix(), func(container *Container) error {
+
+			apps := []*ContainerApp{}
+
+			for _, a := range container.Apps {
+				if a.Appid == entry.Appid {
+					prev = a
+				} else {
+					apps = append(apps, a)
+				}
+			}
+
+			container.Apps = append(apps, entry)
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		container = c
+
+		if entry.Channel != "" || (prev != nil && prev.Channel != "") {
+			return indexDeploy(tx, entry.Appid, id, entry.Channel)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return container, nil
+}
+
+func (s *objectStore) RemoveContainerApp(ctx micro.Context, id string, appid string, uid string) (*Container, error) {
+
+	var container *Container = nil
+
+	err := s.update(ctx, func(tx *storeTx) error {
+
+		container = &Container{}
+
+		err := tx.MustObject(fmt.Sprintf("container/%s/meta.json", id), container, "Container that does not exist")
+
+		if err != nil {
+			return err
+		}
+
+		var prev *ContainerApp = nil
+
+		for _, a := range container.Apps {
+			if a.Appid == appid {
+				prev = a
+			}
+		}
+
+		if prev == nil {
+			return nil
+		}
+
+		container, err = s.updateContainer(tx, id, uid, time.Now().Unix(), func(container *Container) error {
+
+			apps := []*ContainerApp{}
+
+			for _, a := range container.Apps {
+				if a.Appid != appid {
+					apps = append(apps, a)
+				}
+			}
+
+			container.Apps = apps
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if prev.Channel != "" {
+			return indexDeploy(tx, appid, id, "")
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return container, nil
+}
+
+/**
+* 容器是否可以使用应用, 公开和不公开列出的应用无需审批
+**/
+func (s *Server) isAppApproved(ctx micro.Context, app *App, containerId string) (bool, error) {
+
+	if app.Visibility == VISIBILITY_PUBLIC || app.Visibility == VISIBILITY_UNLISTED {
+		return true, nil
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return false, err
+	}
+
+	_, err = config.Cache().Get(ctx, "app_approve", fmt.Sprintf("%sap_%s_%s", config.Prefix, app.Id, containerId), s.loader(ctx, fmt.Sprintf("app/%s/approve/%s", app.Id, containerId)))
+
+	if err != nil {
+		if IsErrno(err, ERRNO_NOT_FOUND) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+/**
+* 解析容器应用清单中的渠道为具体版本, 灰度发布中的应用按容器分桶决定版本
+**/
+func (s *Server) resolveContainerApps(ctx micro.Context, container *Container) ([]*ContainerApp, error) {
+
+	rs := []*ContainerApp{}
+
+	for _, a := range container.Apps {
+
+		r := *a
+
+		app, err := s.getApp(ctx, r.Appid)
+
+		if err != nil {
+			if IsErrno(err, ERRNO_NOT_FOUND) {
+				continue
+			}
+			return nil, err
+		}
+
+		// 设置后应用可能改为私有或取消了审批
+		approved, err := s.isAppApproved(ctx, app, container.Id)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !approved {
+			continue
+		}
+
+		if r.Channel == CHANNEL_LATEST {
+
+			ver, err := s.resolveChannelVer(ctx, app, container)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if ver == "" {
+				continue
+			}
+
+			r.Ver = ver
+		}
+
+		rs = append(rs, &r)
+	}
+
+	return rs, nil
+}
+
+func (s *Server) ContainerAppSet(ctx micro.Context, task *ContainerAppSetTask) (*Container, error) {
+
+	if task.Id == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	if task.Appid == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter appid is incorrect")
+	}
+
+	if task.Ability == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter ability is incorrect")
+	}
+
+	if task.Channel != "" {
+		if task.Channel != CHANNEL_LATEST || task.Ver != "" {
+			return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter channel is incorrect")
+		}
+	} else if !re_ver.MatchString(task.Ver) {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter ver is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	member, err := s.getContainerMember(ctx, task.Id, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if member.Role != ROLE_OWNER && member.Role != ROLE_READ_WRITE {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
+
+	app, err := s.getApp(ctx, task.Appid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	approved, err := s.isAppApproved(ctx, app, task.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !approved {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "The app is not approved for the container")
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if task.Ver != "" {
+
+		info, err := config.Store().GetObject(ctx, fmt.Sprintf("app/%s/%s/info.json", task.Appid, task.Ver))
+
+		if err != nil {
+			if IsErrno(err, ERRNO_NOT_FOUND) {
+				return nil, errors.Errorf(ERRNO_APP_VER, "App version that doesn't exist")
+			}
+			return nil, err
+		}
+
+		if dynamic.Get(info, task.Ability) == nil {
+			return nil, errors.Errorf(ERRNO_NOT_FOUND, "application package %s that does not exist", task.Ability)
+		}
+
+	}
+
+	entry := &ContainerApp{Appid: task.Appid, Channel: task.Channel, Ver: task.Ver, Ability: task.Ability, Config: task.Config}
+
+	container, err := config.Store().SetContainerApp(ctx, task.Id, entry, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key_c := fmt.Sprintf("%sc_%s", config.Prefix, task.Id)
+
+	config.Cache().Del(ctx, key_c)
+
+	err = s.publishContainerVer(ctx, container.Id, container.Ver)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return memberContainer(container, member.Role), nil
+}
+
+func (s *Server) ContainerAppRemove(ctx micro.Context, task *ContainerAppRemoveTask) (*Container, error) {
+
+	if task.Id == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	if task.Appid == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter appid is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	member, err := s.getContainerMember(ctx, task.Id, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if member.Role != ROLE_OWNER && member.Role != ROLE_READ_WRITE {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	container, err := config.Store().RemoveContainerApp(ctx, task.Id, task.Appid, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key_c := fmt.Sprintf("%sc_%s", config.Prefix, task.Id)
+
+	config.Cache().Del(ctx, key_c)
+
+	err = s.publishContainerVer(ctx, container.Id, container.Ver)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return memberContainer(container, member.Role), nil
+}
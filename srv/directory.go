@@ -0,0 +1,320 @@
+package srv
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/ability-sh/abi-lib/dynamic"
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-micro/http"
+	"github.com/ability-sh/abi-micro/micro"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	DIRECTORY_HTTP = "http"
+	DIRECTORY_DB   = "db"
+	DIRECTORY_LDAP = "ldap"
+)
+
+/**
+* 用户目录
+**/
+type UserDirectory interface {
+	/**
+	* 通过邮箱获取用户, create 为 true 时不存在则创建
+	**/
+	GetUser(ctx micro.Context, email string, create bool) (*User, error)
+	GetUserById(ctx micro.Context, uid string) (*User, error)
+}
+
+func newUserDirectory(config *ConfigService) (UserDirectory, error) {
+	switch config.UserDirectory {
+	case DIRECTORY_HTTP:
+		return &emailUserDirectory{&httpUserDirectory{config: config}}, nil
+	case DIRECTORY_DB:
+		return &emailUserDirectory{&dbUserDirectory{config: config}}, nil
+	case DIRECTORY_LDAP:
+		return &emailUserDirectory{&ldapUserDirectory{config: config}}, nil
+	}
+	return nil, fmt.Errorf("not support user-directory %s", config.UserDirectory)
+}
+
+/**
+* 查询和返回的邮箱都规范化, 各个用户目录不需要再处理大小写
+**/
+type emailUserDirectory struct {
+	directory UserDirectory
+}
+
+func (d *emailUserDirectory) GetUser(ctx micro.Context, email string, create bool) (*User, error) {
+
+	u, err := d.directory.GetUser(ctx, normalizeEmail(email), create)
+
+	if err != nil {
+		return nil, err
+	}
+
+	u.Email = normalizeEmail(u.Email)
+
+	return u, nil
+}
+
+func (d *emailUserDirectory) GetUserById(ctx micro.Context, uid string) (*User, error) {
+
+	u, err := d.directory.GetUserById(ctx, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	u.Email = normalizeEmail(u.Email)
+
+	return u, nil
+}
+
+/**
+* 独立的用户服务 {user-svc}/get.json
+**/
+type httpUserDirectory struct {
+	config *ConfigService
+}
+
+func (d *httpUserDirectory) get(ctx micro.Context, query map[string]string) (interface{}, error) {
+
+	HTTP, err := http.GetHTTPService(ctx, SERVICE_HTTP)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := HTTP.Request(ctx, "GET").
+		SetURL(fmt.Sprintf("%s/get.json", d.config.UserSvc), query).
+		Send()
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := res.PraseBody()
+
+	if err != nil {
+		return nil, err
+	}
+
+	errno := dynamic.IntValue(dynamic.Get(data, "errno"), 0)
+
+	if errno != 200 {
+		return nil, errors.Errorf(int32(errno), dynamic.StringValue(dynamic.Get(data, "errmsg"), "Internal service error"))
+	}
+
+	return dynamic.Get(data, "data"), nil
+}
+
+func (d *httpUserDirectory) GetUser(ctx micro.Context, email string, create bool) (*User, error) {
+
+	query := map[string]string{"name": email}
+
+	if create {
+		query["autoCreated"] = "true"
+	}
+
+	data, err := d.get(ctx, query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &User{Email: email, Id: dynamic.StringValue(dynamic.Get(data, "id"), "")}, nil
+}
+
+func (d *httpUserDirectory) GetUserById(ctx micro.Context, uid string) (*User, error) {
+
+	data, err := d.get(ctx, map[string]string{"id": uid})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &User{Email: dynamic.StringValue(dynamic.Get(data, "name"), ""), Id: uid}, nil
+}
+
+/**
+* 内置用户, 保存在 collection 中
+* user/email/{email}.json 邮箱索引
+* user/{uid}/info.json 用户信息
+**/
+type dbUserDirectory struct {
+	config *ConfigService
+}
+
+func (d *dbUserDirectory) GetUser(ctx micro.Context, email string, create bool) (*User, error) {
+
+	var u *User = nil
+
+	if create {
+		u = &User{Id: d.config.NewID(ctx), Email: email}
+	}
+
+	return d.config.Store().GetUser(ctx, email, u)
+}
+
+func (s *objectStore) GetUser(ctx micro.Context, email string, create *User) (*User, error) {
+
+	u := &User{}
+
+	err := s.update(ctx, func(tx *storeTx) error {
+
+		k_email := fmt.Sprintf("user/email/%s.json", email)
+
+		ok, err := tx.GetObject(k_email, u)
+
+		if err != nil || ok {
+			return err
+		}
+
+		if create == nil {
+			return errors.Errorf(ERRNO_NOT_FOUND, "User that does not exist")
+		}
+
+		*u = *create
+
+		err = tx.PutObject(k_email, u)
+
+		if err != nil {
+			return err
+		}
+
+		return tx.PutObject(fmt.Sprintf("user/%s/info.json", u.Id), u)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func (d *dbUserDirectory) GetUserById(ctx micro.Context, uid string) (*User, error) {
+
+	text, err := d.config.Store().Get(ctx, fmt.Sprintf("user/%s/info.json", uid))
+
+	if err != nil {
+		if IsErrno(err, ERRNO_NOT_FOUND) {
+			return nil, errors.Errorf(ERRNO_NOT_FOUND, "User that does not exist")
+		}
+		return nil, err
+	}
+
+	u := &User{}
+
+	unmarshalObject(text, u)
+
+	return u, nil
+}
+
+/**
+* LDAP 目录, 只读, 用户不存在时不会创建
+**/
+type ldapUserDirectory struct {
+	config *ConfigService
+}
+
+func (d *ldapUserDirectory) dial() (*ldap.Conn, error) {
+
+	timeout := time.Duration(d.config.LdapTimeout) * time.Second
+
+	conn, err := ldap.DialURL(d.config.LdapAddr, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetTimeout(timeout)
+
+	if d.config.LdapStartTLS {
+
+		u, err := url.Parse(d.config.LdapAddr)
+
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		err = conn.StartTLS(&tls.Config{ServerName: u.Hostname()})
+
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+/**
+* 没有 id 属性的条目不能作为用户
+**/
+func newLdapUser(config *ConfigService, e *ldap.Entry) (*User, error) {
+
+	id := e.GetAttributeValue(config.LdapIdAttr)
+
+	if id == "" {
+		return nil, errors.Errorf(ERRNO_NOT_FOUND, "User that does not exist")
+	}
+
+	return &User{Id: id, Email: e.GetAttributeValue(config.LdapMailAttr)}, nil
+}
+
+func (d *ldapUserDirectory) search(attr string, value string) (*User, error) {
+
+	conn, err := d.dial()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	if d.config.LdapBindDN != "" {
+
+		err = conn.Bind(d.config.LdapBindDN, d.config.LdapBindPassword)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	filter := fmt.Sprintf("(&%s(%s=%s))", d.config.LdapFilter, ldap.EscapeFilter(attr), ldap.EscapeFilter(value))
+
+	rs, err := conn.Search(ldap.NewSearchRequest(d.config.LdapBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		filter, []string{d.config.LdapIdAttr, d.config.LdapMailAttr}, nil))
+
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return nil, errors.Errorf(ERRNO_INTERNAL_SERVER, "Multiple users found")
+		}
+		return nil, err
+	}
+
+	if len(rs.Entries) == 0 {
+		return nil, errors.Errorf(ERRNO_NOT_FOUND, "User that does not exist")
+	}
+
+	if len(rs.Entries) > 1 {
+		return nil, errors.Errorf(ERRNO_INTERNAL_SERVER, "Multiple users found")
+	}
+
+	return newLdapUser(d.config, rs.Entries[0])
+}
+
+func (d *ldapUserDirectory) GetUser(ctx micro.Context, email string, create bool) (*User, error) {
+	return d.search(d.config.LdapMailAttr, email)
+}
+
+func (d *ldapUserDirectory) GetUserById(ctx micro.Context, uid string) (*User, error) {
+	return d.search(d.config.LdapIdAttr, uid)
+}
@@ -0,0 +1,80 @@
+package srv
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ability-sh/abi-micro/micro"
+	"github.com/go-ldap/ldap/v3"
+)
+
+func TestLdapUser(t *testing.T) {
+
+	config := &ConfigService{LdapIdAttr: "uid", LdapMailAttr: "mail"}
+
+	_, err := newLdapUser(config, ldap.NewEntry("cn=alice,dc=example,dc=com", map[string][]string{"mail": {"alice@example.com"}}))
+
+	assertErrno(t, err, ERRNO_NOT_FOUND)
+
+	u, err := newLdapUser(config, ldap.NewEntry("cn=alice,dc=example,dc=com", map[string][]string{"uid": {"alice"}, "mail": {"Alice@Example.com"}}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Id != "alice" || u.Email != "Alice@Example.com" {
+		t.Fatalf("unexpected user %+v", u)
+	}
+}
+
+func TestLdapTimeout(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	// 接受连接但不响应
+	go func() {
+		conns := []net.Conn{}
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				for _, c := range conns {
+					c.Close()
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	e := newTestEnvWith(t, map[string]interface{}{
+		"user-directory": DIRECTORY_LDAP,
+		"ldap-addr":      "ldap://" + l.Addr().String(),
+		"ldap-bind-dn":   "cn=admin,dc=example,dc=com",
+		"ldap-base-dn":   "dc=example,dc=com",
+		"ldap-start-tls": true,
+		"ldap-timeout":   1,
+	})
+
+	e.ctx(func(ctx micro.Context) {
+
+		start := time.Now()
+
+		_, err := e.s.getUser(ctx, "alice@example.com")
+
+		if err == nil || !strings.Contains(err.Error(), "timed out") {
+			t.Fatalf("expected a timeout, got %v", err)
+		}
+
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("the operation timeout was not applied, took %s", time.Since(start))
+		}
+	})
+}
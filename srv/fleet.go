@@ -0,0 +1,525 @@
+package srv
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"sort"
+
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+const (
+	LABEL_INDEX_SHARDS = 16
+)
+
+/**
+* 标签索引 label/{key}/{value}/{n}.json 保存容器ID, 按容器ID分成 LABEL_INDEX_SHARDS 个分片
+* 避免所有容器的标签修改都写入同一个文档
+**/
+func labelIndexKey(key string, value string, n uint32) string {
+	return fmt.Sprintf("label/%s/%s/%d.json", url.PathEscape(key), url.PathEscape(value), n)
+}
+
+func labelIndexShard(id string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return h.Sum32() % LABEL_INDEX_SHARDS
+}
+
+/**
+* 更新容器标签索引, 标签为空时移除
+**/
+func (s *Server) indexContainerLabels(ctx micro.Context, id string, labels map[string]string) error {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return err
+	}
+
+	return config.Store().IndexContainerLabels(ctx, id, labels)
+}
+
+/**
+* 容器上次索引的标签保存在 container/{id}/labels.json, 只修改变化的标签所在的分片
+**/
+func (s *objectStore) IndexContainerLabels(ctx micro.Context, id string, labels map[string]string) error {
+	return s.update(ctx, func(tx *storeTx) error {
+
+		key := fmt.Sprintf("container/%s/labels.json", id)
+
+		prev := map[string]string{}
+
+		_, err := tx.GetObject(key, &prev)
+
+		if err != nil {
+			return err
+		}
+
+		n := labelIndexShard(id)
+
+		for name, value := range prev {
+
+			if v, ok := labels[name]; ok && v == value {
+				continue
+			}
+
+			ids := []string{}
+
+			_, err = tx.GetObject(labelIndexKey(name, value, n), &ids)
+
+			if err != nil {
+				return err
+			}
+
+			vs := []string{}
+
+			for _, v := range ids {
+				if v != id {
+					vs = append(vs, v)
+				}
+			}
+
+			if len(vs) == 0 {
+				tx.Del(labelIndexKey(name, value, n))
+				continue
+			}
+
+			err = tx.PutObject(labelIndexKey(name, value, n), vs)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		for name, value := range labels {
+
+			if v, ok := prev[name]; ok && v == value {
+				continue
+			}
+
+			ids := []string{}
+
+			_, err = tx.GetObject(labelIndexKey(name, value, n), &ids)
+
+			if err != nil {
+				return err
+			}
+
+			i := sort.SearchStrings(ids, id)
+
+			if i < len(ids) && ids[i] == id {
+				continue
+			}
+
+			ids = append(ids, "")
+			copy(ids[i+1:], ids[i:])
+			ids[i] = id
+
+			err = tx.PutObject(labelIndexKey(name, value, n), ids)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(labels) == 0 {
+			tx.Del(key)
+			return nil
+		}
+
+		return tx.PutObject(key, labels)
+	})
+}
+
+func (s *objectStore) UpdateFleet(ctx micro.Context, id string, fn func(fleet *Fleet) error) (*Fleet, error) {
+
+	var fleet *Fleet = nil
+
+	err := s.update(ctx, func(tx *storeTx) error {
+
+		fleet = &Fleet{}
+
+		err := tx.MustObject(fmt.Sprintf("fleet/%s/meta.json", id), fleet, "Fleet that does not exist")
+
+		if err != nil {
+			return err
+		}
+
+		err = fn(fleet)
+
+		if err != nil {
+			return err
+		}
+
+		return tx.PutObject(fmt.Sprintf("fleet/%s/meta.json", id), fleet)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return fleet, nil
+}
+
+/**
+* 标签为 key=value 的容器ID
+**/
+func (s *Server) getLabelContainers(ctx micro.Context, key string, value string) (map[string]bool, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rs := map[string]bool{}
+
+	for n := uint32(0); n < LABEL_INDEX_SHARDS; n++ {
+
+		text, err := config.Store().Get(ctx, labelIndexKey(key, value, n))
+
+		if err != nil {
+			if IsErrno(err, ERRNO_NOT_FOUND) {
+				continue
+			}
+			return nil, err
+		}
+
+		ids := []string{}
+
+		unmarshalObject(text, &ids)
+
+		for _, id := range ids {
+			rs[id] = true
+		}
+	}
+
+	return rs, nil
+}
+
+/**
+* 选择器匹配且 uid 是成员的容器, 选择器中的所有标签都相同时匹配
+**/
+func (s *Server) selectContainers(ctx micro.Context, selector map[string]string, uid string) ([]string, error) {
+
+	ids := []string{}
+
+	if len(selector) == 0 {
+		return ids, nil
+	}
+
+	var matched map[string]bool = nil
+
+	for key, value := range selector {
+
+		rs, err := s.getLabelContainers(ctx, key, value)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if matched == nil {
+			matched = rs
+			continue
+		}
+
+		for id := range matched {
+			if !rs[id] {
+				delete(matched, id)
+			}
+		}
+	}
+
+	for id := range matched {
+
+		_, err := s.loadContainerMember(ctx, id, uid)
+
+		if err != nil {
+			if IsErrno(err, ERRNO_NOT_FOUND) {
+				continue
+			}
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+func (s *Server) getFleetMember(ctx micro.Context, id string, uid string) (*Member, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	u := Member{}
+
+	err = config.Cache().GetObject(ctx, "fleet_member", fmt.Sprintf("%sfm_%s_%s", config.Prefix, id, uid), &u, s.memberLoader(ctx, "fleet", id, uid))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+func (s *Server) getFleet(ctx micro.Context, id string) (*Fleet, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := config.Store().Get(ctx, fmt.Sprintf("fleet/%s/meta.json", id))
+
+	if err != nil {
+		return nil, err
+	}
+
+	fleet := Fleet{}
+
+	unmarshalObject(text, &fleet)
+
+	return &fleet, nil
+}
+
+/**
+* 对集群中的每个容器执行 fn, 单个容器失败不影响其他容器
+**/
+func (s *Server) fleetEach(ctx micro.Context, token string, id string, write bool, fn func(cid string) (interface{}, error)) (*FleetResult, error) {
+
+	if id == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	member, err := s.getFleetMember(ctx, id, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if member.Role != ROLE_OWNER && member.Role != ROLE_READ_WRITE && (write || member.Role != ROLE_READ_ONLY) {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
+
+	fleet, err := s.getFleet(ctx, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := s.selectContainers(ctx, fleet.Selector, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rs := &FleetResult{Items: []*FleetItemResult{}}
+
+	for _, cid := range ids {
+
+		data, err := fn(cid)
+
+		if err != nil {
+
+			item := &FleetItemResult{Id: cid, Errno: ERRNO_INTERNAL_SERVER, Errmsg: err.Error()}
+
+			e, ok := err.(*errors.Error)
+
+			if ok {
+				item.Errno = e.Errno
+				item.Errmsg = e.Errmsg
+			}
+
+			rs.Items = append(rs.Items, item)
+			rs.Failed = rs.Failed + 1
+
+		} else {
+			rs.Items = append(rs.Items, &FleetItemResult{Id: cid, Errno: ERRNO_OK, Data: data})
+			rs.Ok = rs.Ok + 1
+		}
+	}
+
+	return rs, nil
+}
+
+func (s *Server) FleetCreate(ctx micro.Context, task *FleetCreateTask) (*Fleet, error) {
+
+	if len(task.Selector) == 0 {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter selector is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fleet := &Fleet{Id: config.NewID(ctx), Title: task.Title, Selector: task.Selector}
+
+	err = config.Store().PutObject(ctx, fmt.Sprintf("fleet/%s/meta.json", fleet.Id), fleet)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Store().PutMember(ctx, "fleet", fleet.Id, &Member{Id: uid, Role: ROLE_OWNER})
+
+	if err != nil {
+		return nil, err
+	}
+
+	config.Cache().Del(ctx, fmt.Sprintf("%sfm_%s_%s", config.Prefix, fleet.Id, uid))
+
+	return fleet, nil
+}
+
+func (s *Server) FleetSet(ctx micro.Context, task *FleetSetTask) (*Fleet, error) {
+
+	if task.Id == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	if task.Selector != nil && len(task.Selector) == 0 {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter selector is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	member, err := s.getFleetMember(ctx, task.Id, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if member.Role != ROLE_OWNER && member.Role != ROLE_READ_WRITE {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return config.Store().UpdateFleet(ctx, task.Id, func(fleet *Fleet) error {
+
+		if task.Title != "" {
+			fleet.Title = task.Title
+		}
+
+		if task.Selector != nil {
+			fleet.Selector = task.Selector
+		}
+
+		return nil
+	})
+}
+
+func (s *Server) FleetGet(ctx micro.Context, task *FleetGetTask) (*FleetGetResult, error) {
+
+	if task.Id == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	member, err := s.getFleetMember(ctx, task.Id, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if member.Role != ROLE_OWNER && member.Role != ROLE_READ_WRITE && member.Role != ROLE_READ_ONLY {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
+
+	fleet, err := s.getFleet(ctx, task.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := s.selectContainers(ctx, fleet.Selector, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &FleetGetResult{Fleet: fleet, Containers: ids}, nil
+}
+
+func (s *Server) FleetAppApprove(ctx micro.Context, task *FleetAppApproveTask) (*FleetResult, error) {
+
+	if task.Appid == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter appid is incorrect")
+	}
+
+	return s.fleetEach(ctx, task.Token, task.Id, true, func(cid string) (interface{}, error) {
+		return s.AppApprove(ctx, &AppApproveTask{Token: task.Token, Id: task.Appid, ContainerId: cid})
+	})
+}
+
+func (s *Server) FleetInfoSet(ctx micro.Context, task *FleetInfoSetTask) (*FleetResult, error) {
+
+	if task.Info == nil {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter info is incorrect")
+	}
+
+	return s.fleetEach(ctx, task.Token, task.Id, true, func(cid string) (interface{}, error) {
+		c, err := s.ContainerSet(ctx, &ContainerSetTask{Token: task.Token, Id: cid, PatchType: PATCH_MERGE, Patch: task.Info})
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"ver": c.Ver}, nil
+	})
+}
+
+func (s *Server) FleetSecretRotate(ctx micro.Context, task *FleetSecretRotateTask) (*FleetResult, error) {
+	return s.fleetEach(ctx, task.Token, task.Id, true, func(cid string) (interface{}, error) {
+		c, err := s.ContainerSet(ctx, &ContainerSetTask{Token: task.Token, Id: cid, Secret: true})
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"ver": c.Ver, "secret": c.Secret}, nil
+	})
+}
+
+func (s *Server) FleetHealth(ctx micro.Context, task *FleetHealthTask) (*FleetResult, error) {
+	return s.fleetEach(ctx, task.Token, task.Id, false, func(cid string) (interface{}, error) {
+		c, err := s.ContainerGet(ctx, &ContainerGetTask{Token: task.Token, Id: cid})
+		if err != nil {
+			return nil, err
+		}
+		return c.Status, nil
+	})
+}
@@ -0,0 +1,221 @@
+package srv
+
+import (
+	"testing"
+
+	"github.com/ability-sh/abi-lib/dynamic"
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+func TestFleet(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	token := e.login("owner@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		ids := []string{}
+
+		for _, env := range []string{"prod", "prod", "dev"} {
+			c, err := e.s.ContainerCreate(ctx, &ContainerCreateTask{Token: token, Labels: map[string]string{"env": env}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, c.Id)
+		}
+
+		fleet, err := e.s.FleetCreate(ctx, &FleetCreateTask{Token: token, Title: "prod", Selector: map[string]string{"env": "prod"}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fleet, err = e.s.FleetSet(ctx, &FleetSetTask{Token: token, Id: fleet.Id, Title: "production"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fleet.Title != "production" || fleet.Selector["env"] != "prod" {
+			t.Fatalf("unexpected fleet %+v", fleet)
+		}
+
+		rs, err := e.s.FleetGet(ctx, &FleetGetTask{Token: token, Id: fleet.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(rs.Containers) != 2 {
+			t.Fatalf("unexpected containers %v", rs.Containers)
+		}
+
+		r, err := e.s.FleetInfoSet(ctx, &FleetInfoSetTask{Token: token, Id: fleet.Id, Info: map[string]interface{}{"debug": true}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.Ok != 2 || r.Failed != 0 {
+			t.Fatalf("unexpected result %+v", r)
+		}
+
+		c, err := e.s.getContainer(ctx, ids[0])
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !dynamic.BooleanValue(dynamic.Get(c.Info, "debug"), false) {
+			t.Fatalf("unexpected container %+v", c)
+		}
+
+		_, err = e.s.ContainerSet(ctx, &ContainerSetTask{Token: token, Id: ids[1], Labels: map[string]string{"env": "dev"}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err = e.s.FleetHealth(ctx, &FleetHealthTask{Token: token, Id: fleet.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(r.Items) != 1 || r.Items[0].Id != ids[0] {
+			t.Fatalf("unexpected result %+v", r)
+		}
+
+		fleets, err := e.s.FleetGet(ctx, &FleetGetTask{Token: token, Id: fleet.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(fleets.Containers) != 1 || fleets.Containers[0] != ids[0] {
+			t.Fatalf("unexpected containers %v", fleets.Containers)
+		}
+	})
+
+	other := e.login("other@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		c, err := e.s.ContainerCreate(ctx, &ContainerCreateTask{Token: other, Labels: map[string]string{"env": "prod"}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fleet, err := e.s.FleetCreate(ctx, &FleetCreateTask{Token: other, Selector: map[string]string{"env": "prod"}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 只列出调用方是成员的容器
+		rs, err := e.s.FleetGet(ctx, &FleetGetTask{Token: other, Id: fleet.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(rs.Containers) != 1 || rs.Containers[0] != c.Id {
+			t.Fatalf("unexpected containers %v", rs.Containers)
+		}
+
+		r, err := e.s.FleetSecretRotate(ctx, &FleetSecretRotateTask{Token: other, Id: fleet.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.Ok != 1 || r.Failed != 0 {
+			t.Fatalf("unexpected result %+v", r)
+		}
+
+		_, err = e.s.FleetGet(ctx, &FleetGetTask{Token: token, Id: fleet.Id})
+
+		assertErrno(t, err, ERRNO_NOT_FOUND)
+
+		_, err = e.s.ContainerSet(ctx, &ContainerSetTask{Token: other, Id: c.Id, Labels: map[string]string{}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rs, err = e.s.FleetGet(ctx, &FleetGetTask{Token: other, Id: fleet.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(rs.Containers) != 0 {
+			t.Fatalf("unexpected containers %v", rs.Containers)
+		}
+	})
+}
+
+func TestFleetAppApprove(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	token := e.login("owner@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		app, err := e.s.AppCreate(ctx, &AppCreateTask{Token: token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.AppVerDone(ctx, &AppVerDoneTask{Token: token, Id: app.Id, Ver: "1.0", Info: map[string]interface{}{"web": map[string]interface{}{}}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids := []string{}
+
+		for i := 0; i < 2; i++ {
+			c, err := e.s.ContainerCreate(ctx, &ContainerCreateTask{Token: token, Labels: map[string]string{"env": "prod"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, c.Id)
+		}
+
+		_, err = e.s.ContainerAppSet(ctx, &ContainerAppSetTask{Token: token, Id: ids[0], Appid: app.Id, Channel: CHANNEL_LATEST, Ability: "web"})
+
+		assertErrno(t, err, ERRNO_NO_PERMISSION)
+
+		fleet, err := e.s.FleetCreate(ctx, &FleetCreateTask{Token: token, Selector: map[string]string{"env": "prod"}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.FleetAppApprove(ctx, &FleetAppApproveTask{Token: token, Id: fleet.Id})
+
+		assertErrno(t, err, ERRNO_INPUT_DATA)
+
+		r, err := e.s.FleetAppApprove(ctx, &FleetAppApproveTask{Token: token, Id: fleet.Id, Appid: app.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.Ok != 2 || r.Failed != 0 {
+			t.Fatalf("unexpected result %+v", r)
+		}
+
+		for _, id := range ids {
+			_, err = e.s.ContainerAppSet(ctx, &ContainerAppSetTask{Token: token, Id: id, Appid: app.Id, Channel: CHANNEL_LATEST, Ability: "web"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
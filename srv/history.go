@@ -0,0 +1,187 @@
+package srv
+
+import (
+	"fmt"
+
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+/**
+* 在事务中保存容器版本到 container/{id}/history/{ver}.json, 超过 retention 的旧版本删除
+**/
+func (s *objectStore) pushHistory(tx *storeTx, id string, h *ContainerHistory) error {
+
+	key := fmt.Sprintf("container/%s/history.json", id)
+
+	items := []*ContainerHistory{}
+
+	_, err := tx.GetObject(key, &items)
+
+	if err != nil {
+		return err
+	}
+
+	err = tx.PutObject(fmt.Sprintf("container/%s/history/%d.json", id, h.Ver), h)
+
+	if err != nil {
+		return err
+	}
+
+	items = append(items, &ContainerHistory{Ver: h.Ver, Uid: h.Uid, Mtime: h.Mtime})
+
+	for len(items) > s.retention {
+		tx.Del(fmt.Sprintf("container/%s/history/%d.json", id, items[0].Ver))
+		items = items[1:]
+	}
+
+	return tx.PutObject(key, items)
+}
+
+func (s *Server) getContainerHistory(ctx micro.Context, id string, ver int) (*ContainerHistory, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := config.Store().Get(ctx, fmt.Sprintf("container/%s/history/%d.json", id, ver))
+
+	if err != nil {
+		if IsErrno(err, ERRNO_NOT_FOUND) {
+			return nil, errors.Errorf(ERRNO_NOT_FOUND, "Container version that doesn't exist")
+		}
+		return nil, err
+	}
+
+	h := &ContainerHistory{}
+
+	unmarshalObject(text, h)
+
+	return h, nil
+}
+
+func (s *Server) ContainerHistoryList(ctx micro.Context, task *ContainerHistoryListTask) ([]*ContainerHistory, error) {
+
+	if task.Id == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	member, err := s.getContainerMember(ctx, task.Id, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if member.Role != ROLE_OWNER && member.Role != ROLE_READ_WRITE && member.Role != ROLE_READ_ONLY {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	items := []*ContainerHistory{}
+
+	text, err := config.Store().Get(ctx, fmt.Sprintf("container/%s/history.json", task.Id))
+
+	if err != nil {
+		if IsErrno(err, ERRNO_NOT_FOUND) {
+			return items, nil
+		}
+		return nil, err
+	}
+
+	unmarshalObject(text, &items)
+
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+
+	return items, nil
+}
+
+func (s *Server) ContainerHistoryGet(ctx micro.Context, task *ContainerHistoryGetTask) (*ContainerHistory, error) {
+
+	if task.Id == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	if task.Ver <= 0 {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter ver is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	member, err := s.getContainerMember(ctx, task.Id, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if member.Role != ROLE_OWNER && member.Role != ROLE_READ_WRITE && member.Role != ROLE_READ_ONLY {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
+
+	return s.getContainerHistory(ctx, task.Id, task.Ver)
+}
+
+func (s *Server) ContainerRollback(ctx micro.Context, task *ContainerRollbackTask) (*Container, error) {
+
+	if task.Id == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	if task.Ver <= 0 {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter ver is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	member, err := s.getContainerMember(ctx, task.Id, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if member.Role != ROLE_OWNER && member.Role != ROLE_READ_WRITE {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
+
+	h, err := s.getContainerHistory(ctx, task.Id, task.Ver)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var info interface{} = h.Info
+
+	if info == nil {
+		info = map[string]interface{}{}
+	}
+
+	container, err := s.setContainer(ctx, &ContainerSetTask{Id: task.Id, Info: info}, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return memberContainer(container, member.Role), nil
+}
@@ -0,0 +1,352 @@
+package srv
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/ability-sh/abi-lib/dynamic"
+	"github.com/ability-sh/abi-lib/json"
+)
+
+/**
+* JSON Web Key, 支持 RSA 和 EC(P-256, P-384) 公钥
+**/
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []*JWK `json:"keys"`
+}
+
+func b64big(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k *JWK) publicKey() (crypto.PublicKey, error) {
+
+	switch k.Kty {
+	case "RSA":
+
+		n, err := b64big(k.N)
+
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := b64big(k.E)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+
+		var curve elliptic.Curve
+
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+
+		x, err := b64big(k.X)
+
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := b64big(k.Y)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+func jwtHash(alg string) (crypto.Hash, error) {
+	switch alg {
+	case "RS256", "ES256":
+		return crypto.SHA256, nil
+	case "RS384", "ES384":
+		return crypto.SHA384, nil
+	case "RS512":
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported alg %s", alg)
+}
+
+/**
+* 校验 JWT 签名, 返回 claims, 不校验 exp 等字段
+**/
+func verifyJWT(token string, keys *JWKS) (map[string]interface{}, error) {
+
+	vs := strings.Split(token, ".")
+
+	if len(vs) != 3 {
+		return nil, fmt.Errorf("malformed jwt")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(vs[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	header := map[string]interface{}{}
+
+	err = unmarshalObject(b, &header)
+
+	if err != nil {
+		return nil, err
+	}
+
+	alg := dynamic.StringValue(header["alg"], "")
+	kid := dynamic.StringValue(header["kid"], "")
+
+	hash, err := jwtHash(alg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var key *JWK = nil
+
+	for _, k := range keys.Keys {
+		if (kid == "" || k.Kid == kid) && (k.Alg == "" || k.Alg == alg) && strings.HasPrefix(alg, map[string]string{"RSA": "RS", "EC": "ES"}[k.Kty]) {
+			key = k
+			break
+		}
+	}
+
+	if key == nil {
+		return nil, fmt.Errorf("no key for kid %s", kid)
+	}
+
+	pub, err := key.publicKey()
+
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(vs[2])
+
+	if err != nil {
+		return nil, err
+	}
+
+	h := hash.New()
+	h.Write([]byte(vs[0] + "." + vs[1]))
+	digest := h.Sum(nil)
+
+	switch p := pub.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(p, hash, digest, sig)
+		if err != nil {
+			return nil, err
+		}
+	case *ecdsa.PublicKey:
+		size := (p.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return nil, fmt.Errorf("invalid signature")
+		}
+		if !ecdsa.Verify(p, digest, new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])) {
+			return nil, fmt.Errorf("invalid signature")
+		}
+	}
+
+	b, err = base64.RawURLEncoding.DecodeString(vs[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	claims := map[string]interface{}{}
+
+	err = unmarshalObject(b, &claims)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+/**
+* 签发 JWT 使用的密钥, kid 为当前签名密钥, 所有密钥的公钥都发布到 JWKS
+**/
+type jwtSigner struct {
+	kid  string
+	alg  string
+	key  crypto.Signer
+	jwks *JWKS
+}
+
+func parsePrivateKey(text string) (crypto.Signer, error) {
+
+	block, _ := pem.Decode([]byte(text))
+
+	if block == nil {
+		return nil, fmt.Errorf("invalid PEM private key")
+	}
+
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key")
+	}
+
+	return signer, nil
+}
+
+/**
+* 公钥转换为 JWK, EC 只支持 P-256(ES256)
+**/
+func newJWK(kid string, pub crypto.PublicKey) (*JWK, error) {
+
+	switch p := pub.(type) {
+	case *ecdsa.PublicKey:
+		if p.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported curve %s", p.Curve.Params().Name)
+		}
+		return &JWK{Kty: "EC", Kid: kid, Alg: "ES256", Use: "sig", Crv: "P-256",
+			X: base64.RawURLEncoding.EncodeToString(p.X.FillBytes(make([]byte, 32))),
+			Y: base64.RawURLEncoding.EncodeToString(p.Y.FillBytes(make([]byte, 32)))}, nil
+	case *rsa.PublicKey:
+		return &JWK{Kty: "RSA", Kid: kid, Alg: "RS256", Use: "sig",
+			N: base64.RawURLEncoding.EncodeToString(p.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.E)).Bytes())}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type")
+}
+
+func newJwtSigner(kid string, keys map[string]string) (*jwtSigner, error) {
+
+	if kid == "" || keys[kid] == "" {
+		return nil, fmt.Errorf("jwt-kid must be one of jwt-keys")
+	}
+
+	kids := []string{}
+
+	for k := range keys {
+		kids = append(kids, k)
+	}
+
+	sort.Strings(kids)
+
+	s := &jwtSigner{kid: kid, jwks: &JWKS{Keys: []*JWK{}}}
+
+	for _, k := range kids {
+
+		key, err := parsePrivateKey(keys[k])
+
+		if err != nil {
+			return nil, fmt.Errorf("jwt-keys %s: %s", k, err.Error())
+		}
+
+		jwk, err := newJWK(k, key.Public())
+
+		if err != nil {
+			return nil, fmt.Errorf("jwt-keys %s: %s", k, err.Error())
+		}
+
+		if k == kid {
+			s.key = key
+			s.alg = jwk.Alg
+		}
+
+		s.jwks.Keys = append(s.jwks.Keys, jwk)
+	}
+
+	return s, nil
+}
+
+func (s *jwtSigner) sign(claims map[string]interface{}) (string, error) {
+
+	header, _ := json.Marshal(map[string]interface{}{"alg": s.alg, "typ": "JWT", "kid": s.kid})
+
+	payload, err := json.Marshal(claims)
+
+	if err != nil {
+		return "", err
+	}
+
+	data := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hash, _ := jwtHash(s.alg)
+
+	h := hash.New()
+	h.Write([]byte(data))
+	digest := h.Sum(nil)
+
+	var sig []byte
+
+	switch key := s.key.(type) {
+	case *ecdsa.PrivateKey:
+
+		r, ss, err := ecdsa.Sign(rand.Reader, key, digest)
+
+		if err != nil {
+			return "", err
+		}
+
+		sig = append(r.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+
+	case *rsa.PrivateKey:
+
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return data + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,251 @@
+package srv
+
+import (
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+/**
+* 邮件模版, Text 和 Html 至少有一个, 都有时发送 multipart/alternative
+**/
+type mailTemplate struct {
+	Subject string
+	Text    string
+	Html    string
+}
+
+/**
+* 加载模版目录, 每个语言一个子目录 {dir}/{locale}/subject.txt, body.txt, body.html
+**/
+func loadMailTemplates(dir string) (map[string]*mailTemplate, error) {
+
+	rs := map[string]*mailTemplate{}
+
+	if dir == "" {
+		return rs, nil
+	}
+
+	items, err := os.ReadDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	read := func(name string) (string, error) {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return "", nil
+			}
+			return "", err
+		}
+		return string(b), nil
+	}
+
+	for _, item := range items {
+
+		if !item.IsDir() {
+			continue
+		}
+
+		p := filepath.Join(dir, item.Name())
+
+		tpl := &mailTemplate{}
+
+		tpl.Subject, err = read(filepath.Join(p, "subject.txt"))
+
+		if err != nil {
+			return nil, err
+		}
+
+		tpl.Text, err = read(filepath.Join(p, "body.txt"))
+
+		if err != nil {
+			return nil, err
+		}
+
+		tpl.Html, err = read(filepath.Join(p, "body.html"))
+
+		if err != nil {
+			return nil, err
+		}
+
+		tpl.Subject = strings.TrimSpace(tpl.Subject)
+
+		if tpl.Subject == "" || (tpl.Text == "" && tpl.Html == "") {
+			return nil, fmt.Errorf("email template %s requires subject.txt and body.txt or body.html", p)
+		}
+
+		rs[strings.ToLower(item.Name())] = tpl
+	}
+
+	return rs, nil
+}
+
+/**
+* 解析 Accept-Language 格式的语言列表, 按 q 值从高到低返回
+**/
+func parseLocales(accept string) []string {
+
+	type locale struct {
+		tag string
+		q   float64
+	}
+
+	ls := []locale{}
+
+	for _, item := range strings.Split(accept, ",") {
+
+		vs := strings.Split(item, ";")
+
+		tag := strings.ToLower(strings.TrimSpace(vs[0]))
+
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		q := 1.0
+
+		for _, v := range vs[1:] {
+			v = strings.TrimSpace(v)
+			if strings.HasPrefix(v, "q=") {
+				q, _ = strconv.ParseFloat(v[2:], 64)
+			}
+		}
+
+		if q <= 0 {
+			continue
+		}
+
+		ls = append(ls, locale{tag: strings.ReplaceAll(tag, "_", "-"), q: q})
+	}
+
+	sort.SliceStable(ls, func(i, j int) bool {
+		return ls[i].q > ls[j].q
+	})
+
+	rs := []string{}
+
+	for _, l := range ls {
+		rs = append(rs, l.tag)
+	}
+
+	return rs
+}
+
+/**
+* 按语言选择验证码邮件模版, 依次匹配完整语言标签和主语言, 都没有时使用 EmailLocale, 最后使用 EmailSubject/EmailBody
+**/
+func (s *ConfigService) captchaTemplate(accept string) (string, *mailTemplate) {
+
+	for _, tag := range parseLocales(accept) {
+
+		if tpl, ok := s.emailTemplates[tag]; ok {
+			return tag, tpl
+		}
+
+		if i := strings.Index(tag, "-"); i > 0 {
+			if tpl, ok := s.emailTemplates[tag[0:i]]; ok {
+				return tag[0:i], tpl
+			}
+		}
+	}
+
+	if tpl, ok := s.emailTemplates[s.EmailLocale]; ok {
+		return s.EmailLocale, tpl
+	}
+
+	tpl := &mailTemplate{Subject: s.EmailSubject}
+
+	if s.EmailBodyType == "text/html" {
+		tpl.Html = s.EmailBody
+	} else {
+		tpl.Text = s.EmailBody
+	}
+
+	return s.EmailLocale, tpl
+}
+
+/**
+* 替换模版变量, html 中的变量会转义
+**/
+func (t *mailTemplate) render(data map[string]string) (string, string, string) {
+
+	escaped := map[string]string{}
+
+	for key, value := range data {
+		escaped[key] = html.EscapeString(value)
+	}
+
+	text := ""
+	body := ""
+
+	if t.Text != "" {
+		text = evalTemplate(t.Text, data)
+	}
+
+	if t.Html != "" {
+		body = evalTemplate(t.Html, escaped)
+	}
+
+	return evalTemplate(t.Subject, data), text, body
+}
+
+/**
+* 使用配置的发送方式发送邮件, 同时有 text 和 html 时发送 multipart/alternative
+**/
+func sendMail(ctx micro.Context, to []string, subject string, text string, body string) error {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return err
+	}
+
+	return config.Transport().Send(ctx, &Mail{Id: config.NewToken(), To: to, Subject: subject, Text: text, Html: body, Ctime: time.Now().Unix()})
+}
+
+/**
+* 查看本地发件箱, 只有开发模式下的管理员可以调用, 只有 file 和 memory 发送方式可用
+**/
+func (s *Server) MailOutbox(ctx micro.Context, task *MailOutboxTask) ([]*Mail, error) {
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !config.IsAdmin(uid) {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
+
+	outbox, ok := config.Transport().(MailOutbox)
+
+	if !config.Dev || !ok {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "The mail outbox is not enabled")
+	}
+
+	limit := task.Limit
+
+	if limit <= 0 || limit > MAIL_MEMORY_SIZE {
+		limit = MAIL_MEMORY_SIZE
+	}
+
+	return outbox.List(task.To, limit)
+}
@@ -0,0 +1,121 @@
+package srv
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+func TestMailPreview(t *testing.T) {
+
+	dir := t.TempDir()
+
+	for locale, files := range map[string]map[string]string{
+		"en": {"subject.txt": "Your code ${code}\n", "body.txt": "Hi ${email}, ${code} expires in ${expiresMinutes} minutes", "body.html": "<p>Hi ${email}</p>"},
+		"zh": {"subject.txt": "验证码 ${code}", "body.txt": "${code} 在 ${expiresMinutes} 分钟后过期"},
+	} {
+		err := os.MkdirAll(filepath.Join(dir, locale), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, text := range files {
+			err = os.WriteFile(filepath.Join(dir, locale, name), []byte(text), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	e := newTestEnvWith(t, map[string]interface{}{"email-templates": dir, "email-locale": "en", "email-expires": 600, "code-length": 4})
+
+	token := e.login("dev@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		_, err := e.s.MailPreview(ctx, &MailPreviewTask{Token: token})
+
+		assertErrno(t, err, ERRNO_NO_PERMISSION)
+	})
+
+	token = e.loginAdmin("admin@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		rs, err := e.s.MailPreview(ctx, &MailPreviewTask{Token: token, Locale: "zh-CN,zh;q=0.9,en;q=0.8"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rs.Locale != "zh" || rs.Subject != "验证码 0000" || rs.Text != "0000 在 10 分钟后过期" || rs.Html != "" {
+			t.Fatalf("unexpected preview %+v", rs)
+		}
+
+		// 没有匹配的语言时使用 email-locale, html 中的变量转义
+		rs, err = e.s.MailPreview(ctx, &MailPreviewTask{Token: token, Locale: "fr", Email: "<b>@example.com"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rs.Locale != "en" || rs.Subject != "Your code 0000" || !strings.HasPrefix(rs.Text, "Hi <b>@example.com") || rs.Html != "<p>Hi &lt;b&gt;@example.com</p>" {
+			t.Fatalf("unexpected preview %+v", rs)
+		}
+	})
+}
+
+func TestMailOutbox(t *testing.T) {
+
+	for _, options := range []map[string]interface{}{
+		{"mail-transport": MAIL_TRANSPORT_MEMORY},
+		{"mail-transport": MAIL_TRANSPORT_FILE, "mail-outbox": t.TempDir()},
+	} {
+
+		e := newTestEnvWith(t, options)
+
+		token := e.login("dev@example.com")
+
+		e.ctx(func(ctx micro.Context) {
+
+			_, err := e.s.MailOutbox(ctx, &MailOutboxTask{Token: token})
+
+			assertErrno(t, err, ERRNO_NO_PERMISSION)
+		})
+
+		token = e.loginAdmin("admin@example.com")
+
+		e.ctx(func(ctx micro.Context) {
+
+			rs, err := e.s.MailOutbox(ctx, &MailOutboxTask{Token: token, To: "DEV@example.com"})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(rs) != 1 || rs[0].To[0] != "dev@example.com" || !strings.Contains(rs[0].Subject, "captcha code") {
+				t.Fatalf("unexpected outbox %+v", rs)
+			}
+
+			// 最新的在前
+			rs, err = e.s.MailOutbox(ctx, &MailOutboxTask{Token: token, Limit: 1})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(rs) != 1 || rs[0].To[0] != "admin@example.com" {
+				t.Fatalf("unexpected outbox %+v", rs)
+			}
+
+			// 只有开发模式可用
+			e.config(ctx).Dev = false
+
+			_, err = e.s.MailOutbox(ctx, &MailOutboxTask{Token: token})
+
+			assertErrno(t, err, ERRNO_NO_PERMISSION)
+		})
+	}
+}
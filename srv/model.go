@@ -6,13 +6,48 @@ const (
 	ROLE_READ_ONLY  = "readonly"
 )
 
+const (
+	VISIBILITY_PRIVATE  = "private"
+	VISIBILITY_PUBLIC   = "public"
+	VISIBILITY_UNLISTED = "unlisted"
+)
+
 type User struct {
 	Id    string `json:"id"`
 	Email string `json:"email"`
 }
 
 type SendMailTask struct {
-	Email string `json:"email"`
+	Email  string `json:"email"`
+	Locale string `json:"locale"` //Accept-Language 格式, 如 zh-CN,zh;q=0.9,en;q=0.8
+}
+
+type MailPreviewTask struct {
+	Token  string `json:"token"`
+	Locale string `json:"locale"`
+	Email  string `json:"email"`
+}
+
+type Mail struct {
+	Id      string   `json:"id"`
+	To      []string `json:"to"`
+	Subject string   `json:"subject"`
+	Text    string   `json:"text,omitempty"`
+	Html    string   `json:"html,omitempty"`
+	Ctime   int64    `json:"ctime"`
+}
+
+type MailOutboxTask struct {
+	Token string `json:"token"`
+	To    string `json:"to"`
+	Limit int    `json:"limit"`
+}
+
+type MailPreviewResult struct {
+	Locale  string `json:"locale"`
+	Subject string `json:"subject"`
+	Text    string `json:"text,omitempty"`
+	Html    string `json:"html,omitempty"`
 }
 
 type LoginTask struct {
@@ -21,31 +56,120 @@ type LoginTask struct {
 }
 
 type LoginResult struct {
-	Token string `json:"token"`
-	User  *User  `json:"user"`
+	Token        string `json:"token,omitempty"`
+	RefreshToken string `json:"refreshToken,omitempty"`
+	Expires      int64  `json:"expires,omitempty"`
+	User         *User  `json:"user,omitempty"`
+	Mfa          bool   `json:"mfa,omitempty"`
+	Ticket       string `json:"ticket,omitempty"`
+}
+
+type TokenRefreshTask struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+type LogoutTask struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+type JwksTask struct {
 }
 
 type UserGetTask struct {
 	Token string `json:"token"`
 }
 
+const (
+	CHANNEL_LATEST = "latest"
+)
+
+type ContainerApp struct {
+	Appid   string      `json:"appid"`
+	Channel string      `json:"channel,omitempty"`
+	Ver     string      `json:"ver,omitempty"`
+	Ability string      `json:"ability"`
+	Config  interface{} `json:"config,omitempty"`
+}
+
+const (
+	CONTAINER_STATE_UNKNOWN = "unknown"
+	CONTAINER_STATE_ONLINE  = "online"
+	CONTAINER_STATE_OFFLINE = "offline"
+)
+
+type ContainerAppStatus struct {
+	Appid   string `json:"appid"`
+	Ver     string `json:"ver"`
+	Ability string `json:"ability"`
+	Health  string `json:"health,omitempty"`
+}
+
+type ContainerStatus struct {
+	State    string                `json:"state"`
+	LastSeen int64                 `json:"lastSeen,omitempty"`
+	Ver      int                   `json:"ver,omitempty"`
+	Health   string                `json:"health,omitempty"`
+	AgentVer string                `json:"agentVer,omitempty"`
+	Ip       string                `json:"ip,omitempty"`
+	Apps     []*ContainerAppStatus `json:"apps,omitempty"`
+}
+
 type Container struct {
-	Id     string      `json:"id"`
-	Info   interface{} `json:"info,omitempty"`
-	Ver    int         `json:"ver"`
-	Secret string      `json:"secret"`
+	Id         string            `json:"id"`
+	Info       interface{}       `json:"info,omitempty"`
+	Ver        int               `json:"ver"`
+	Secret     string            `json:"secret,omitempty"`
+	Apps       []*ContainerApp   `json:"apps,omitempty"`
+	Secrets    map[string]string `json:"secrets,omitempty"`
+	Template   string            `json:"template,omitempty"`
+	Vars       map[string]string `json:"vars,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	RequireMfa bool              `json:"requireMfa,omitempty"`
+	Status     *ContainerStatus  `json:"status,omitempty"`
 }
 
 type ContainerCreateTask struct {
-	Token string      `json:"token"`
-	Info  interface{} `json:"info"`
+	Token  string            `json:"token"`
+	Info   interface{}       `json:"info"`
+	Labels map[string]string `json:"labels"`
 }
 
 type ContainerSetTask struct {
-	Token  string      `json:"token"`
-	Id     string      `json:"id"`
-	Info   interface{} `json:"info"`
-	Secret bool        `json:"secret"`
+	Token       string            `json:"token"`
+	Id          string            `json:"id"`
+	Info        interface{}       `json:"info"`
+	Secret      bool              `json:"secret"`
+	PatchType   string            `json:"patchType"`
+	Patch       interface{}       `json:"patch"`
+	ExpectedVer int               `json:"expectedVer"`
+	Secrets     interface{}       `json:"secrets"`
+	Labels      map[string]string `json:"labels"`
+}
+
+type ContainerHistory struct {
+	Ver   int         `json:"ver"`
+	Info  interface{} `json:"info,omitempty"`
+	Uid   string      `json:"uid,omitempty"`
+	Mtime int64       `json:"mtime"`
+}
+
+type ContainerHistoryListTask struct {
+	Token string `json:"token"`
+	Id    string `json:"id"`
+}
+
+type ContainerHistoryGetTask struct {
+	Token string `json:"token"`
+	Id    string `json:"id"`
+	Ver   int    `json:"ver"`
+}
+
+type ContainerRollbackTask struct {
+	Token string `json:"token"`
+	Id    string `json:"id"`
+	Ver   int    `json:"ver"`
 }
 
 type ContainerGetTask struct {
@@ -58,11 +182,27 @@ type ContainerInfoGetTask struct {
 	Id        string `json:"id"`
 	Timestamp int64  `json:"timestamp"`
 	Ver       int    `json:"ver"`
+	Wait      int    `json:"wait"`
+	Encrypt   bool   `json:"encrypt"`
 }
 
 type ContainerInfoGetResult struct {
-	Info interface{} `json:"info,omitempty"`
-	Ver  int         `json:"ver"`
+	Info      interface{}       `json:"info,omitempty"`
+	Ver       int               `json:"ver"`
+	Apps      []*ContainerApp   `json:"apps,omitempty"`
+	Secrets   map[string]string `json:"secrets,omitempty"`
+	Encrypted bool              `json:"encrypted,omitempty"`
+}
+
+type ContainerReportTask struct {
+	Sign      string                `json:"sign"`
+	Id        string                `json:"id"`
+	Timestamp int64                 `json:"timestamp"`
+	Nonce     string                `json:"nonce"` //每次上报不同, 时间窗口内重复的上报视为重放
+	Ver       int                   `json:"ver"`
+	Health    string                `json:"health"`
+	AgentVer  string                `json:"agentVer"`
+	Apps      []*ContainerAppStatus `json:"apps"`
 }
 
 type Member struct {
@@ -92,19 +232,47 @@ type ContainerAppGetTask struct {
 	Timestamp int64  `json:"timestamp"`
 }
 
+type ContainerAppSetTask struct {
+	Token   string      `json:"token"`
+	Id      string      `json:"id"`
+	Appid   string      `json:"appid"`
+	Channel string      `json:"channel"`
+	Ver     string      `json:"ver"`
+	Ability string      `json:"ability"`
+	Config  interface{} `json:"config"`
+}
+
+type ContainerAppRemoveTask struct {
+	Token string `json:"token"`
+	Id    string `json:"id"`
+	Appid string `json:"appid"`
+}
+
+type ContainerTemplateSetTask struct {
+	Token    string            `json:"token"`
+	Id       string            `json:"id"`
+	Template string            `json:"template"`
+	Vars     map[string]string `json:"vars"`
+}
+
 type ContainerAppGetResult struct {
 	Info interface{} `json:"info,omitempty"`
 	Url  string      `json:"url,omitempty"`
 }
 
 type App struct {
-	Id   string      `json:"id"`
-	Info interface{} `json:"info,omitempty"`
+	Id         string      `json:"id"`
+	Info       interface{} `json:"info,omitempty"`
+	Visibility string      `json:"visibility,omitempty"`
+	Ver        string      `json:"ver,omitempty"`
+	Abilities  []string    `json:"abilities,omitempty"`
+	Rev        int         `json:"rev"` //应用信息的修订号, 每次 AppSet 加一, ver 是最新发布的版本号, 不随信息修改变化
 }
 
 type AppCreateTask struct {
-	Token string      `json:"token"`
-	Info  interface{} `json:"info,omitempty"`
+	Token      string      `json:"token"`
+	Info       interface{} `json:"info,omitempty"`
+	Visibility string      `json:"visibility"`
 }
 
 type AppGetTask struct {
@@ -113,9 +281,13 @@ type AppGetTask struct {
 }
 
 type AppSetTask struct {
-	Token string      `json:"token"`
-	Id    string      `json:"id"`
-	Info  interface{} `json:"info,omitempty"`
+	Token       string      `json:"token"`
+	Id          string      `json:"id"`
+	Info        interface{} `json:"info,omitempty"`
+	Visibility  string      `json:"visibility"`
+	PatchType   string      `json:"patchType"`
+	Patch       interface{} `json:"patch"`
+	ExpectedRev int         `json:"expectedRev"` //与容器的 expectedVer 作用相同, 应用的 ver 是发布版本号, 所以比较 rev
 }
 
 type AppVerUpTask struct {
@@ -130,10 +302,11 @@ type AppVerUpResult struct {
 }
 
 type AppVerDoneTask struct {
-	Token string      `json:"token"`
-	Id    string      `json:"id"`
-	Ver   string      `json:"ver"`
-	Info  interface{} `json:"info,omitempty"`
+	Token  string      `json:"token"`
+	Id     string      `json:"id"`
+	Ver    string      `json:"ver"`
+	Info   interface{} `json:"info,omitempty"`
+	Staged bool        `json:"staged"`
 }
 
 type AppMemberAddTask struct {
@@ -166,3 +339,392 @@ type AppUnapproveTask struct {
 	Id          string `json:"id"`
 	ContainerId string `json:"containerId"`
 }
+
+type AppCatalogTask struct {
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+}
+
+type AppCatalogItem struct {
+	Id          string   `json:"id"`
+	Title       string   `json:"title,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Ver         string   `json:"ver,omitempty"`
+	Abilities   []string `json:"abilities,omitempty"`
+}
+
+type AppCatalogResult struct {
+	Items []*AppCatalogItem `json:"items"`
+	Total int               `json:"total"`
+}
+
+type AppSearchTask struct {
+	Q       string `json:"q"`
+	Tag     string `json:"tag"`
+	Ability string `json:"ability"`
+	Sort    string `json:"sort"`
+	Cursor  string `json:"cursor"`
+	Limit   int    `json:"limit"`
+}
+
+type AppSearchResult struct {
+	Items  []*AppCatalogItem `json:"items"`
+	Cursor string            `json:"cursor,omitempty"`
+}
+
+type Template struct {
+	Id   string      `json:"id"`
+	Info interface{} `json:"info,omitempty"`
+	Ver  int         `json:"ver"`
+}
+
+type TemplateCreateTask struct {
+	Token string      `json:"token"`
+	Info  interface{} `json:"info"`
+}
+
+type TemplateSetTask struct {
+	Token string      `json:"token"`
+	Id    string      `json:"id"`
+	Info  interface{} `json:"info"`
+}
+
+type TemplateGetTask struct {
+	Token string `json:"token"`
+	Id    string `json:"id"`
+}
+
+type TemplateMemberAddTask struct {
+	Token string `json:"token"`
+	Id    string `json:"id"`
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+type TemplateMemberRemoveTask struct {
+	Token string `json:"token"`
+	Id    string `json:"id"`
+	Email string `json:"email"`
+}
+
+type Fleet struct {
+	Id       string            `json:"id"`
+	Title    string            `json:"title,omitempty"`
+	Selector map[string]string `json:"selector"`
+}
+
+type FleetCreateTask struct {
+	Token    string            `json:"token"`
+	Title    string            `json:"title"`
+	Selector map[string]string `json:"selector"`
+}
+
+type FleetSetTask struct {
+	Token    string            `json:"token"`
+	Id       string            `json:"id"`
+	Title    string            `json:"title"`
+	Selector map[string]string `json:"selector"`
+}
+
+type FleetGetTask struct {
+	Token string `json:"token"`
+	Id    string `json:"id"`
+}
+
+type FleetGetResult struct {
+	Fleet      *Fleet   `json:"fleet"`
+	Containers []string `json:"containers"`
+}
+
+type FleetAppApproveTask struct {
+	Token string `json:"token"`
+	Id    string `json:"id"`
+	Appid string `json:"appid"`
+}
+
+type FleetInfoSetTask struct {
+	Token string      `json:"token"`
+	Id    string      `json:"id"`
+	Info  interface{} `json:"info"`
+}
+
+type FleetSecretRotateTask struct {
+	Token string `json:"token"`
+	Id    string `json:"id"`
+}
+
+type FleetHealthTask struct {
+	Token string `json:"token"`
+	Id    string `json:"id"`
+}
+
+type FleetItemResult struct {
+	Id     string      `json:"id"`
+	Errno  int32       `json:"errno"`
+	Errmsg string      `json:"errmsg,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+type FleetResult struct {
+	Items  []*FleetItemResult `json:"items"`
+	Ok     int                `json:"ok"`
+	Failed int                `json:"failed"`
+}
+
+const (
+	ROLLOUT_STATE_RUNNING   = "running"
+	ROLLOUT_STATE_PAUSED    = "paused"
+	ROLLOUT_STATE_COMPLETED = "completed"
+	ROLLOUT_STATE_ABORTED   = "aborted"
+)
+
+type Rollout struct {
+	Id       string            `json:"id"`
+	Appid    string            `json:"appid"`
+	Ver      string            `json:"ver"`
+	BaseVer  string            `json:"baseVer,omitempty"`
+	Selector map[string]string `json:"selector,omitempty"`
+	Steps    []int             `json:"steps"`
+	Step     int               `json:"step"`
+	State    string            `json:"state"`
+	Uid      string            `json:"uid"`
+	Ctime    int64             `json:"ctime"`
+	Mtime    int64             `json:"mtime"`
+}
+
+type RolloutCreateTask struct {
+	Token    string            `json:"token"`
+	Appid    string            `json:"appid"`
+	Ver      string            `json:"ver"`
+	Selector map[string]string `json:"selector"`
+	Steps    []int             `json:"steps"`
+}
+
+type RolloutTask struct {
+	Token string `json:"token"`
+	Appid string `json:"appid"`
+}
+
+type RolloutHealth struct {
+	Total     int `json:"total"`
+	Targeted  int `json:"targeted"`
+	Updated   int `json:"updated"`
+	Online    int `json:"online"`
+	Offline   int `json:"offline"`
+	Unhealthy int `json:"unhealthy"`
+}
+
+type RolloutGetResult struct {
+	Rollout *Rollout       `json:"rollout"`
+	Health  *RolloutHealth `json:"health"`
+}
+
+const (
+	WEBHOOK_SCOPE_APP       = "app"
+	WEBHOOK_SCOPE_CONTAINER = "container"
+)
+
+const (
+	EVENT_VERSION_PUBLISHED = "version.published"
+	EVENT_APP_APPROVED      = "app.approved"
+	EVENT_APP_UNAPPROVED    = "app.unapproved"
+	EVENT_CONTAINER_UPDATED = "container.updated"
+	EVENT_MEMBER_CHANGED    = "member.changed"
+)
+
+const (
+	DELIVERY_STATE_PENDING   = "pending"
+	DELIVERY_STATE_SUCCEEDED = "succeeded"
+	DELIVERY_STATE_FAILED    = "failed"
+)
+
+type Webhook struct {
+	Id     string   `json:"id"`
+	Scope  string   `json:"scope"`
+	Target string   `json:"target"`
+	Url    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+	Uid    string   `json:"uid"`
+	Ctime  int64    `json:"ctime"`
+}
+
+type WebhookCreateTask struct {
+	Token  string   `json:"token"`
+	Scope  string   `json:"scope"`
+	Target string   `json:"target"`
+	Url    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+type WebhookRemoveTask struct {
+	Token string `json:"token"`
+	Id    string `json:"id"`
+}
+
+type WebhookListTask struct {
+	Token  string `json:"token"`
+	Scope  string `json:"scope"`
+	Target string `json:"target"`
+}
+
+type WebhookEvent struct {
+	Id     string      `json:"id"`
+	Event  string      `json:"event"`
+	Scope  string      `json:"scope"`
+	Target string      `json:"target"`
+	Time   int64       `json:"time"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+type WebhookDelivery struct {
+	Id       string        `json:"id"`
+	Webhook  string        `json:"webhook"`
+	Event    *WebhookEvent `json:"event"`
+	State    string        `json:"state"`
+	Attempts int           `json:"attempts"`
+	Code     int           `json:"code,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Next     int64         `json:"next,omitempty"`
+	Ctime    int64         `json:"ctime"`
+	Mtime    int64         `json:"mtime"`
+}
+
+type WebhookDeliveryListTask struct {
+	Token string `json:"token"`
+	Id    string `json:"id"`
+	Limit int    `json:"limit"`
+}
+
+const (
+	EVENT_CONTAINER_OFFLINE = "container.offline"
+)
+
+type NotifyPrefs struct {
+	Events []string `json:"events"`
+}
+
+type NotifyPrefsGetTask struct {
+	Token string `json:"token"`
+}
+
+type NotifyPrefsSetTask struct {
+	Token  string   `json:"token"`
+	Events []string `json:"events"`
+}
+
+type OidcAuthorizeTask struct {
+}
+
+type OidcAuthorizeResult struct {
+	Url   string `json:"url"`
+	State string `json:"state"`
+}
+
+type OidcLoginTask struct {
+	Code  string `json:"code"`
+	State string `json:"state"`
+}
+
+type Totp struct {
+	Secret   string   `json:"secret"`
+	Enabled  bool     `json:"enabled"`
+	Recovery []string `json:"recovery,omitempty"`
+	Ctime    int64    `json:"ctime"`
+}
+
+type TotpEnrollTask struct {
+	Token string `json:"token"`
+}
+
+type TotpEnrollResult struct {
+	Secret string `json:"secret"`
+	Uri    string `json:"uri"`
+}
+
+type TotpConfirmTask struct {
+	Token string `json:"token"`
+	Code  string `json:"code"`
+}
+
+type TotpConfirmResult struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+type TotpDisableTask struct {
+	Token string `json:"token"`
+	Code  string `json:"code"`
+}
+
+type LoginTotpTask struct {
+	Ticket string `json:"ticket"`
+	Code   string `json:"code"`
+}
+
+type ContainerMfaSetTask struct {
+	Token    string `json:"token"`
+	Id       string `json:"id"`
+	Required bool   `json:"required"`
+}
+
+type Passkey struct {
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	Key       *JWK   `json:"key,omitempty"`
+	SignCount uint32 `json:"signCount"`
+	Ctime     int64  `json:"ctime"`
+	Atime     int64  `json:"atime,omitempty"`
+}
+
+type PasskeyRegisterBeginTask struct {
+	Token string `json:"token"`
+}
+
+type PasskeyRegisterFinishTask struct {
+	Token             string `json:"token"`
+	Name              string `json:"name"`
+	Id                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+}
+
+type PasskeyLoginBeginTask struct {
+	Email string `json:"email"`
+}
+
+type PasskeyLoginFinishTask struct {
+	Id                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"userHandle"`
+}
+
+type PasskeyListTask struct {
+	Token string `json:"token"`
+}
+
+type PasskeyRemoveTask struct {
+	Token string `json:"token"`
+	Id    string `json:"id"`
+}
+
+type MemberIndexRebuildTask struct {
+	Token string   `json:"token"`
+	Kind  string   `json:"kind"`
+	Id    string   `json:"id"`
+	Uids  []string `json:"uids"`
+}
+
+type CacheStatsGetTask struct {
+	Token string `json:"token"`
+}
+
+type CacheStats struct {
+	LocalHit    int64 `json:"localHit"`
+	RedisHit    int64 `json:"redisHit"`
+	NegativeHit int64 `json:"negativeHit"`
+	Miss        int64 `json:"miss"`
+	RedisError  int64 `json:"redisError"`
+}
@@ -0,0 +1,609 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-lib/json"
+	"github.com/ability-sh/abi-micro/micro"
+	"github.com/ability-sh/abi-micro/redis"
+	R "github.com/go-redis/redis/v8"
+)
+
+const (
+	NOTIFY_RETRY   = 5
+	NOTIFY_BACKOFF = 60
+	NOTIFY_EXPIRES = 86400
+)
+
+/**
+* 通知队列中的一封邮件, 保存在 {prefix}nt_{id}, 队列 {prefix}nt_queue 的分数为下次发送时间
+**/
+type notifyJob struct {
+	Event    string            `json:"event"`
+	Uid      string            `json:"uid"`
+	Data     map[string]string `json:"data"`
+	Attempts int               `json:"attempts"`
+}
+
+func isNotifyEvent(event string) bool {
+	switch event {
+	case EVENT_MEMBER_CHANGED, EVENT_VERSION_PUBLISHED, EVENT_APP_APPROVED, EVENT_CONTAINER_OFFLINE:
+		return true
+	}
+	return false
+}
+
+/**
+* 替换模版中的 ${name}, 不存在的变量替换为空字符串
+**/
+func evalTemplate(tpl string, data map[string]string) string {
+	return parseEval(tpl, func(key string) string {
+		return data[key]
+	})
+}
+
+func (s *ConfigService) notifyTemplate(event string) (string, string) {
+	switch event {
+	case EVENT_MEMBER_CHANGED:
+		return s.NotifyMemberSubject, s.NotifyMemberBody
+	case EVENT_VERSION_PUBLISHED:
+		return s.NotifyVersionSubject, s.NotifyVersionBody
+	case EVENT_APP_APPROVED:
+		return s.NotifyApprovedSubject, s.NotifyApprovedBody
+	case EVENT_CONTAINER_OFFLINE:
+		return s.NotifyOfflineSubject, s.NotifyOfflineBody
+	}
+	return "", ""
+}
+
+/**
+* 成员索引, 返回 {uid: role}
+**/
+func (s *Server) getMembers(ctx micro.Context, kind string, id string) (map[string]string, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return config.Store().ListMembers(ctx, kind, id)
+}
+
+/**
+* 读取成员, 成员不在成员索引中时补进索引
+* 成员索引之前添加的应用和容器成员没有索引, 在下次读取时补全
+**/
+func (s *Server) memberLoader(ctx micro.Context, kind string, id string, uid string) func() ([]byte, error) {
+
+	load := s.loader(ctx, memberKey(kind, id, uid))
+
+	return func() ([]byte, error) {
+
+		text, err := load()
+
+		if err != nil {
+			return nil, err
+		}
+
+		member := &Member{}
+
+		err = unmarshalObject(text, member)
+
+		if err != nil || member.Role == "" {
+			return text, nil
+		}
+
+		member.Id = uid
+
+		members, err := s.getMembers(ctx, kind, id)
+
+		if err == nil && members[uid] == member.Role {
+			return text, nil
+		}
+
+		config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = config.Store().IndexMember(ctx, kind, id, member)
+
+		if err != nil {
+			ctx.Println("member", "index", kind, id, uid, err)
+		}
+
+		return text, nil
+	}
+}
+
+/**
+* 按给定的 uid 重建成员索引, 成员存在时加入索引, 不存在时从索引中删除, 只有管理员可以调用
+* abi-db 不能按前缀列出 key, uid 需要从存储中导出
+**/
+func (s *Server) MemberIndexRebuild(ctx micro.Context, task *MemberIndexRebuildTask) (map[string]string, error) {
+
+	if task.Kind != "app" && task.Kind != "container" && task.Kind != "template" && task.Kind != "fleet" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter kind is incorrect")
+	}
+
+	if task.Id == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !config.IsAdmin(uid) {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
+
+	for _, v := range task.Uids {
+
+		member, err := config.Store().GetMember(ctx, task.Kind, task.Id, v)
+
+		if err != nil {
+
+			if !IsErrno(err, ERRNO_NOT_FOUND) {
+				return nil, err
+			}
+
+			err = config.Store().DelMember(ctx, task.Kind, task.Id, v)
+
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		member.Id = v
+
+		err = config.Store().IndexMember(ctx, task.Kind, task.Id, member)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s.getMembers(ctx, task.Kind, task.Id)
+}
+
+func (s *Server) getNotifyPrefs(ctx micro.Context, uid string) (*NotifyPrefs, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	prefs := &NotifyPrefs{Events: []string{}}
+
+	text, err := config.Store().Get(ctx, fmt.Sprintf("user/%s/notify.json", uid))
+
+	if err != nil {
+		if IsErrno(err, ERRNO_NOT_FOUND) {
+			return prefs, nil
+		}
+		return nil, err
+	}
+
+	unmarshalObject(text, prefs)
+
+	return prefs, nil
+}
+
+/**
+* 通知邮件加入队列, 由后台任务发送, 失败只记录日志不影响调用方
+**/
+func (s *Server) notify(ctx micro.Context, event string, uids []string, data map[string]string) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		ctx.Println("notify", event, err)
+		return
+	}
+
+	if !config.NotifyEnabled || len(uids) == 0 {
+		return
+	}
+
+	cli, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		ctx.Println("notify", event, err)
+		return
+	}
+
+	now := time.Now()
+
+	for _, uid := range uids {
+
+		id := config.NewID(ctx)
+
+		b, _ := json.Marshal(&notifyJob{Event: event, Uid: uid, Data: data})
+
+		err = cli.Set(context.Background(), fmt.Sprintf("%snt_%s", config.Prefix, id), b, time.Duration(NOTIFY_EXPIRES)*time.Second).Err()
+
+		if err == nil {
+			err = cli.ZAdd(context.Background(), fmt.Sprintf("%snt_queue", config.Prefix), &R.Z{Score: float64(now.UnixMilli()), Member: id}).Err()
+		}
+
+		if err != nil {
+			ctx.Println("notify", event, uid, err)
+		}
+	}
+}
+
+/**
+* 发送队列中的一封通知邮件, 失败时按指数退避重新加入队列, 超过最大次数丢弃
+**/
+func (s *Server) deliverNotify(ctx micro.Context, id string) error {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return err
+	}
+
+	cli, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%snt_%s", config.Prefix, id)
+
+	text, err := cli.Get(context.Background(), key).Result()
+
+	if err != nil {
+		if redis.IsNil(err) {
+			return nil
+		}
+		return err
+	}
+
+	job := &notifyJob{}
+
+	err = unmarshalObject([]byte(text), job)
+
+	if err != nil {
+		cli.Del(context.Background(), key)
+		return err
+	}
+
+	err = s.notifyUser(ctx, config, job.Event, job.Uid, job.Data)
+
+	if err == nil {
+		return cli.Del(context.Background(), key).Err()
+	}
+
+	job.Attempts = job.Attempts + 1
+
+	if job.Attempts >= NOTIFY_RETRY {
+		cli.Del(context.Background(), key)
+		return fmt.Errorf("%s %s dropped after %d attempts: %s", job.Event, job.Uid, job.Attempts, err.Error())
+	}
+
+	ctx.Println("notify", job.Event, job.Uid, err)
+
+	next := time.Now().Add(time.Duration(NOTIFY_BACKOFF) * time.Second << (job.Attempts - 1))
+
+	b, _ := json.Marshal(job)
+
+	err = cli.Set(context.Background(), key, b, time.Duration(NOTIFY_EXPIRES)*time.Second).Err()
+
+	if err != nil {
+		return err
+	}
+
+	return cli.ZAdd(context.Background(), fmt.Sprintf("%snt_queue", config.Prefix), &R.Z{Score: float64(next.UnixMilli()), Member: id}).Err()
+}
+
+func (s *Server) notifyUser(ctx micro.Context, config *ConfigService, event string, uid string, data map[string]string) error {
+
+	prefs, err := s.getNotifyPrefs(ctx, uid)
+
+	if err != nil {
+		return err
+	}
+
+	subscribed := false
+
+	for _, v := range prefs.Events {
+		if v == event {
+			subscribed = true
+			break
+		}
+	}
+
+	if !subscribed {
+		return nil
+	}
+
+	u, err := s.getUserById(ctx, uid)
+
+	if err != nil {
+		return err
+	}
+
+	if !re_email.MatchString(u.Email) {
+		return nil
+	}
+
+	subject, body := config.notifyTemplate(event)
+
+	if config.NotifyBodyType == "text/html" {
+		return sendMail(ctx, []string{u.Email}, evalTemplate(subject, data), "", evalTemplate(body, data))
+	}
+
+	return sendMail(ctx, []string{u.Email}, evalTemplate(subject, data), evalTemplate(body, data), "")
+}
+
+/**
+* 通知成员索引中的成员, owner 为 true 时只通知所有者
+**/
+func (s *Server) notifyMembers(ctx micro.Context, kind string, id string, owner bool, event string, data map[string]string) {
+
+	members, err := s.getMembers(ctx, kind, id)
+
+	if err != nil {
+		ctx.Println("notify", event, err)
+		return
+	}
+
+	uids := []string{}
+
+	for uid, role := range members {
+		if !owner || role == ROLE_OWNER {
+			uids = append(uids, uid)
+		}
+	}
+
+	s.notify(ctx, event, uids, data)
+}
+
+/**
+* 记录容器心跳, 用于离线检测
+**/
+func (s *Server) touchContainer(ctx micro.Context, id string, lastSeen int64) error {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return err
+	}
+
+	cli, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		return err
+	}
+
+	return cli.ZAdd(context.Background(), fmt.Sprintf("%shb", config.Prefix), &R.Z{Score: float64(lastSeen), Member: id}).Err()
+}
+
+type notifyWorker struct {
+	s    *Server
+	p    micro.Payload
+	done chan struct{}
+}
+
+/**
+* 后台检测离线容器并通知所有者, 发送队列中的通知邮件, 多个进程通过 ZREM 争抢
+**/
+func NewNotifyWorker(s *Server, p micro.Payload) micro.Recycle {
+	w := &notifyWorker{s: s, p: p, done: make(chan struct{})}
+	go w.run()
+	return w
+}
+
+func (w *notifyWorker) run() {
+
+	tk := time.NewTicker(10 * time.Second)
+
+	defer tk.Stop()
+
+	mk := time.NewTicker(time.Second)
+
+	defer mk.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-tk.C:
+			w.poll()
+		case <-mk.C:
+			w.pollMail()
+		}
+	}
+}
+
+func (w *notifyWorker) pollMail() {
+
+	ctx, err := w.p.NewContext("__notify__", micro.NewTrace())
+
+	if err != nil {
+		return
+	}
+
+	defer ctx.Recycle()
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		ctx.Println("notify", err)
+		return
+	}
+
+	cli, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		ctx.Println("notify", err)
+		return
+	}
+
+	key := fmt.Sprintf("%snt_queue", config.Prefix)
+
+	items, err := cli.ZRangeByScore(context.Background(), key, &R.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(time.Now().UnixMilli(), 10), Count: 20}).Result()
+
+	if err != nil {
+		ctx.Println("notify", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+
+	for _, item := range items {
+
+		n, err := cli.ZRem(context.Background(), key, item).Result()
+
+		if err != nil || n == 0 {
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(id string) {
+			defer wg.Done()
+			w.deliver(id)
+		}(item)
+	}
+
+	wg.Wait()
+}
+
+func (w *notifyWorker) deliver(id string) {
+
+	ctx, err := w.p.NewContext("__notify__", micro.NewTrace())
+
+	if err != nil {
+		return
+	}
+
+	defer ctx.Recycle()
+
+	err = w.s.deliverNotify(ctx, id)
+
+	if err != nil {
+		ctx.Println("notify", id, err)
+	}
+}
+
+func (w *notifyWorker) poll() {
+
+	ctx, err := w.p.NewContext("__notify__", micro.NewTrace())
+
+	if err != nil {
+		return
+	}
+
+	defer ctx.Recycle()
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		ctx.Println("notify", err)
+		return
+	}
+
+	cli, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		ctx.Println("notify", err)
+		return
+	}
+
+	key := fmt.Sprintf("%shb", config.Prefix)
+
+	max := time.Now().Unix() - int64(config.ContainerOfflineExpires)
+
+	items, err := cli.ZRangeByScoreWithScores(context.Background(), key, &R.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(max, 10), Count: 100}).Result()
+
+	if err != nil {
+		ctx.Println("notify", err)
+		return
+	}
+
+	for _, item := range items {
+
+		id, _ := item.Member.(string)
+
+		n, err := cli.ZRem(context.Background(), key, id).Result()
+
+		if err != nil || n == 0 {
+			continue
+		}
+
+		lastSeen := time.Unix(int64(item.Score), 0).UTC().Format(time.RFC3339)
+
+		w.s.notifyMembers(ctx, "container", id, true, EVENT_CONTAINER_OFFLINE, map[string]string{"containerId": id, "lastSeen": lastSeen})
+	}
+}
+
+func (w *notifyWorker) Recycle() {
+	close(w.done)
+}
+
+func (s *Server) NotifyPrefsGet(ctx micro.Context, task *NotifyPrefsGetTask) (*NotifyPrefs, error) {
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.getNotifyPrefs(ctx, uid)
+}
+
+func (s *Server) NotifyPrefsSet(ctx micro.Context, task *NotifyPrefsSetTask) (*NotifyPrefs, error) {
+
+	for _, event := range task.Events {
+		if !isNotifyEvent(event) {
+			return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter events is incorrect")
+		}
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	prefs := &NotifyPrefs{Events: task.Events}
+
+	if prefs.Events == nil {
+		prefs.Events = []string{}
+	}
+
+	err = config.Store().PutObject(ctx, fmt.Sprintf("user/%s/notify.json", uid), prefs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return prefs, nil
+}
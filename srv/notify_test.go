@@ -0,0 +1,137 @@
+package srv
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+func TestNotifyPrefs(t *testing.T) {
+
+	e := newTestEnvWith(t, map[string]interface{}{"notify-enabled": true})
+
+	rs := e.loginResult("owner@example.com")
+
+	other := e.loginResult("other@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		prefs, err := e.s.NotifyPrefsGet(ctx, &NotifyPrefsGetTask{Token: rs.Token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(prefs.Events) != 0 {
+			t.Fatalf("unexpected prefs %+v", prefs)
+		}
+
+		_, err = e.s.NotifyPrefsSet(ctx, &NotifyPrefsSetTask{Token: rs.Token, Events: []string{"unknown"}})
+
+		assertErrno(t, err, ERRNO_INPUT_DATA)
+
+		_, err = e.s.NotifyPrefsSet(ctx, &NotifyPrefsSetTask{Token: rs.Token, Events: []string{EVENT_VERSION_PUBLISHED}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		prefs, err = e.s.NotifyPrefsGet(ctx, &NotifyPrefsGetTask{Token: rs.Token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(prefs.Events) != 1 || prefs.Events[0] != EVENT_VERSION_PUBLISHED {
+			t.Fatalf("unexpected prefs %+v", prefs)
+		}
+
+		// 只有订阅了事件的用户收到邮件
+		e.s.notify(ctx, EVENT_VERSION_PUBLISHED, []string{rs.User.Id, other.User.Id}, map[string]string{"appid": "a", "ver": "1.0"})
+
+		ids, err := e.r.ZMembers("test_nt_queue")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(ids) != 2 {
+			t.Fatalf("unexpected queue %v", ids)
+		}
+
+		for _, id := range ids {
+			err = e.s.deliverNotify(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		mails, err := e.config(ctx).Transport().(MailOutbox).List("", MAIL_MEMORY_SIZE)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sent := []*Mail{}
+
+		for _, m := range mails {
+			if strings.Contains(m.Subject, "published") {
+				sent = append(sent, m)
+			}
+		}
+
+		if len(sent) != 1 || sent[0].To[0] != "owner@example.com" || sent[0].Subject != "App a 1.0 has been published" {
+			t.Fatalf("unexpected mails %+v", sent)
+		}
+	})
+}
+
+func TestMemberIndexRebuild(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	rs := e.loginResult("owner@example.com")
+
+	admin := e.loginAdmin("admin@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		c, err := e.s.ContainerCreate(ctx, &ContainerCreateTask{Token: rs.Token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 模拟索引之前的数据, 索引中缺少所有者且有已删除的成员
+		err = e.config(ctx).Store().PutObject(ctx, "container/"+c.Id+"/members.json", map[string]string{"ghost": ROLE_READ_ONLY})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		task := &MemberIndexRebuildTask{Token: rs.Token, Kind: "container", Id: c.Id, Uids: []string{rs.User.Id, "ghost"}}
+
+		_, err = e.s.MemberIndexRebuild(ctx, task)
+
+		assertErrno(t, err, ERRNO_NO_PERMISSION)
+
+		task.Token = admin
+
+		members, err := e.s.MemberIndexRebuild(ctx, task)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(members) != 1 || members[rs.User.Id] != ROLE_OWNER {
+			t.Fatalf("unexpected members %v", members)
+		}
+
+		task.Kind = "user"
+
+		_, err = e.s.MemberIndexRebuild(ctx, task)
+
+		assertErrno(t, err, ERRNO_INPUT_DATA)
+	})
+}
@@ -0,0 +1,408 @@
+package srv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ability-sh/abi-lib/dynamic"
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-lib/json"
+	"github.com/ability-sh/abi-micro/http"
+	"github.com/ability-sh/abi-micro/micro"
+	"github.com/ability-sh/abi-micro/redis"
+)
+
+const (
+	OIDC_STATE_EXPIRES = 600
+	OIDC_CLOCK_SKEW    = 60
+)
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type oidcState struct {
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+	Session  string `json:"session"` //发起授权的浏览器会话, 回调时必须相同
+}
+
+func (s *Server) oidcGet(ctx micro.Context, u string, object interface{}) error {
+
+	HTTP, err := http.GetHTTPService(ctx, SERVICE_HTTP)
+
+	if err != nil {
+		return err
+	}
+
+	res, err := HTTP.Request(ctx, "GET").SetURL(u, nil).Send()
+
+	if err != nil {
+		return err
+	}
+
+	if res.Code() != 200 {
+		return errors.Errorf(ERRNO_INTERNAL_SERVER, "OIDC request %s failed with status %d", u, res.Code())
+	}
+
+	return unmarshalObject(res.Body(), object)
+}
+
+/**
+* 获取 {issuer}/.well-known/openid-configuration, 缓存 CacheExpires 秒
+**/
+func (s *Server) getOidcDiscovery(ctx micro.Context) (*oidcDiscovery, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if config.OidcIssuer == "" {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "OIDC login is not enabled")
+	}
+
+	redis, err := redis.GetRedis(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		return nil, err
+	}
+
+	d := &oidcDiscovery{}
+
+	key_od := fmt.Sprintf("%sod", config.Prefix)
+
+	{
+		text, err := redis.Get(key_od)
+		if err == nil && text != "" {
+			err = unmarshalObject([]byte(text), d)
+			if err == nil {
+				return d, nil
+			}
+		}
+	}
+
+	err = s.oidcGet(ctx, strings.TrimSuffix(config.OidcIssuer, "/")+"/.well-known/openid-configuration", d)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Issuer != config.OidcIssuer || d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JwksUri == "" {
+		return nil, errors.Errorf(ERRNO_INTERNAL_SERVER, "Invalid OIDC discovery document")
+	}
+
+	b, _ := json.Marshal(d)
+
+	redis.Set(key_od, string(b), time.Duration(config.CacheExpires)*time.Second)
+
+	return d, nil
+}
+
+/**
+* 获取身份提供方的 JWKS, 缓存 CacheExpires 秒, refresh 为 true 时不使用缓存
+**/
+func (s *Server) getOidcJwks(ctx micro.Context, d *oidcDiscovery, refresh bool) (*JWKS, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	redis, err := redis.GetRedis(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys := &JWKS{}
+
+	key_oj := fmt.Sprintf("%soj", config.Prefix)
+
+	if !refresh {
+		text, err := redis.Get(key_oj)
+		if err == nil && text != "" {
+			err = unmarshalObject([]byte(text), keys)
+			if err == nil {
+				return keys, nil
+			}
+		}
+	}
+
+	err = s.oidcGet(ctx, d.JwksUri, keys)
+
+	if err != nil {
+		return nil, err
+	}
+
+	b, _ := json.Marshal(keys)
+
+	redis.Set(key_oj, string(b), time.Duration(config.CacheExpires)*time.Second)
+
+	return keys, nil
+}
+
+/**
+* 校验 ID Token 的签名和 iss, aud, exp, nonce, 返回 claims
+**/
+func (s *Server) verifyIdToken(ctx micro.Context, d *oidcDiscovery, idToken string, nonce string) (map[string]interface{}, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := s.getOidcJwks(ctx, d, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := verifyJWT(idToken, keys)
+
+	if err != nil {
+
+		// 身份提供方可能轮换了密钥, 重新获取一次
+		keys, err = s.getOidcJwks(ctx, d, true)
+
+		if err != nil {
+			return nil, err
+		}
+
+		claims, err = verifyJWT(idToken, keys)
+	}
+
+	if err != nil {
+		return nil, errors.Errorf(ERRNO_LOGIN, "Invalid id token, %s", err.Error())
+	}
+
+	if dynamic.StringValue(claims["iss"], "") != config.OidcIssuer {
+		return nil, errors.Errorf(ERRNO_LOGIN, "Invalid id token issuer")
+	}
+
+	aud := false
+
+	switch v := claims["aud"].(type) {
+	case string:
+		aud = v == config.OidcClientId
+	case []interface{}:
+		for _, a := range v {
+			if dynamic.StringValue(a, "") == config.OidcClientId {
+				aud = true
+				break
+			}
+		}
+	}
+
+	if !aud {
+		return nil, errors.Errorf(ERRNO_LOGIN, "Invalid id token audience")
+	}
+
+	now := time.Now().Unix()
+
+	if dynamic.IntValue(claims["exp"], 0)+OIDC_CLOCK_SKEW < now {
+		return nil, errors.Errorf(ERRNO_LOGIN, "The id token has expired")
+	}
+
+	if dynamic.IntValue(claims["iat"], 0)-OIDC_CLOCK_SKEW > now {
+		return nil, errors.Errorf(ERRNO_LOGIN, "Invalid id token issued time")
+	}
+
+	if dynamic.StringValue(claims["nonce"], "") != nonce {
+		return nil, errors.Errorf(ERRNO_LOGIN, "Invalid id token nonce")
+	}
+
+	return claims, nil
+}
+
+/**
+* 开始授权码流程, 返回跳转到身份提供方的地址, state 只能在同一个浏览器会话中使用
+**/
+func (s *Server) OidcAuthorize(ctx micro.Context, task *OidcAuthorizeTask) (*OidcAuthorizeResult, error) {
+
+	session := ctx.GetValue("sessionId")
+
+	if session == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The browser session is missing")
+	}
+
+	d, err := s.getOidcDiscovery(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	redis, err := redis.GetRedis(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		return nil, err
+	}
+
+	state := config.NewToken()
+
+	st := &oidcState{Verifier: config.NewToken() + config.NewToken(), Nonce: config.NewToken(), Session: session}
+
+	b, _ := json.Marshal(st)
+
+	err = redis.Set(fmt.Sprintf("%soi_%s", config.Prefix, state), string(b), time.Duration(OIDC_STATE_EXPIRES)*time.Second)
+
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := sha256.Sum256([]byte(st.Verifier))
+
+	q := url.Values{}
+
+	q.Set("response_type", "code")
+	q.Set("client_id", config.OidcClientId)
+	q.Set("redirect_uri", config.OidcRedirectUri)
+	q.Set("scope", config.OidcScope)
+	q.Set("state", state)
+	q.Set("nonce", st.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+
+	u := d.AuthorizationEndpoint
+
+	if strings.Contains(u, "?") {
+		u = u + "&" + q.Encode()
+	} else {
+		u = u + "?" + q.Encode()
+	}
+
+	return &OidcAuthorizeResult{Url: u, State: state}, nil
+}
+
+/**
+* 使用回调中的 code 和 state 换取 ID Token, 以已验证的 email 登录
+**/
+func (s *Server) OidcLogin(ctx micro.Context, task *OidcLoginTask) (*LoginResult, error) {
+
+	if task.Code == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter code is incorrect")
+	}
+
+	if task.State == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter state is incorrect")
+	}
+
+	d, err := s.getOidcDiscovery(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cli, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// 读取并删除 state, 并发回调时只有一个请求能拿到
+	text, err := getDelScript.Run(context.Background(), cli, []string{fmt.Sprintf("%soi_%s", config.Prefix, task.State)}).Text()
+
+	if err != nil && !redis.IsNil(err) {
+		return nil, err
+	}
+
+	if text == "" {
+		return nil, errors.Errorf(ERRNO_LOGIN, "The login state has expired")
+	}
+
+	st := &oidcState{}
+
+	unmarshalObject([]byte(text), st)
+
+	if st.Session == "" || st.Session != ctx.GetValue("sessionId") {
+		return nil, errors.Errorf(ERRNO_LOGIN, "The login state does not belong to this browser session")
+	}
+
+	HTTP, err := http.GetHTTPService(ctx, SERVICE_HTTP)
+
+	if err != nil {
+		return nil, err
+	}
+
+	body := map[string]string{
+		"grant_type":    "authorization_code",
+		"code":          task.Code,
+		"redirect_uri":  config.OidcRedirectUri,
+		"client_id":     config.OidcClientId,
+		"code_verifier": st.Verifier,
+	}
+
+	if config.OidcClientSecret != "" {
+		body["client_secret"] = config.OidcClientSecret
+	}
+
+	res, err := HTTP.Request(ctx, "POST").
+		SetURL(d.TokenEndpoint, nil).
+		SetUrlencodeBody(body).
+		Send()
+
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string]interface{}{}
+
+	unmarshalObject(res.Body(), &data)
+
+	if res.Code() != 200 {
+		return nil, errors.Errorf(ERRNO_LOGIN, "OIDC token request failed, %s", dynamic.StringValue(data["error"], fmt.Sprintf("status %d", res.Code())))
+	}
+
+	idToken := dynamic.StringValue(data["id_token"], "")
+
+	if idToken == "" {
+		return nil, errors.Errorf(ERRNO_LOGIN, "OIDC token response has no id_token")
+	}
+
+	claims, err := s.verifyIdToken(ctx, d, idToken, st.Nonce)
+
+	if err != nil {
+		return nil, err
+	}
+
+	email := normalizeEmail(dynamic.StringValue(claims["email"], ""))
+
+	if !re_email.MatchString(email) {
+		return nil, errors.Errorf(ERRNO_LOGIN, "The id token has no email claim")
+	}
+
+	if !dynamic.BooleanValue(claims["email_verified"], false) {
+		return nil, errors.Errorf(ERRNO_LOGIN, "The email is not verified by the identity provider")
+	}
+
+	u, err := config.Directory().GetUser(ctx, email, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.completeLogin(ctx, u)
+}
@@ -0,0 +1,293 @@
+package srv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ability-sh/abi-lib/json"
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+/**
+* 模拟身份提供方, code 为授权时的 nonce 和 code_challenge
+**/
+type testIdp struct {
+	t      *testing.T
+	ts     *httptest.Server
+	mu     sync.Mutex
+	signer *jwtSigner
+	codes  map[string][2]string
+	jwks   int32
+	email  string
+}
+
+func newTestSigner(t *testing.T, kid string) *jwtSigner {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := newJwtSigner(kid, map[string]string{kid: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}))})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+func newTestIdp(t *testing.T) *testIdp {
+
+	idp := &testIdp{t: t, signer: newTestSigner(t, "k1"), codes: map[string][2]string{}, email: "Alice@Example.com"}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := json.Marshal(&oidcDiscovery{Issuer: idp.ts.URL, AuthorizationEndpoint: idp.ts.URL + "/authorize", TokenEndpoint: idp.ts.URL + "/token", JwksUri: idp.ts.URL + "/jwks"})
+		w.Write(b)
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&idp.jwks, 1)
+		idp.mu.Lock()
+		b, _ := json.Marshal(idp.signer.jwks)
+		idp.mu.Unlock()
+		w.Write(b)
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+
+		r.ParseForm()
+
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+
+		v, ok := idp.codes[r.Form.Get("code")]
+
+		delete(idp.codes, r.Form.Get("code"))
+
+		challenge := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+
+		if !ok || v[1] != base64.RawURLEncoding.EncodeToString(challenge[:]) || r.Form.Get("client_id") != "store" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+
+		now := time.Now().Unix()
+
+		token, err := idp.signer.sign(map[string]interface{}{
+			"iss":            idp.ts.URL,
+			"aud":            "store",
+			"sub":            "alice",
+			"email":          idp.email,
+			"email_verified": true,
+			"nonce":          v[0],
+			"iat":            now,
+			"exp":            now + 300,
+		})
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		b, _ := json.Marshal(map[string]interface{}{"id_token": token, "token_type": "Bearer"})
+
+		w.Write(b)
+	})
+
+	idp.ts = httptest.NewServer(mux)
+
+	t.Cleanup(idp.ts.Close)
+
+	return idp
+}
+
+/**
+* 模拟用户在身份提供方完成授权, 返回回调中的 code
+**/
+func (idp *testIdp) authorize(rs *OidcAuthorizeResult) string {
+
+	u, err := url.Parse(rs.Url)
+
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+
+	q := u.Query()
+
+	if q.Get("state") != rs.State || q.Get("code_challenge_method") != "S256" {
+		idp.t.Fatalf("unexpected authorize url %s", rs.Url)
+	}
+
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	code := fmt.Sprintf("code-%d", len(idp.codes)+1)
+
+	idp.codes[code] = [2]string{q.Get("nonce"), q.Get("code_challenge")}
+
+	return code
+}
+
+func (e *testEnv) session(id string, fn func(ctx micro.Context)) {
+	e.ctx(func(ctx micro.Context) {
+		ctx.SetValue("sessionId", id)
+		fn(ctx)
+	})
+}
+
+func TestOidcLogin(t *testing.T) {
+
+	idp := newTestIdp(t)
+
+	e := newTestEnvWith(t, map[string]interface{}{
+		"oidc-issuer":       idp.ts.URL,
+		"oidc-client-id":    "store",
+		"oidc-redirect-uri": "https://store.example.com/oidc/callback",
+		"oidc-scope":        "openid email",
+	})
+
+	login := func(authorizeSession string, loginSession string) (*LoginResult, error) {
+
+		var rs *OidcAuthorizeResult = nil
+
+		e.session(authorizeSession, func(ctx micro.Context) {
+
+			var err error
+
+			rs, err = e.s.OidcAuthorize(ctx, &OidcAuthorizeTask{})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		code := idp.authorize(rs)
+
+		var r *LoginResult = nil
+		var err error = nil
+
+		e.session(loginSession, func(ctx micro.Context) {
+			r, err = e.s.OidcLogin(ctx, &OidcLoginTask{Code: code, State: rs.State})
+		})
+
+		if err == nil {
+			// state 只能使用一次
+			e.session(loginSession, func(ctx micro.Context) {
+				_, err := e.s.OidcLogin(ctx, &OidcLoginTask{Code: code, State: rs.State})
+				assertErrno(t, err, ERRNO_LOGIN)
+			})
+		}
+
+		return r, err
+	}
+
+	e.ctx(func(ctx micro.Context) {
+		_, err := e.s.OidcAuthorize(ctx, &OidcAuthorizeTask{})
+		assertErrno(t, err, ERRNO_INPUT_DATA)
+	})
+
+	// 其他浏览器会话不能使用 state
+	_, err := login("s1", "s2")
+
+	assertErrno(t, err, ERRNO_LOGIN)
+
+	rs, err := login("s1", "s1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rs.User.Email != "alice@example.com" {
+		t.Fatalf("unexpected user %+v", rs.User)
+	}
+
+	// 验证码登录使用同一个规范化后的邮箱
+	e.ctx(func(ctx micro.Context) {
+
+		_, err := e.s.MailSend(ctx, &SendMailTask{Email: "ALICE@example.com"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		code, err := e.r.Get("test_s_alice@example.com")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := e.s.Login(ctx, &LoginTask{Email: " Alice@Example.COM", Code: code})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.User.Id != rs.User.Id {
+			t.Fatalf("expected the same user, got %s and %s", r.User.Id, rs.User.Id)
+		}
+	})
+
+	_, err = login("s1", "s1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt32(&idp.jwks); n != 1 {
+		t.Fatalf("expected the jwks to be cached, fetched %d times", n)
+	}
+
+	// 身份提供方轮换密钥后重新获取 JWKS
+	idp.mu.Lock()
+	idp.signer = newTestSigner(t, "k2")
+	idp.mu.Unlock()
+
+	_, err = login("s1", "s1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt32(&idp.jwks); n != 2 {
+		t.Fatalf("expected the jwks to be fetched again, fetched %d times", n)
+	}
+
+	idp.mu.Lock()
+	idp.email = "bob@example.com"
+	idp.signer = newTestSigner(t, "k1")
+	idp.mu.Unlock()
+
+	// 签名密钥与缓存中的 kid 相同但公钥不同, 重新获取后校验
+	rs, err = login("s1", "s1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rs.User.Email != "bob@example.com" {
+		t.Fatalf("unexpected user %+v", rs.User)
+	}
+}
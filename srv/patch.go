@@ -0,0 +1,375 @@
+package srv
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-lib/json"
+)
+
+const (
+	PATCH_MERGE = "merge" // RFC 7386 JSON Merge Patch
+	PATCH_JSON  = "json"  // RFC 6902 JSON Patch
+)
+
+func checkPatch(info interface{}, patchType string, patch interface{}) error {
+
+	if patch == nil {
+		if patchType != "" {
+			return errors.Errorf(ERRNO_INPUT_DATA, "The parameter patch is incorrect")
+		}
+		return nil
+	}
+
+	if info != nil {
+		return errors.Errorf(ERRNO_INPUT_DATA, "The parameters info and patch cannot be used together")
+	}
+
+	switch patchType {
+	case PATCH_MERGE:
+		return nil
+	case PATCH_JSON:
+		_, ok := patch.([]interface{})
+		if !ok {
+			return errors.Errorf(ERRNO_INPUT_DATA, "The parameter patch is incorrect")
+		}
+		return nil
+	}
+
+	return errors.Errorf(ERRNO_INPUT_DATA, "The parameter patchType is incorrect")
+}
+
+var re_patch_index, _ = regexp.Compile(`^(0|[1-9][0-9]*)$`)
+
+/**
+* 应用补丁, 返回新的文档, doc 不会被修改
+**/
+func applyPatch(doc interface{}, patchType string, patch interface{}) (interface{}, error) {
+
+	doc, err := cloneValue(doc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	patch, err = cloneValue(patch)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if patchType == PATCH_MERGE {
+		return mergePatch(doc, patch), nil
+	}
+
+	ops, _ := patch.([]interface{})
+
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+
+	for _, op := range ops {
+		doc, err = applyPatchOp(doc, op)
+		if err != nil {
+			return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter patch is incorrect, %s", err.Error())
+		}
+	}
+
+	return doc, nil
+}
+
+func cloneValue(v interface{}) (interface{}, error) {
+
+	if v == nil {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var r interface{} = nil
+
+	err = unmarshalObject(b, &r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func mergePatch(target interface{}, patch interface{}) interface{} {
+
+	p, ok := patch.(map[string]interface{})
+
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+
+	if !ok {
+		t = map[string]interface{}{}
+	}
+
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+		} else {
+			t[key] = mergePatch(t[key], value)
+		}
+	}
+
+	return t
+}
+
+func applyPatchOp(doc interface{}, op interface{}) (interface{}, error) {
+
+	o, ok := op.(map[string]interface{})
+
+	if !ok {
+		return nil, fmt.Errorf("invalid op")
+	}
+
+	name, _ := o["op"].(string)
+
+	switch name {
+	case "add":
+		return patchAdd(doc, o["path"], o["value"], false)
+	case "remove":
+		return patchRemove(doc, o["path"])
+	case "replace":
+		return patchAdd(doc, o["path"], o["value"], true)
+	case "move":
+		v, err := patchGet(doc, o["from"])
+		if err != nil {
+			return nil, err
+		}
+		doc, err = patchRemove(doc, o["from"])
+		if err != nil {
+			return nil, err
+		}
+		return patchAdd(doc, o["path"], v, false)
+	case "copy":
+		v, err := patchGet(doc, o["from"])
+		if err != nil {
+			return nil, err
+		}
+		v, err = cloneValue(v)
+		if err != nil {
+			return nil, err
+		}
+		return patchAdd(doc, o["path"], v, false)
+	case "test":
+		v, err := patchGet(doc, o["path"])
+		if err != nil {
+			return nil, err
+		}
+		a, _ := json.Marshal(v)
+		b, _ := json.Marshal(o["value"])
+		if string(a) != string(b) {
+			return nil, fmt.Errorf("test failed %v", o["path"])
+		}
+		return doc, nil
+	}
+
+	return nil, fmt.Errorf("invalid op %s", name)
+}
+
+/**
+* 解析 JSON Pointer, ~1 为 /, ~0 为 ~
+**/
+func parsePatchPath(path interface{}) ([]string, error) {
+
+	p, ok := path.(string)
+
+	if !ok || (p != "" && !strings.HasPrefix(p, "/")) {
+		return nil, fmt.Errorf("invalid path %v", path)
+	}
+
+	if p == "" {
+		return []string{}, nil
+	}
+
+	keys := strings.Split(p[1:], "/")
+
+	for i, key := range keys {
+		keys[i] = strings.ReplaceAll(strings.ReplaceAll(key, "~1", "/"), "~0", "~")
+	}
+
+	return keys, nil
+}
+
+func patchIndex(array []interface{}, key string, add bool) (int, error) {
+
+	if add && key == "-" {
+		return len(array), nil
+	}
+
+	if !re_patch_index.MatchString(key) {
+		return 0, fmt.Errorf("invalid array index %s", key)
+	}
+
+	i, err := strconv.Atoi(key)
+
+	if err != nil || i > len(array) || (!add && i == len(array)) {
+		return 0, fmt.Errorf("array index out of bounds %s", key)
+	}
+
+	return i, nil
+}
+
+/**
+* 找到 keys 的父节点后调用 fn, fn 返回新的父节点, 数组插入和删除时父节点会改变
+**/
+func patchParent(doc interface{}, keys []string, path string, fn func(p interface{}, key string) (interface{}, error)) (interface{}, error) {
+
+	if len(keys) == 1 {
+		switch doc.(type) {
+		case map[string]interface{}, []interface{}:
+			return fn(doc, keys[0])
+		}
+		return nil, fmt.Errorf("path not found %s", path)
+	}
+
+	switch v := doc.(type) {
+	case []interface{}:
+		i, err := patchIndex(v, keys[0], false)
+		if err != nil {
+			return nil, err
+		}
+		r, err := patchParent(v[i], keys[1:], path, fn)
+		if err != nil {
+			return nil, err
+		}
+		v[i] = r
+		return v, nil
+	case map[string]interface{}:
+		c, ok := v[keys[0]]
+		if !ok {
+			return nil, fmt.Errorf("path not found %s", path)
+		}
+		r, err := patchParent(c, keys[1:], path, fn)
+		if err != nil {
+			return nil, err
+		}
+		v[keys[0]] = r
+		return v, nil
+	}
+
+	return nil, fmt.Errorf("path not found %s", path)
+}
+
+func patchGet(doc interface{}, path interface{}) (interface{}, error) {
+
+	keys, err := parsePatchPath(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return doc, nil
+	}
+
+	var rs interface{} = nil
+
+	_, err = patchParent(doc, keys, path.(string), func(p interface{}, key string) (interface{}, error) {
+		switch v := p.(type) {
+		case []interface{}:
+			i, err := patchIndex(v, key, false)
+			if err != nil {
+				return nil, err
+			}
+			rs = v[i]
+		case map[string]interface{}:
+			r, ok := v[key]
+			if !ok {
+				return nil, fmt.Errorf("path not found %s", path)
+			}
+			rs = r
+		}
+		return p, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+func patchRemove(doc interface{}, path interface{}) (interface{}, error) {
+
+	keys, err := parsePatchPath(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("cannot remove root")
+	}
+
+	return patchParent(doc, keys, path.(string), func(p interface{}, key string) (interface{}, error) {
+		switch v := p.(type) {
+		case []interface{}:
+			i, err := patchIndex(v, key, false)
+			if err != nil {
+				return nil, err
+			}
+			return append(v[:i], v[i+1:]...), nil
+		case map[string]interface{}:
+			_, ok := v[key]
+			if !ok {
+				return nil, fmt.Errorf("path not found %s", path)
+			}
+			delete(v, key)
+		}
+		return p, nil
+	})
+}
+
+func patchAdd(doc interface{}, path interface{}, value interface{}, replace bool) (interface{}, error) {
+
+	keys, err := parsePatchPath(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return value, nil
+	}
+
+	return patchParent(doc, keys, path.(string), func(p interface{}, key string) (interface{}, error) {
+		switch v := p.(type) {
+		case []interface{}:
+			i, err := patchIndex(v, key, !replace)
+			if err != nil {
+				return nil, err
+			}
+			if replace {
+				v[i] = value
+				return v, nil
+			}
+			v = append(v, nil)
+			copy(v[i+1:], v[i:])
+			v[i] = value
+			return v, nil
+		case map[string]interface{}:
+			_, ok := v[key]
+			if replace && !ok {
+				return nil, fmt.Errorf("path not found %s", path)
+			}
+			v[key] = value
+		}
+		return p, nil
+	})
+}
@@ -0,0 +1,238 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ability-sh/abi-lib/dynamic"
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-micro/micro"
+	"github.com/ability-sh/abi-micro/redis"
+	R "github.com/go-redis/redis/v8"
+)
+
+const (
+	RATE_LIMIT_IP        = "ip"
+	RATE_LIMIT_UID       = "uid"
+	RATE_LIMIT_CONTAINER = "container"
+	RATE_LIMIT_ALL       = "*"
+)
+
+/**
+* 令牌桶, 容量 Burst, 每 Period 秒补充 Burst 个
+**/
+type rateLimit struct {
+	Key    string
+	Burst  int64
+	Period int64
+}
+
+/**
+* 令牌桶保存在 hash 中, t 为剩余令牌, ts 为上次更新时间(毫秒)
+* 返回 0 表示通过, 否则为需要等待的毫秒数
+**/
+var rateLimitScript = R.NewScript(`
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local b = redis.call('HMGET', KEYS[1], 't', 'ts')
+local tokens = tonumber(b[1]) or burst
+local ts = tonumber(b[2]) or now
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) * rate)
+end
+if tokens < 1 then
+	return math.ceil((1 - tokens) / rate)
+end
+redis.call('HSET', KEYS[1], 't', tostring(tokens - 1), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate))
+return 0
+`)
+
+/**
+* 与 driver.NewReflectExecutor 相同的方法名转换, MailSend => mail/send.json
+**/
+func routeName(name string) string {
+	b := bytes.NewBuffer(nil)
+	for i, r := range name {
+		if r >= 'A' && r <= 'Z' {
+			if i != 0 {
+				b.WriteRune('/')
+			}
+			b.WriteRune(r + 32)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	b.WriteString(".json")
+	return b.String()
+}
+
+/**
+* 解析 {方法名: "ip:10/60,uid:100/60"}, 返回 {路由: []*rateLimit}
+**/
+func parseRateLimits(config map[string]string) (map[string][]*rateLimit, error) {
+
+	rs := map[string][]*rateLimit{}
+
+	for name, text := range config {
+
+		route := name
+
+		if name != RATE_LIMIT_ALL {
+			route = routeName(name)
+		}
+
+		limits := []*rateLimit{}
+
+		for _, item := range strings.Split(text, ",") {
+
+			item = strings.TrimSpace(item)
+
+			if item == "" {
+				continue
+			}
+
+			l := &rateLimit{}
+
+			i := strings.Index(item, ":")
+			j := strings.Index(item, "/")
+
+			if i > 0 && j > i {
+				l.Key = item[0:i]
+				l.Burst, _ = strconv.ParseInt(item[i+1:j], 10, 64)
+				l.Period, _ = strconv.ParseInt(item[j+1:], 10, 64)
+			}
+
+			switch l.Key {
+			case RATE_LIMIT_IP, RATE_LIMIT_UID, RATE_LIMIT_CONTAINER:
+			default:
+				return nil, fmt.Errorf("rate-limits %s: invalid key in %s", name, item)
+			}
+
+			if l.Burst <= 0 || l.Period <= 0 {
+				return nil, fmt.Errorf("rate-limits %s: invalid rate in %s", name, item)
+			}
+
+			limits = append(limits, l)
+		}
+
+		rs[route] = limits
+	}
+
+	return rs, nil
+}
+
+/**
+* 与 driver.Executor 相同
+**/
+type Executor interface {
+	Exec(ctx micro.Context, name string, data interface{}) (interface{}, error)
+}
+
+type rateLimitExecutor struct {
+	s        *Server
+	executor Executor
+}
+
+/**
+* 在调用方法前按 rate-limits 限流, 超出时返回 ERRNO_AGAIN
+**/
+func NewRateLimitExecutor(s *Server, executor Executor) Executor {
+	return &rateLimitExecutor{s: s, executor: executor}
+}
+
+func (r *rateLimitExecutor) Exec(ctx micro.Context, name string, data interface{}) (interface{}, error) {
+
+	err := r.s.checkRateLimit(ctx, name, data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return r.executor.Exec(ctx, name, data)
+}
+
+/**
+* 限流的对象, 取不到时返回空, 不限流
+**/
+func (s *Server) rateLimitValue(ctx micro.Context, key string, data interface{}) string {
+	switch key {
+	case RATE_LIMIT_IP:
+		return ctx.GetValue("clientIp")
+	case RATE_LIMIT_UID:
+		token := dynamic.StringValue(dynamic.Get(data, "token"), "")
+		if token == "" {
+			return ""
+		}
+		uid, err := s.getUid(ctx, token)
+		if err != nil {
+			return ""
+		}
+		return uid
+	case RATE_LIMIT_CONTAINER:
+		return dynamic.StringValue(dynamic.Get(data, "id"), "")
+	}
+	return ""
+}
+
+/**
+* Redis 不可用时不限流
+**/
+func (s *Server) checkRateLimit(ctx micro.Context, name string, data interface{}) error {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return err
+	}
+
+	limits, ok := config.limits[name]
+
+	if !ok {
+		limits = config.limits[RATE_LIMIT_ALL]
+	}
+
+	if len(limits) == 0 {
+		return nil
+	}
+
+	cli, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		ctx.Println("ratelimit", err)
+		return nil
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	for _, l := range limits {
+
+		value := s.rateLimitValue(ctx, l.Key, data)
+
+		if value == "" {
+			continue
+		}
+
+		key := fmt.Sprintf("%srl_%s_%s_%s", config.Prefix, name, l.Key, value)
+
+		rate := float64(l.Burst) / float64(l.Period*1000)
+
+		wait, err := rateLimitScript.Run(context.Background(), cli, []string{key}, l.Burst, rate, now).Int64()
+
+		if err != nil {
+			ctx.Println("ratelimit", err)
+			continue
+		}
+
+		if wait > 0 {
+			return errors.Errorf(ERRNO_AGAIN, "The operation is too frequent, retry after %d seconds", (wait+999)/1000)
+		}
+	}
+
+	return nil
+}
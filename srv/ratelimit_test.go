@@ -0,0 +1,102 @@
+package srv
+
+import (
+	"testing"
+
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+type testExecutor struct {
+	calls int
+}
+
+func (e *testExecutor) Exec(ctx micro.Context, name string, data interface{}) (interface{}, error) {
+	e.calls = e.calls + 1
+	return nil, nil
+}
+
+func TestParseRateLimits(t *testing.T) {
+
+	rs, err := parseRateLimits(map[string]string{"MailSend": "ip:10/60, uid:100/3600", "*": "ip:1000/60"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limits := rs["mail/send.json"]
+
+	if len(limits) != 2 || limits[1].Key != RATE_LIMIT_UID || limits[1].Burst != 100 || limits[1].Period != 3600 || len(rs[RATE_LIMIT_ALL]) != 1 {
+		t.Fatalf("unexpected limits %+v", rs)
+	}
+
+	for _, text := range []string{"host:10/60", "ip:0/60", "ip:10", "ip:10/x"} {
+		if _, err := parseRateLimits(map[string]string{"MailSend": text}); err == nil {
+			t.Fatalf("expected an error for %s", text)
+		}
+	}
+}
+
+func TestRateLimitExecutor(t *testing.T) {
+
+	e := newTestEnvWith(t, map[string]interface{}{
+		"rate-limits": map[string]interface{}{"UserGet": "ip:2/60", "*": "uid:1/60"},
+	})
+
+	token := e.login("dev@example.com")
+
+	executor := &testExecutor{}
+
+	r := NewRateLimitExecutor(e.s, executor)
+
+	e.ctx(func(ctx micro.Context) {
+
+		for i := 0; i < 2; i++ {
+			_, err := r.Exec(ctx, routeName("UserGet"), map[string]interface{}{})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, err := r.Exec(ctx, routeName("UserGet"), map[string]interface{}{})
+
+		assertErrno(t, err, ERRNO_AGAIN)
+
+		// 不同的 ip 单独计数
+		ctx.SetValue("clientIp", "127.0.0.2")
+
+		_, err = r.Exec(ctx, routeName("UserGet"), map[string]interface{}{})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 没有单独配置的方法使用 *, 取不到 uid 时不限流
+		for i := 0; i < 3; i++ {
+			_, err = r.Exec(ctx, routeName("AppCreate"), map[string]interface{}{})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, err = r.Exec(ctx, routeName("AppCreate"), map[string]interface{}{"token": token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = r.Exec(ctx, routeName("AppCreate"), map[string]interface{}{"token": token})
+
+		assertErrno(t, err, ERRNO_AGAIN)
+
+		// 每个方法单独计数
+		_, err = r.Exec(ctx, routeName("AppList"), map[string]interface{}{"token": token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if executor.calls != 8 {
+		t.Fatalf("expected 8 calls, got %d", executor.calls)
+	}
+}
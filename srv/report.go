@@ -0,0 +1,152 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-micro/micro"
+	"github.com/ability-sh/abi-micro/redis"
+)
+
+func (s *Server) getContainerStatus(ctx micro.Context, id string) (*ContainerStatus, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	status := &ContainerStatus{}
+
+	text, err := config.Store().Get(ctx, fmt.Sprintf("container/%s/status.json", id))
+
+	if err != nil {
+		if IsErrno(err, ERRNO_NOT_FOUND) {
+			return &ContainerStatus{State: CONTAINER_STATE_UNKNOWN}, nil
+		}
+		return nil, err
+	}
+
+	unmarshalObject(text, status)
+
+	if time.Now().Unix()-status.LastSeen > int64(config.ContainerOfflineExpires) {
+		status.State = CONTAINER_STATE_OFFLINE
+	} else {
+		status.State = CONTAINER_STATE_ONLINE
+	}
+
+	return status, nil
+}
+
+/**
+* 签名中 apps 的规范形式, 按 appid 排序, 每个应用为 appid:ver:ability:health, 用逗号连接
+**/
+func signApps(apps []*ContainerAppStatus) string {
+
+	vs := []string{}
+
+	for _, a := range apps {
+		if a != nil {
+			vs = append(vs, strings.Join([]string{a.Appid, a.Ver, a.Ability, a.Health}, ":"))
+		}
+	}
+
+	sort.Strings(vs)
+
+	return strings.Join(vs, ",")
+}
+
+func (s *Server) ContainerReport(ctx micro.Context, task *ContainerReportTask) (*ContainerStatus, error) {
+
+	if task.Id == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	if task.Timestamp == 0 {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter timestamp is incorrect")
+	}
+
+	if task.Sign == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter sign is incorrect")
+	}
+
+	if task.Nonce == "" || len(task.Nonce) > 64 {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter nonce is incorrect")
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// timestamp 为秒, 超出允许误差的上报视为重放
+	if d := time.Now().Unix() - task.Timestamp; d > int64(config.ContainerReportWindow) || d < -int64(config.ContainerReportWindow) {
+		return nil, errors.Errorf(ERRNO_SIGN, "The parameter timestamp has expired")
+	}
+
+	container, err := s.getContainer(ctx, task.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ss := config.Sign(container.Secret, map[string]interface{}{
+		"id":        task.Id,
+		"timestamp": task.Timestamp,
+		"nonce":     task.Nonce,
+		"ver":       task.Ver,
+		"health":    task.Health,
+		"agentVer":  task.AgentVer,
+		"apps":      signApps(task.Apps),
+	})
+
+	if ss != task.Sign {
+		return nil, errors.Errorf(ERRNO_SIGN, "Signature error")
+	}
+
+	cli, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// nonce 保留到时间窗口结束, 窗口外的上报已经被 timestamp 拒绝
+	ok, err := cli.SetNX(context.Background(), fmt.Sprintf("%scn_%s_%s", config.Prefix, task.Id, task.Nonce), "1", time.Duration(2*config.ContainerReportWindow)*time.Second).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, errors.Errorf(ERRNO_SIGN, "The report has been replayed")
+	}
+
+	status := &ContainerStatus{
+		State:    CONTAINER_STATE_ONLINE,
+		LastSeen: time.Now().Unix(),
+		Ver:      task.Ver,
+		Health:   task.Health,
+		AgentVer: task.AgentVer,
+		Ip:       ctx.GetValue("clientIp"),
+		Apps:     task.Apps,
+	}
+
+	err = config.Store().PutObject(ctx, fmt.Sprintf("container/%s/status.json", task.Id), status)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.touchContainer(ctx, task.Id, status.LastSeen)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
@@ -0,0 +1,99 @@
+package srv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+func TestContainerReport(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	token := e.login("owner@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		c, err := e.s.ContainerCreate(ctx, &ContainerCreateTask{Token: token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sign := func(task *ContainerReportTask) *ContainerReportTask {
+			task.Sign = e.config(ctx).Sign(c.Secret, map[string]interface{}{
+				"id":        task.Id,
+				"timestamp": task.Timestamp,
+				"nonce":     task.Nonce,
+				"ver":       task.Ver,
+				"health":    task.Health,
+				"agentVer":  task.AgentVer,
+				"apps":      signApps(task.Apps),
+			})
+			return task
+		}
+
+		now := time.Now().Unix()
+
+		_, err = e.s.ContainerReport(ctx, sign(&ContainerReportTask{Id: c.Id, Timestamp: now, Ver: c.Ver}))
+
+		assertErrno(t, err, ERRNO_INPUT_DATA)
+
+		// 没有上报应用时 apps 也参与签名
+		task := &ContainerReportTask{Id: c.Id, Timestamp: now, Nonce: "n1", Ver: c.Ver, Health: "ok", AgentVer: "1.0"}
+
+		task.Sign = e.config(ctx).Sign(c.Secret, map[string]interface{}{"id": c.Id, "timestamp": now, "nonce": "n1", "ver": c.Ver, "health": "ok", "agentVer": "1.0"})
+
+		_, err = e.s.ContainerReport(ctx, task)
+
+		assertErrno(t, err, ERRNO_SIGN)
+
+		status, err := e.s.ContainerReport(ctx, sign(task))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if status.State != CONTAINER_STATE_ONLINE || status.Ver != c.Ver || status.Ip != "127.0.0.1" {
+			t.Fatalf("unexpected status %+v", status)
+		}
+
+		// 时间窗口内重复的上报视为重放
+		_, err = e.s.ContainerReport(ctx, task)
+
+		assertErrno(t, err, ERRNO_SIGN)
+
+		apps := []*ContainerAppStatus{{Appid: "a", Ver: "1.0", Ability: "web", Health: "ok"}}
+
+		task = sign(&ContainerReportTask{Id: c.Id, Timestamp: now, Nonce: "n2", Ver: c.Ver, Health: "ok", Apps: apps})
+
+		task.Apps = []*ContainerAppStatus{{Appid: "a", Ver: "1.0", Ability: "web", Health: "down"}}
+
+		_, err = e.s.ContainerReport(ctx, task)
+
+		assertErrno(t, err, ERRNO_SIGN)
+
+		task.Apps = apps
+
+		_, err = e.s.ContainerReport(ctx, task)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.ContainerReport(ctx, sign(&ContainerReportTask{Id: c.Id, Timestamp: now - 3600, Nonce: "n3", Ver: c.Ver}))
+
+		assertErrno(t, err, ERRNO_SIGN)
+
+		rs, err := e.s.ContainerGet(ctx, &ContainerGetTask{Token: token, Id: c.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rs.Status == nil || rs.Status.State != CONTAINER_STATE_ONLINE || len(rs.Status.Apps) != 1 || rs.Status.Apps[0].Health != "ok" {
+			t.Fatalf("unexpected container status %+v", rs.Status)
+		}
+	})
+}
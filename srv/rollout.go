@@ -0,0 +1,494 @@
+package srv
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+const (
+	ROLLOUT_OP_CREATE  = "create"
+	ROLLOUT_OP_ADVANCE = "advance"
+	ROLLOUT_OP_PAUSE   = "pause"
+	ROLLOUT_OP_RESUME  = "resume"
+	ROLLOUT_OP_ABORT   = "abort"
+)
+
+/**
+* 容器分桶 0-99, 同一应用同一容器始终落在同一个桶
+**/
+func rolloutBucket(appid string, cid string) int {
+	h := fnv.New32a()
+	h.Write([]byte(appid + ":" + cid))
+	return int(h.Sum32() % 100)
+}
+
+func (r *Rollout) isActive() bool {
+	return r.State == ROLLOUT_STATE_RUNNING || r.State == ROLLOUT_STATE_PAUSED
+}
+
+/**
+* 容器是否在当前灰度范围内, 标签需匹配选择器且分桶小于当前步骤的百分比
+**/
+func (r *Rollout) isTarget(container *Container) bool {
+
+	if !r.isActive() || r.Step < 0 || r.Step >= len(r.Steps) {
+		return false
+	}
+
+	for key, value := range r.Selector {
+		if container.Labels[key] != value {
+			return false
+		}
+	}
+
+	return rolloutBucket(r.Appid, container.Id) < r.Steps[r.Step]
+}
+
+/**
+* 获取应用的灰度发布, 不存在时返回 nil
+**/
+func (s *Server) getRollout(ctx micro.Context, appid string) (*Rollout, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r := Rollout{}
+
+	err = config.Cache().GetObject(ctx, "rollout", fmt.Sprintf("%sro_%s", config.Prefix, appid), &r, s.loader(ctx, fmt.Sprintf("app/%s/rollout.json", appid)))
+
+	if err != nil {
+		if IsErrno(err, ERRNO_NOT_FOUND) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+/**
+* 容器跟随渠道时应使用的版本, 灰度范围内的容器使用灰度版本
+**/
+func (s *Server) resolveChannelVer(ctx micro.Context, app *App, container *Container) (string, error) {
+
+	r, err := s.getRollout(ctx, app.Id)
+
+	if err != nil {
+		return "", err
+	}
+
+	if r != nil && r.isTarget(container) {
+		return r.Ver, nil
+	}
+
+	return app.Ver, nil
+}
+
+func (s *Server) checkRolloutMember(ctx micro.Context, token string, appid string, write bool) (string, error) {
+
+	if appid == "" {
+		return "", errors.Errorf(ERRNO_INPUT_DATA, "The parameter appid is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, token)
+
+	if err != nil {
+		return "", err
+	}
+
+	member, err := s.getAppMember(ctx, appid, uid)
+
+	if err != nil {
+		return "", err
+	}
+
+	if member.Role != ROLE_OWNER && member.Role != ROLE_READ_WRITE && (write || member.Role != ROLE_READ_ONLY) {
+		return "", errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
+
+	return uid, nil
+}
+
+func (s *objectStore) ApplyRollout(ctx micro.Context, appid string, uid string, op string, rollout *Rollout) (*Rollout, *App, map[string]int, error) {
+
+	var object *Rollout = nil
+	var app *App = nil
+	var completed = false
+	var mtime int64 = 0
+
+	err := s.update(ctx, func(tx *storeTx) error {
+
+		app = &App{}
+
+		err := tx.MustObject(fmt.Sprintf("app/%s/info.json", appid), app, "App that does not exist")
+
+		if err != nil {
+			return err
+		}
+
+		object = &Rollout{}
+
+		ok, err := tx.GetObject(fmt.Sprintf("app/%s/rollout.json", appid), object)
+
+		if err != nil {
+			return err
+		}
+
+		active := ok && (object.State == ROLLOUT_STATE_RUNNING || object.State == ROLLOUT_STATE_PAUSED)
+
+		completed = false
+
+		if op == ROLLOUT_OP_CREATE {
+
+			if active {
+				return errors.Errorf(ERRNO_CONFLICT, "The app already has an active rollout %s", object.Id)
+			}
+
+			_, err = tx.Get(fmt.Sprintf("app/%s/%s/info.json", appid, rollout.Ver))
+
+			if err != nil {
+				if IsErrno(err, ERRNO_NOT_FOUND) {
+					return errors.Errorf(ERRNO_APP_VER, "App version that does not exist")
+				}
+				return err
+			}
+
+			if compareVer(rollout.Ver, app.Ver) <= 0 {
+				return errors.Errorf(ERRNO_CONFLICT, "The version is not newer than the latest version %s", app.Ver)
+			}
+
+			r := *rollout
+
+			object = &r
+			object.BaseVer = app.Ver
+
+		} else if !active {
+			return errors.Errorf(ERRNO_NOT_FOUND, "The app has no active rollout")
+		} else if op == ROLLOUT_OP_ADVANCE {
+
+			if object.State != ROLLOUT_STATE_RUNNING {
+				return errors.Errorf(ERRNO_CONFLICT, "The rollout is %s", object.State)
+			}
+
+			if object.Step+1 < len(object.Steps) {
+				object.Step = object.Step + 1
+			} else {
+				completed = true
+			}
+
+		} else if op == ROLLOUT_OP_PAUSE {
+
+			if object.State != ROLLOUT_STATE_RUNNING {
+				return errors.Errorf(ERRNO_CONFLICT, "The rollout is %s", object.State)
+			}
+
+			object.State = ROLLOUT_STATE_PAUSED
+
+		} else if op == ROLLOUT_OP_RESUME {
+
+			if object.State != ROLLOUT_STATE_PAUSED {
+				return errors.Errorf(ERRNO_CONFLICT, "The rollout is %s", object.State)
+			}
+
+			object.State = ROLLOUT_STATE_RUNNING
+
+		} else if op == ROLLOUT_OP_ABORT {
+			object.State = ROLLOUT_STATE_ABORTED
+		}
+
+		mtime = time.Now().Unix()
+
+		if completed {
+
+			if compareVer(object.Ver, app.Ver) > 0 {
+
+				info := map[string]interface{}{}
+
+				err = tx.MustObject(fmt.Sprintf("app/%s/%s/info.json", appid, object.Ver), &info, "App version that does not exist")
+
+				if err != nil {
+					return err
+				}
+
+				app.Ver = object.Ver
+				app.Abilities = appAbilities(info)
+
+				err = tx.PutObject(fmt.Sprintf("app/%s/info.json", appid), app)
+
+				if err != nil {
+					return err
+				}
+
+			} else {
+				completed = false
+			}
+
+			object.State = ROLLOUT_STATE_COMPLETED
+		}
+
+		object.Mtime = mtime
+
+		return tx.PutObject(fmt.Sprintf("app/%s/rollout.json", appid), object)
+	})
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	containers := map[string]int{}
+
+	if op != ROLLOUT_OP_PAUSE && op != ROLLOUT_OP_RESUME {
+
+		containers, err = s.bumpDeploy(ctx, appid, uid, mtime)
+
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	if !completed {
+		app = nil
+	}
+
+	return object, app, containers, nil
+}
+
+/**
+* 执行灰度操作, 完成时灰度版本比应用最新版本新才设为最新版本, 不会回退, 跟随渠道的容器版本递增
+**/
+func (s *Server) execRollout(ctx micro.Context, appid string, uid string, op string, rollout *Rollout) (*Rollout, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rollout, app, containers, err := config.Store().ApplyRollout(ctx, appid, uid, op, rollout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config.Cache().Del(ctx, fmt.Sprintf("%sro_%s", config.Prefix, appid))
+
+	if app != nil {
+		config.Cache().Del(ctx, fmt.Sprintf("%sa_%s", config.Prefix, appid))
+	}
+
+	for cid, ver := range containers {
+
+		config.Cache().Del(ctx, fmt.Sprintf("%sc_%s", config.Prefix, cid))
+
+		err = s.publishContainerVer(ctx, cid, ver)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if app != nil {
+		s.emitEvent(ctx, WEBHOOK_SCOPE_APP, appid, EVENT_VERSION_PUBLISHED, map[string]interface{}{"appid": appid, "ver": app.Ver, "rollout": rollout.Id, "latest": true})
+		s.notifyMembers(ctx, "app", appid, false, EVENT_VERSION_PUBLISHED, map[string]string{"appid": appid, "ver": app.Ver})
+	}
+
+	if app != nil && app.Visibility == VISIBILITY_PUBLIC {
+
+		err = s.updateCatalog(ctx, app.Id, true)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.indexApp(ctx, app)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rollout, nil
+}
+
+func (s *Server) RolloutCreate(ctx micro.Context, task *RolloutCreateTask) (*Rollout, error) {
+
+	if !re_ver.MatchString(task.Ver) {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter ver is incorrect")
+	}
+
+	if len(task.Steps) == 0 {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter steps is incorrect")
+	}
+
+	for i, step := range task.Steps {
+		if step <= 0 || step > 100 || (i > 0 && step <= task.Steps[i-1]) {
+			return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter steps is incorrect")
+		}
+	}
+
+	uid, err := s.checkRolloutMember(ctx, task.Token, task.Appid, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+
+	rollout := &Rollout{
+		Id:       config.NewID(ctx),
+		Appid:    task.Appid,
+		Ver:      task.Ver,
+		Selector: task.Selector,
+		Steps:    task.Steps,
+		Step:     0,
+		State:    ROLLOUT_STATE_RUNNING,
+		Uid:      uid,
+		Ctime:    now,
+		Mtime:    now,
+	}
+
+	return s.execRollout(ctx, task.Appid, uid, ROLLOUT_OP_CREATE, rollout)
+}
+
+func (s *Server) RolloutGet(ctx micro.Context, task *RolloutTask) (*RolloutGetResult, error) {
+
+	_, err := s.checkRolloutMember(ctx, task.Token, task.Appid, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := s.getRollout(ctx, task.Appid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if r == nil {
+		return nil, errors.Errorf(ERRNO_NOT_FOUND, "The app has no rollout")
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	deploy := map[string]string{}
+
+	text, err := config.Store().Get(ctx, fmt.Sprintf("app/%s/deploy.json", task.Appid))
+
+	if err != nil {
+		if !IsErrno(err, ERRNO_NOT_FOUND) {
+			return nil, err
+		}
+	} else {
+		unmarshalObject(text, &deploy)
+	}
+
+	health := &RolloutHealth{}
+
+	for cid, _ := range deploy {
+
+		container, err := s.getContainer(ctx, cid)
+
+		if err != nil {
+			if IsErrno(err, ERRNO_NOT_FOUND) {
+				continue
+			}
+			return nil, err
+		}
+
+		health.Total = health.Total + 1
+
+		if !r.isTarget(container) {
+			continue
+		}
+
+		health.Targeted = health.Targeted + 1
+
+		status, err := s.getContainerStatus(ctx, cid)
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch status.State {
+		case CONTAINER_STATE_ONLINE:
+			health.Online = health.Online + 1
+		case CONTAINER_STATE_OFFLINE:
+			health.Offline = health.Offline + 1
+		}
+
+		for _, a := range status.Apps {
+			if a.Appid != task.Appid {
+				continue
+			}
+			if a.Ver == r.Ver {
+				health.Updated = health.Updated + 1
+			}
+			if a.Health != "" && a.Health != "ok" {
+				health.Unhealthy = health.Unhealthy + 1
+			}
+		}
+	}
+
+	return &RolloutGetResult{Rollout: r, Health: health}, nil
+}
+
+func (s *Server) RolloutAdvance(ctx micro.Context, task *RolloutTask) (*Rollout, error) {
+
+	uid, err := s.checkRolloutMember(ctx, task.Token, task.Appid, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.execRollout(ctx, task.Appid, uid, ROLLOUT_OP_ADVANCE, nil)
+}
+
+func (s *Server) RolloutPause(ctx micro.Context, task *RolloutTask) (*Rollout, error) {
+
+	uid, err := s.checkRolloutMember(ctx, task.Token, task.Appid, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.execRollout(ctx, task.Appid, uid, ROLLOUT_OP_PAUSE, nil)
+}
+
+func (s *Server) RolloutResume(ctx micro.Context, task *RolloutTask) (*Rollout, error) {
+
+	uid, err := s.checkRolloutMember(ctx, task.Token, task.Appid, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.execRollout(ctx, task.Appid, uid, ROLLOUT_OP_RESUME, nil)
+}
+
+func (s *Server) RolloutAbort(ctx micro.Context, task *RolloutTask) (*Rollout, error) {
+
+	uid, err := s.checkRolloutMember(ctx, task.Token, task.Appid, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.execRollout(ctx, task.Appid, uid, ROLLOUT_OP_ABORT, nil)
+}
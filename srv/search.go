@@ -0,0 +1,364 @@
+package srv
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ability-sh/abi-lib/dynamic"
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+const (
+	SEARCH_SORT_RECENT = "recent"
+)
+
+/**
+* 应用的索引文档
+**/
+type searchDoc struct {
+	Id    string   `json:"id"`
+	Terms []string `json:"terms"`
+	Mtime int64    `json:"mtime"`
+}
+
+/**
+* 分词, 字母数字连续为一个词, 汉字逐字为一个词
+**/
+func searchTokens(text string) []string {
+
+	rs := []string{}
+
+	b := strings.Builder{}
+
+	flush := func() {
+		if b.Len() > 0 {
+			rs = append(rs, b.String())
+			b.Reset()
+		}
+	}
+
+	for _, r := range strings.ToLower(text) {
+		if unicode.Is(unicode.Han, r) {
+			flush()
+			rs = append(rs, string(r))
+		} else if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		} else {
+			flush()
+		}
+	}
+
+	flush()
+
+	return rs
+}
+
+func searchTermKey(kind string, term string) string {
+	return fmt.Sprintf("search/%s/%s.json", kind, url.PathEscape(term))
+}
+
+func searchAppTerms(app *App) []string {
+
+	set := map[string]bool{}
+
+	for _, t := range searchTokens(dynamic.StringValue(dynamic.Get(app.Info, "title"), "")) {
+		set[searchTermKey("w", t)] = true
+	}
+
+	for _, t := range searchTokens(dynamic.StringValue(dynamic.Get(app.Info, "description"), "")) {
+		set[searchTermKey("w", t)] = true
+	}
+
+	dynamic.Each(dynamic.Get(app.Info, "tags"), func(key interface{}, value interface{}) bool {
+		tag := strings.ToLower(strings.TrimSpace(dynamic.StringValue(value, "")))
+		if tag != "" {
+			set[searchTermKey("t", tag)] = true
+			for _, t := range searchTokens(tag) {
+				set[searchTermKey("w", t)] = true
+			}
+		}
+		return true
+	})
+
+	for _, ability := range app.Abilities {
+		set[searchTermKey("a", ability)] = true
+	}
+
+	terms := []string{}
+
+	for key, _ := range set {
+		terms = append(terms, key)
+	}
+
+	sort.Strings(terms)
+
+	return terms
+}
+
+/**
+* 更新应用的搜索索引, 非公开应用从索引中移除
+**/
+func (s *Server) indexApp(ctx micro.Context, app *App) error {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return err
+	}
+
+	terms := []string{}
+
+	if app.Visibility == VISIBILITY_PUBLIC {
+		terms = searchAppTerms(app)
+	}
+
+	return config.Store().IndexSearch(ctx, app.Id, terms, time.Now().UnixMilli())
+}
+
+/**
+* 文档 search/doc/{id}.json 记录应用的词项, 词项的倒排表 {id: mtime} 保存在词项 key 中
+**/
+func (s *objectStore) IndexSearch(ctx micro.Context, id string, terms []string, mtime int64) error {
+	return s.update(ctx, func(tx *storeTx) error {
+
+		k_doc := fmt.Sprintf("search/doc/%s.json", id)
+
+		doc := &searchDoc{}
+
+		_, err := tx.GetObject(k_doc, doc)
+
+		if err != nil {
+			return err
+		}
+
+		set := map[string]bool{}
+
+		for _, term := range terms {
+			set[term] = true
+		}
+
+		for _, term := range doc.Terms {
+
+			if set[term] {
+				continue
+			}
+
+			posting := map[string]int64{}
+
+			ok, err := tx.GetObject(term, &posting)
+
+			if err != nil {
+				return err
+			}
+
+			if ok {
+
+				delete(posting, id)
+
+				err = tx.PutObject(term, posting)
+
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, term := range terms {
+
+			posting := map[string]int64{}
+
+			_, err := tx.GetObject(term, &posting)
+
+			if err != nil {
+				return err
+			}
+
+			posting[id] = mtime
+
+			err = tx.PutObject(term, posting)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(terms) == 0 {
+			if len(doc.Terms) > 0 {
+				tx.Del(k_doc)
+			}
+			return nil
+		}
+
+		return tx.PutObject(k_doc, &searchDoc{Id: id, Terms: terms, Mtime: mtime})
+	})
+}
+
+func (s *Server) getSearchPosting(ctx micro.Context, key string) (map[string]int64, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	posting := map[string]int64{}
+
+	text, err := config.Store().Get(ctx, key)
+
+	if err != nil {
+		if IsErrno(err, ERRNO_NOT_FOUND) {
+			return posting, nil
+		}
+		return nil, err
+	}
+
+	unmarshalObject(text, &posting)
+
+	return posting, nil
+}
+
+func parseSearchCursor(cursor string) (int64, string, error) {
+
+	i := strings.Index(cursor, "_")
+
+	if i < 0 {
+		return 0, "", errors.Errorf(ERRNO_INPUT_DATA, "The parameter cursor is incorrect")
+	}
+
+	mtime, err := strconv.ParseInt(cursor[0:i], 36, 64)
+
+	if err != nil {
+		return 0, "", errors.Errorf(ERRNO_INPUT_DATA, "The parameter cursor is incorrect")
+	}
+
+	return mtime, cursor[i+1:], nil
+}
+
+func (s *Server) AppSearch(ctx micro.Context, task *AppSearchTask) (*AppSearchResult, error) {
+
+	if task.Sort != "" && task.Sort != SEARCH_SORT_RECENT {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter sort is incorrect")
+	}
+
+	keys := []string{}
+
+	for _, t := range searchTokens(task.Q) {
+		keys = append(keys, searchTermKey("w", t))
+	}
+
+	if task.Tag != "" {
+		keys = append(keys, searchTermKey("t", strings.ToLower(strings.TrimSpace(task.Tag))))
+	}
+
+	if task.Ability != "" {
+		keys = append(keys, searchTermKey("a", task.Ability))
+	}
+
+	var hits map[string]int64 = nil
+	var err error = nil
+
+	if len(keys) == 0 {
+
+		hits, err = s.getCatalog(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+	} else {
+
+		for _, key := range keys {
+
+			posting, err := s.getSearchPosting(ctx, key)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if hits == nil {
+				hits = posting
+				continue
+			}
+
+			for id, _ := range hits {
+				if _, ok := posting[id]; !ok {
+					delete(hits, id)
+				}
+			}
+
+			if len(hits) == 0 {
+				break
+			}
+		}
+	}
+
+	ids := []string{}
+
+	for id, _ := range hits {
+		ids = append(ids, id)
+	}
+
+	less := func(mtime_a int64, id_a string, mtime_b int64, id_b string) bool {
+		if mtime_a == mtime_b {
+			return id_a < id_b
+		}
+		return mtime_a > mtime_b
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return less(hits[ids[i]], ids[i], hits[ids[j]], ids[j])
+	})
+
+	i := 0
+
+	if task.Cursor != "" {
+
+		mtime, id, err := parseSearchCursor(task.Cursor)
+
+		if err != nil {
+			return nil, err
+		}
+
+		i = sort.Search(len(ids), func(n int) bool {
+			return less(mtime, id, hits[ids[n]], ids[n])
+		})
+	}
+
+	limit := task.Limit
+
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	rs := &AppSearchResult{Items: []*AppCatalogItem{}}
+
+	for ; i < len(ids) && len(rs.Items) < limit; i++ {
+
+		app, err := s.getApp(ctx, ids[i])
+
+		if err != nil {
+			if IsErrno(err, ERRNO_NOT_FOUND) {
+				continue
+			}
+			return nil, err
+		}
+
+		if app.Visibility != VISIBILITY_PUBLIC {
+			continue
+		}
+
+		rs.Items = append(rs.Items, newAppCatalogItem(app))
+
+		if len(rs.Items) == limit && i+1 < len(ids) {
+			rs.Cursor = fmt.Sprintf("%s_%s", strconv.FormatInt(hits[ids[i]], 36), ids[i])
+		}
+	}
+
+	return rs, nil
+}
@@ -0,0 +1,93 @@
+package srv
+
+import (
+	"testing"
+
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+func TestAppSearch(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	token := e.login("owner@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		ids := []string{}
+
+		for _, info := range []map[string]interface{}{
+			{"title": "Markdown Editor", "tags": []interface{}{"Editor"}},
+			{"title": "Image editor", "description": "编辑图片"},
+			{"title": "Chat"},
+		} {
+			app, err := e.s.AppCreate(ctx, &AppCreateTask{Token: token, Info: info, Visibility: VISIBILITY_PUBLIC})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, app.Id)
+		}
+
+		rs, err := e.s.AppSearch(ctx, &AppSearchTask{Q: "editor", Limit: 1})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(rs.Items) != 1 || rs.Cursor == "" {
+			t.Fatalf("unexpected result %+v", rs)
+		}
+
+		first := rs.Items[0].Id
+
+		rs, err = e.s.AppSearch(ctx, &AppSearchTask{Q: "editor", Limit: 1, Cursor: rs.Cursor})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(rs.Items) != 1 || rs.Items[0].Id == first || rs.Cursor != "" {
+			t.Fatalf("unexpected result %+v", rs)
+		}
+
+		rs, err = e.s.AppSearch(ctx, &AppSearchTask{Tag: "editor"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(rs.Items) != 1 || rs.Items[0].Id != ids[0] {
+			t.Fatalf("unexpected result %+v", rs)
+		}
+
+		rs, err = e.s.AppSearch(ctx, &AppSearchTask{Q: "图片"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(rs.Items) != 1 || rs.Items[0].Id != ids[1] {
+			t.Fatalf("unexpected result %+v", rs)
+		}
+
+		_, err = e.s.AppSet(ctx, &AppSetTask{Token: token, Id: ids[1], Visibility: VISIBILITY_PRIVATE})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rs, err = e.s.AppSearch(ctx, &AppSearchTask{Q: "editor"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(rs.Items) != 1 || rs.Items[0].Id != ids[0] {
+			t.Fatalf("unexpected result %+v", rs)
+		}
+
+		_, err = e.s.AppSearch(ctx, &AppSearchTask{Sort: "popular"})
+
+		assertErrno(t, err, ERRNO_INPUT_DATA)
+	})
+}
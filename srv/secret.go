@@ -0,0 +1,262 @@
+package srv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ability-sh/abi-lib/dynamic"
+	"github.com/ability-sh/abi-lib/errors"
+)
+
+const (
+	SECRET_PREFIX = "enc:v1:"
+	SECRET_MASK   = "******"
+)
+
+func sealAESGCM(key []byte, data []byte) ([]byte, error) {
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+
+	_, err = io.ReadFull(rand.Reader, nonce)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+func openAESGCM(key []byte, data []byte) ([]byte, error) {
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func (s *ConfigService) masterKey() ([]byte, error) {
+
+	if s.SecretKey == "" {
+		return nil, errors.Errorf(ERRNO_INTERNAL_SERVER, "The secret-key is not configured")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(s.SecretKey)
+
+	if err != nil || len(key) != 32 {
+		return nil, errors.Errorf(ERRNO_INTERNAL_SERVER, "The secret-key must be 32 bytes encoded in base64")
+	}
+
+	return key, nil
+}
+
+/**
+* 信封加密, 每个值使用随机数据密钥加密, 数据密钥使用主密钥加密
+**/
+func (s *ConfigService) EncryptSecret(value string) (string, error) {
+
+	key, err := s.masterKey()
+
+	if err != nil {
+		return "", err
+	}
+
+	dek := make([]byte, 32)
+
+	_, err = io.ReadFull(rand.Reader, dek)
+
+	if err != nil {
+		return "", err
+	}
+
+	wrapped, err := sealAESGCM(key, dek)
+
+	if err != nil {
+		return "", err
+	}
+
+	data, err := sealAESGCM(dek, []byte(value))
+
+	if err != nil {
+		return "", err
+	}
+
+	return SECRET_PREFIX + base64.RawStdEncoding.EncodeToString(wrapped) + ":" + base64.RawStdEncoding.EncodeToString(data), nil
+}
+
+func (s *ConfigService) DecryptSecret(value string) (string, error) {
+
+	if !strings.HasPrefix(value, SECRET_PREFIX) {
+		return "", fmt.Errorf("invalid secret value")
+	}
+
+	vs := strings.Split(value[len(SECRET_PREFIX):], ":")
+
+	if len(vs) != 2 {
+		return "", fmt.Errorf("invalid secret value")
+	}
+
+	key, err := s.masterKey()
+
+	if err != nil {
+		return "", err
+	}
+
+	wrapped, err := base64.RawStdEncoding.DecodeString(vs[0])
+
+	if err != nil {
+		return "", err
+	}
+
+	data, err := base64.RawStdEncoding.DecodeString(vs[1])
+
+	if err != nil {
+		return "", err
+	}
+
+	dek, err := openAESGCM(key, wrapped)
+
+	if err != nil {
+		return "", err
+	}
+
+	b, err := openAESGCM(dek, data)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+/**
+* 使用容器密钥重新加密, 容器端以 sha256(secret) 为 AES-256-GCM 密钥解密
+**/
+func encryptForContainer(secret string, value string) (string, error) {
+
+	key := sha256.Sum256([]byte(secret))
+
+	b, err := sealAESGCM(key[:], []byte(value))
+
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+/**
+* 加密待写入的密钥值, null 表示删除
+**/
+func (s *Server) encryptSecrets(config *ConfigService, secrets interface{}) (map[string]interface{}, error) {
+
+	if secrets == nil {
+		return nil, nil
+	}
+
+	rs := map[string]interface{}{}
+
+	var err error = nil
+
+	dynamic.Each(secrets, func(key interface{}, value interface{}) bool {
+
+		skey := dynamic.StringValue(key, "")
+
+		if value == nil {
+			rs[skey] = nil
+			return true
+		}
+
+		rs[skey], err = config.EncryptSecret(dynamic.StringValue(value, ""))
+
+		return err == nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+func (s *Server) decryptSecrets(config *ConfigService, secrets map[string]string) (map[string]string, error) {
+
+	if len(secrets) == 0 {
+		return nil, nil
+	}
+
+	rs := map[string]string{}
+
+	for key, value := range secrets {
+
+		v, err := config.DecryptSecret(value)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rs[key] = v
+	}
+
+	return rs, nil
+}
+
+/**
+* 返回给成员的容器, 密钥值都隐藏, 只有所有者可以看到容器签名密钥
+* 密钥值只在容器签名获取的 ContainerInfoGet 中解密
+**/
+func memberContainer(container *Container, role string) *Container {
+
+	container.Secrets = maskSecrets(container.Secrets)
+
+	if role != ROLE_OWNER {
+		container.Secret = ""
+	}
+
+	return container
+}
+
+func maskSecrets(secrets map[string]string) map[string]string {
+
+	if len(secrets) == 0 {
+		return nil
+	}
+
+	rs := map[string]string{}
+
+	for key, _ := range secrets {
+		rs[key] = SECRET_MASK
+	}
+
+	return rs
+}
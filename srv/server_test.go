@@ -0,0 +1,201 @@
+package srv
+
+import (
+	"fmt"
+	"testing"
+
+	_ "github.com/ability-sh/abi-micro/http"
+	"github.com/ability-sh/abi-micro/micro"
+	_ "github.com/ability-sh/abi-micro/redis"
+	"github.com/ability-sh/abi-micro/runtime"
+	"github.com/alicebob/miniredis/v2"
+)
+
+/**
+* 测试环境, 使用内存存储, 内存发件箱和 miniredis, oss 只用于生成签名地址
+**/
+type testEnv struct {
+	t *testing.T
+	s *Server
+	p micro.Payload
+	r *miniredis.Miniredis
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	return newTestEnvWith(t, nil)
+}
+
+/**
+* options 覆盖默认的服务配置
+**/
+func newTestEnvWith(t *testing.T, options map[string]interface{}) *testEnv {
+
+	r := miniredis.RunT(t)
+
+	service := map[string]interface{}{
+		"type":           SERVICE_CONFIG,
+		"store":          STORE_MEMORY,
+		"prefix":         "test_",
+		"token-mode":     TOKEN_MODE_REDIS,
+		"user-directory": "db",
+		"mail-transport": MAIL_TRANSPORT_MEMORY,
+		"dev":            true,
+		"secret-key":     "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+	}
+
+	for key, value := range options {
+		service[key] = value
+	}
+
+	config := map[string]interface{}{
+		"services": map[string]interface{}{
+			SERVICE_CONFIG: service,
+			SERVICE_REDIS: map[string]interface{}{
+				"type": "redis",
+				"addr": r.Addr(),
+			},
+			SERVICE_HTTP: map[string]interface{}{
+				"type": "http",
+			},
+			SERVICE_OSS: map[string]interface{}{
+				"type":      "oss",
+				"driver":    "aws",
+				"region":    "us-east-1",
+				"bucket":    "test",
+				"accessKey": "test",
+				"secretKey": "test",
+			},
+		},
+	}
+
+	p := runtime.NewPayload()
+
+	err := p.SetConfig(config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(p.Exit)
+
+	return &testEnv{t: t, s: &Server{}, p: p, r: r}
+}
+
+/**
+* 在新的上下文中执行 fn, 与一次请求相同
+**/
+func (e *testEnv) ctx(fn func(ctx micro.Context)) {
+
+	ctx, err := e.p.NewContext("test", micro.NewTrace())
+
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	defer ctx.Recycle()
+
+	ctx.SetValue("clientIp", "127.0.0.1")
+
+	fn(ctx)
+}
+
+/**
+* 通过验证码邮件登录, 返回会话令牌
+**/
+func (e *testEnv) login(email string) string {
+	return e.loginResult(email).Token
+}
+
+/**
+* 通过验证码邮件登录, 启用两步验证时返回票据
+**/
+func (e *testEnv) loginResult(email string) *LoginResult {
+
+	var rs *LoginResult = nil
+
+	e.ctx(func(ctx micro.Context) {
+
+		_, err := e.s.MailSend(ctx, &SendMailTask{Email: email})
+
+		if err != nil {
+			e.t.Fatal(err)
+		}
+
+		code, err := e.r.Get(fmt.Sprintf("test_s_%s", email))
+
+		if err != nil {
+			e.t.Fatal(err)
+		}
+
+		rs, err = e.s.Login(ctx, &LoginTask{Email: email, Code: code})
+
+		if err != nil {
+			e.t.Fatal(err)
+		}
+	})
+
+	return rs
+}
+
+/**
+* 登录并设为管理员, 返回会话令牌
+**/
+func (e *testEnv) loginAdmin(email string) string {
+
+	rs := e.loginResult(email)
+
+	e.ctx(func(ctx micro.Context) {
+		e.config(ctx).Admins = rs.User.Id
+	})
+
+	return rs.Token
+}
+
+func (e *testEnv) config(ctx micro.Context) *ConfigService {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	return config
+}
+
+func assertErrno(t *testing.T, err error, errno int32) {
+	t.Helper()
+	if !IsErrno(err, errno) {
+		t.Fatalf("expected errno %d, got %v", errno, err)
+	}
+}
+
+func TestLogin(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	token := e.login("dev@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		u, err := e.s.UserGet(ctx, &UserGetTask{Token: token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if u.Email != "dev@example.com" || u.Id == "" {
+			t.Fatalf("unexpected user %+v", u)
+		}
+	})
+
+	if e.login("dev@example.com") == token {
+		t.Fatal("expected a new token for the second login")
+	}
+
+	e.ctx(func(ctx micro.Context) {
+
+		_, err := e.s.Login(ctx, &LoginTask{Email: "dev@example.com", Code: "000000"})
+
+		assertErrno(t, err, ERRNO_AGAIN)
+	})
+}
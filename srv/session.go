@@ -0,0 +1,490 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ability-sh/abi-lib/dynamic"
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-micro/micro"
+	"github.com/ability-sh/abi-micro/redis"
+	R "github.com/go-redis/redis/v8"
+)
+
+const (
+	TOKEN_MODE_REDIS = "redis"
+	TOKEN_MODE_JWT   = "jwt"
+
+	TOKEN_TYPE_ACCESS  = "access"
+	TOKEN_TYPE_REFRESH = "refresh"
+
+	VALUE_SESSION_MFA = "abi-app-store-session-mfa"
+)
+
+var getDelScript = R.NewScript(`
+local v = redis.call('GET', KEYS[1])
+if v then
+	redis.call('DEL', KEYS[1])
+end
+return v
+`)
+
+func isJwtToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+/**
+* 会话剩余有效期, 空闲超时 TokenExpires 和最长有效期 TokenMaxAge 取较小值
+**/
+func (s *ConfigService) sessionTTL(ctime int64, now int64) int64 {
+
+	ttl := int64(s.TokenExpires)
+
+	if max := ctime + int64(s.TokenMaxAge) - now; max < ttl {
+		ttl = max
+	}
+
+	return ttl
+}
+
+/**
+* {prefix}t_{token} 保存 uid:ctime:atime:mfa, ctime 为登录时间, atime 为最后一次延长的时间, mfa 为 1 时表示登录时完成了两步验证
+* 旧的令牌只保存 uid
+**/
+type redisSession struct {
+	Uid   string
+	Ctime int64
+	Atime int64
+	Mfa   bool
+}
+
+func parseRedisSession(text string) *redisSession {
+
+	vs := strings.Split(text, ":")
+
+	r := &redisSession{Uid: vs[0]}
+
+	if len(vs) >= 3 {
+		r.Ctime, _ = strconv.ParseInt(vs[1], 10, 64)
+		r.Atime, _ = strconv.ParseInt(vs[2], 10, 64)
+	}
+
+	if len(vs) >= 4 {
+		r.Mfa = vs[3] == "1"
+	}
+
+	return r
+}
+
+func (r *redisSession) String() string {
+
+	mfa := 0
+
+	if r.Mfa {
+		mfa = 1
+	}
+
+	return fmt.Sprintf("%s:%d:%d:%d", r.Uid, r.Ctime, r.Atime, mfa)
+}
+
+func (s *Server) newRedisSession(ctx micro.Context, u *User, ctime int64, mfa bool) (*LoginResult, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+
+	ttl := config.sessionTTL(ctime, now)
+
+	if ttl <= 0 {
+		return nil, errors.Errorf(ERRNO_LOGIN, "Retry after logging in")
+	}
+
+	redis, err := redis.GetRedis(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		return nil, err
+	}
+
+	token := config.NewToken()
+
+	r := &redisSession{Uid: u.Id, Ctime: ctime, Atime: now, Mfa: mfa}
+
+	err = redis.Set(fmt.Sprintf("%st_%s", config.Prefix, token), r.String(), time.Duration(ttl)*time.Second)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoginResult{Token: token, Expires: now + ttl, User: u}, nil
+}
+
+/**
+* 校验会话令牌, 距上次延长超过 TokenSlideWait 时延长有效期, 不超过最长有效期
+**/
+func (s *Server) getSessionUid(ctx micro.Context, token string) (string, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return "", err
+	}
+
+	redis, err := redis.GetRedis(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		return "", err
+	}
+
+	key_t := fmt.Sprintf("%st_%s", config.Prefix, token)
+
+	text, err := redis.Get(key_t)
+
+	if err != nil || text == "" {
+		return "", errors.Errorf(ERRNO_LOGIN, "Retry after logging in")
+	}
+
+	r := parseRedisSession(text)
+
+	if r.Mfa {
+		ctx.SetValue(VALUE_SESSION_MFA, "1")
+	}
+
+	now := time.Now().Unix()
+
+	if r.Ctime == 0 {
+		r.Ctime = now
+	}
+
+	if now-r.Atime < int64(config.TokenSlideWait) {
+		return r.Uid, nil
+	}
+
+	ttl := config.sessionTTL(r.Ctime, now)
+
+	if ttl <= 0 {
+		redis.Del(key_t)
+		return "", errors.Errorf(ERRNO_LOGIN, "Retry after logging in")
+	}
+
+	r.Atime = now
+
+	err = redis.Set(key_t, r.String(), time.Duration(ttl)*time.Second)
+
+	if err != nil {
+		ctx.Println("session", "slide", err)
+	}
+
+	return r.Uid, nil
+}
+
+/**
+* 轮换会话令牌, 旧令牌立即失效, 新令牌保留原登录时间
+**/
+func (s *Server) refreshRedisSession(ctx micro.Context, token string) (*LoginResult, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cli, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// 读取并删除旧令牌, 并发刷新时只有一个请求能拿到
+	text, err := getDelScript.Run(context.Background(), cli, []string{fmt.Sprintf("%st_%s", config.Prefix, token)}).Text()
+
+	if err != nil && !redis.IsNil(err) {
+		return nil, err
+	}
+
+	if text == "" {
+		ctx.Println("session", "refresh", "token reused or expired")
+		return nil, errors.Errorf(ERRNO_LOGIN, "Retry after logging in")
+	}
+
+	r := parseRedisSession(text)
+
+	if r.Ctime == 0 {
+		r.Ctime = time.Now().Unix()
+	}
+
+	u, err := s.getUserById(ctx, r.Uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.newRedisSession(ctx, u, r.Ctime, r.Mfa)
+}
+
+/**
+* 签发访问令牌和刷新令牌, 访问令牌有效期 JwtExpires, 刷新令牌有效期同 Redis 会话
+**/
+func (s *Server) newJwtSession(ctx micro.Context, u *User, authTime int64, mfa bool) (*LoginResult, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+
+	ttl := config.sessionTTL(authTime, now)
+
+	if ttl <= 0 {
+		return nil, errors.Errorf(ERRNO_LOGIN, "Retry after logging in")
+	}
+
+	exp := now + int64(config.JwtExpires)
+
+	if exp > now+ttl {
+		exp = now + ttl
+	}
+
+	token, err := config.signer.sign(map[string]interface{}{
+		"iss":   config.JwtIssuer,
+		"sub":   u.Id,
+		"email": u.Email,
+		"typ":   TOKEN_TYPE_ACCESS,
+		"jti":   config.NewToken(),
+		"iat":   now,
+		"exp":   exp,
+		"mfa":   mfa,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := config.signer.sign(map[string]interface{}{
+		"iss":       config.JwtIssuer,
+		"sub":       u.Id,
+		"email":     u.Email,
+		"typ":       TOKEN_TYPE_REFRESH,
+		"jti":       config.NewToken(),
+		"iat":       now,
+		"auth_time": authTime,
+		"exp":       now + ttl,
+		"mfa":       mfa,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoginResult{Token: token, RefreshToken: refreshToken, Expires: exp, User: u}, nil
+}
+
+/**
+* 校验本服务签发的 JWT, 并检查撤销列表 {prefix}jd_{jti}
+* Redis 不可用时不检查撤销列表, 访问令牌有效期较短
+**/
+func (s *Server) parseJwt(ctx micro.Context, token string, typ string) (map[string]interface{}, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if config.signer == nil {
+		return nil, errors.Errorf(ERRNO_LOGIN, "Retry after logging in")
+	}
+
+	claims, err := verifyJWT(token, config.signer.jwks)
+
+	if err != nil {
+		return nil, errors.Errorf(ERRNO_LOGIN, "Retry after logging in")
+	}
+
+	if dynamic.StringValue(claims["iss"], "") != config.JwtIssuer || dynamic.StringValue(claims["typ"], "") != typ {
+		return nil, errors.Errorf(ERRNO_LOGIN, "Retry after logging in")
+	}
+
+	if dynamic.IntValue(claims["exp"], 0) < time.Now().Unix() {
+		return nil, errors.Errorf(ERRNO_LOGIN, "Retry after logging in")
+	}
+
+	if dynamic.StringValue(claims["sub"], "") == "" {
+		return nil, errors.Errorf(ERRNO_LOGIN, "Retry after logging in")
+	}
+
+	redis, err := redis.GetRedis(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		ctx.Println("jwt", "deny-list", err)
+		return claims, nil
+	}
+
+	v, err := redis.Get(fmt.Sprintf("%sjd_%s", config.Prefix, dynamic.StringValue(claims["jti"], "")))
+
+	if err == nil && v != "" {
+		return nil, errors.Errorf(ERRNO_LOGIN, "Retry after logging in")
+	}
+
+	return claims, nil
+}
+
+/**
+* 撤销 JWT, 加入撤销列表直到令牌过期, 已经在撤销列表中时返回 ERRNO_LOGIN
+**/
+func (s *Server) revokeJwt(ctx micro.Context, claims map[string]interface{}) error {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return err
+	}
+
+	ttl := dynamic.IntValue(claims["exp"], 0) - time.Now().Unix()
+
+	if ttl <= 0 {
+		return nil
+	}
+
+	cli, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		return err
+	}
+
+	ok, err := cli.SetNX(context.Background(), fmt.Sprintf("%sjd_%s", config.Prefix, dynamic.StringValue(claims["jti"], "")), "1", time.Duration(ttl)*time.Second).Result()
+
+	if err != nil {
+		return err
+	}
+
+	// 已经撤销过, 令牌被重复使用
+	if !ok {
+		return errors.Errorf(ERRNO_LOGIN, "Retry after logging in")
+	}
+
+	return nil
+}
+
+/**
+* 使用刷新令牌换取新的令牌, 旧的刷新令牌同时撤销
+* 没有刷新令牌时轮换 Redis 会话令牌
+**/
+func (s *Server) TokenRefresh(ctx micro.Context, task *TokenRefreshTask) (*LoginResult, error) {
+
+	if task.RefreshToken == "" {
+
+		if task.Token == "" || isJwtToken(task.Token) {
+			return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter refreshToken is incorrect")
+		}
+
+		return s.refreshRedisSession(ctx, task.Token)
+	}
+
+	claims, err := s.parseJwt(ctx, task.RefreshToken, TOKEN_TYPE_REFRESH)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.revokeJwt(ctx, claims)
+
+	if err != nil {
+		return nil, err
+	}
+
+	authTime := dynamic.IntValue(claims["auth_time"], 0)
+
+	if authTime == 0 {
+		authTime = dynamic.IntValue(claims["iat"], 0)
+	}
+
+	return s.newJwtSession(ctx, &User{Id: dynamic.StringValue(claims["sub"], ""), Email: dynamic.StringValue(claims["email"], "")}, authTime, dynamic.BooleanValue(claims["mfa"], false))
+}
+
+/**
+* 退出登录, 撤销会话令牌和刷新令牌
+**/
+func (s *Server) Logout(ctx micro.Context, task *LogoutTask) (interface{}, error) {
+
+	if task.Token == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter token is incorrect")
+	}
+
+	if !isJwtToken(task.Token) {
+
+		config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+		if err != nil {
+			return nil, err
+		}
+
+		redis, err := redis.GetRedis(ctx, SERVICE_REDIS)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = redis.Del(fmt.Sprintf("%st_%s", config.Prefix, task.Token))
+
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{}, nil
+	}
+
+	claims, err := s.parseJwt(ctx, task.Token, TOKEN_TYPE_ACCESS)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.revokeJwt(ctx, claims)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if task.RefreshToken != "" {
+
+		rc, err := s.parseJwt(ctx, task.RefreshToken, TOKEN_TYPE_REFRESH)
+
+		if err == nil && rc["sub"] == claims["sub"] {
+
+			err = s.revokeJwt(ctx, rc)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return map[string]interface{}{}, nil
+}
+
+/**
+* 公钥集合, 其它服务可以使用它校验会话令牌
+**/
+func (s *Server) Jwks(ctx micro.Context, task *JwksTask) (*JWKS, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if config.signer == nil {
+		return &JWKS{Keys: []*JWK{}}, nil
+	}
+
+	return config.signer.jwks, nil
+}
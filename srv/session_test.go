@@ -0,0 +1,159 @@
+package srv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+func TestJwtSession(t *testing.T) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := newTestEnvWith(t, map[string]interface{}{
+		"token-mode": TOKEN_MODE_JWT,
+		"jwt-issuer": "test",
+		"jwt-kid":    "k1",
+		"jwt-keys":   map[string]interface{}{"k1": string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}))},
+	})
+
+	rs := e.loginResult("dev@example.com")
+
+	if !isJwtToken(rs.Token) || !isJwtToken(rs.RefreshToken) {
+		t.Fatalf("unexpected login result %+v", rs)
+	}
+
+	e.ctx(func(ctx micro.Context) {
+
+		jwks, err := e.s.Jwks(ctx, &JwksTask{})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != "k1" {
+			t.Fatalf("unexpected jwks %+v", jwks)
+		}
+
+		u, err := e.s.UserGet(ctx, &UserGetTask{Token: rs.Token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if u.Email != "dev@example.com" {
+			t.Fatalf("unexpected user %+v", u)
+		}
+
+		// 访问令牌不能用来刷新
+		_, err = e.s.TokenRefresh(ctx, &TokenRefreshTask{RefreshToken: rs.Token})
+
+		assertErrno(t, err, ERRNO_LOGIN)
+
+		r, err := e.s.TokenRefresh(ctx, &TokenRefreshTask{RefreshToken: rs.RefreshToken})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.Token == rs.Token || r.RefreshToken == rs.RefreshToken || r.User.Id != u.Id {
+			t.Fatalf("unexpected refresh result %+v", r)
+		}
+
+		// 刷新令牌只能使用一次
+		_, err = e.s.TokenRefresh(ctx, &TokenRefreshTask{RefreshToken: rs.RefreshToken})
+
+		assertErrno(t, err, ERRNO_LOGIN)
+
+		_, err = e.s.Logout(ctx, &LogoutTask{Token: r.Token, RefreshToken: r.RefreshToken})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.UserGet(ctx, &UserGetTask{Token: r.Token})
+
+		assertErrno(t, err, ERRNO_LOGIN)
+
+		_, err = e.s.TokenRefresh(ctx, &TokenRefreshTask{RefreshToken: r.RefreshToken})
+
+		assertErrno(t, err, ERRNO_LOGIN)
+
+		// 其它会话不受影响
+		_, err = e.s.UserGet(ctx, &UserGetTask{Token: rs.Token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestSessionRefresh(t *testing.T) {
+
+	e := newTestEnvWith(t, map[string]interface{}{"token-expires": 600, "token-max-age": 300})
+
+	rs := e.loginResult("dev@example.com")
+
+	// 有效期不超过最长有效期
+	if ttl := e.r.TTL("test_t_" + rs.Token); ttl <= 0 || ttl > 300*time.Second {
+		t.Fatalf("unexpected ttl %v", ttl)
+	}
+
+	e.ctx(func(ctx micro.Context) {
+
+		_, err := e.s.TokenRefresh(ctx, &TokenRefreshTask{})
+
+		assertErrno(t, err, ERRNO_INPUT_DATA)
+
+		r, err := e.s.TokenRefresh(ctx, &TokenRefreshTask{Token: rs.Token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.Token == rs.Token || r.User.Email != "dev@example.com" {
+			t.Fatalf("unexpected refresh result %+v", r)
+		}
+
+		// 旧令牌立即失效
+		_, err = e.s.UserGet(ctx, &UserGetTask{Token: rs.Token})
+
+		assertErrno(t, err, ERRNO_LOGIN)
+
+		_, err = e.s.TokenRefresh(ctx, &TokenRefreshTask{Token: rs.Token})
+
+		assertErrno(t, err, ERRNO_LOGIN)
+
+		_, err = e.s.UserGet(ctx, &UserGetTask{Token: r.Token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.Logout(ctx, &LogoutTask{Token: r.Token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.UserGet(ctx, &UserGetTask{Token: r.Token})
+
+		assertErrno(t, err, ERRNO_LOGIN)
+	})
+}
@@ -0,0 +1,884 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	stdjson "encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ability-sh/abi-db/client"
+	"github.com/ability-sh/abi-db/client/service"
+	"github.com/ability-sh/abi-lib/dynamic"
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-lib/json"
+	"github.com/ability-sh/abi-micro/grpc"
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+const (
+	STORE_DB     = "db"
+	STORE_MEMORY = "memory"
+
+	STORE_TX_RETRY = 10
+)
+
+/**
+* 存储, key 都相对于 collection, 不存在时返回 ERRNO_NOT_FOUND
+* 读取后修改的方法都在事务中执行, 读到的数据在写入前被修改时重新执行
+**/
+type Store interface {
+	Get(ctx micro.Context, key string) ([]byte, error)
+	GetObject(ctx micro.Context, key string) (interface{}, error)
+	Put(ctx micro.Context, key string, data []byte) error
+	PutObject(ctx micro.Context, key string, object interface{}) error
+	Del(ctx micro.Context, key string) error
+
+	GetApp(ctx micro.Context, id string) (*App, error)
+	PutApp(ctx micro.Context, app *App) error
+	/**
+	* 读取应用, fn 修改后写入, fn 可能执行多次
+	**/
+	UpdateApp(ctx micro.Context, id string, fn func(app *App) error) (*App, error)
+	/**
+	* 保存应用版本, 比最新版本新且不是预发布时设为最新版本, 返回应用和跟随渠道的容器 {容器ID: 新版本}
+	* 跟随渠道的容器在应用提交后逐个递增版本
+	**/
+	PublishAppVer(ctx micro.Context, id string, ver string, info map[string]interface{}, abilities []string, staged bool, uid string) (*App, map[string]int, error)
+	/**
+	* 执行灰度操作, 完成并设为最新版本时返回应用, 否则应用为 nil
+	**/
+	ApplyRollout(ctx micro.Context, appid string, uid string, op string, rollout *Rollout) (*Rollout, *App, map[string]int, error)
+	/**
+	* 更新公开应用目录 catalog/app.json, listed 为 false 时移除
+	**/
+	SetCatalog(ctx micro.Context, id string, listed bool, mtime int64) error
+	/**
+	* 更新应用的搜索索引, terms 为空时移除
+	**/
+	IndexSearch(ctx micro.Context, id string, terms []string, mtime int64) error
+
+	GetContainer(ctx micro.Context, id string) (*Container, error)
+	PutContainer(ctx micro.Context, container *Container) error
+	/**
+	* 读取容器, fn 修改后版本加一, 修改前的版本保存到历史, fn 可能执行多次
+	**/
+	UpdateContainer(ctx micro.Context, id string, uid string, fn func(container *Container) error) (*Container, error)
+	/**
+	* 设置容器中的应用, 同时更新应用的渠道索引 app/{appid}/deploy.json
+	**/
+	SetContainerApp(ctx micro.Context, id string, entry *ContainerApp, uid string) (*Container, error)
+	/**
+	* 移除容器中的应用, 容器中没有该应用时不修改
+	**/
+	RemoveContainerApp(ctx micro.Context, id string, appid string, uid string) (*Container, error)
+	/**
+	* 设置容器的模版和变量, 同时更新模版的容器索引 template/{id}/containers.json
+	**/
+	SetContainerTemplate(ctx micro.Context, id string, template string, vars map[string]string, uid string) (*Container, error)
+	/**
+	* 设置容器是否要求两步验证, 版本不变
+	**/
+	SetContainerMfa(ctx micro.Context, id string, required bool) (*Container, error)
+	/**
+	* 更新容器标签索引 label/{key}/{value}/{n}.json, 标签为空时移除
+	**/
+	IndexContainerLabels(ctx micro.Context, id string, labels map[string]string) error
+
+	GetTemplate(ctx micro.Context, id string) (*Template, error)
+	PutTemplate(ctx micro.Context, tpl *Template) error
+	/**
+	* 修改模版, 使用该模版的容器版本加一, 返回模版和 {容器ID: 新版本}
+	**/
+	SetTemplate(ctx micro.Context, id string, info interface{}, uid string) (*Template, map[string]int, error)
+
+	/**
+	* 读取机群, fn 修改后写入, fn 可能执行多次
+	**/
+	UpdateFleet(ctx micro.Context, id string, fn func(fleet *Fleet) error) (*Fleet, error)
+
+	/**
+	* kind 为 app, container, template, fleet
+	**/
+	GetMember(ctx micro.Context, kind string, id string, uid string) (*Member, error)
+	/**
+	* 同时更新成员索引 {kind}/{id}/members.json
+	**/
+	PutMember(ctx micro.Context, kind string, id string, member *Member) error
+	/**
+	* 只更新成员索引
+	**/
+	IndexMember(ctx micro.Context, kind string, id string, member *Member) error
+	DelMember(ctx micro.Context, kind string, id string, uid string) error
+	/**
+	* 成员索引, 返回 {uid: role}
+	**/
+	ListMembers(ctx micro.Context, kind string, id string) (map[string]string, error)
+
+	/**
+	* 按邮箱获取内置用户, 不存在且 create 不为 nil 时保存 create
+	**/
+	GetUser(ctx micro.Context, email string, create *User) (*User, error)
+	/**
+	* 删除恢复码 hash, 未启用两步验证或恢复码不存在时返回 false
+	**/
+	UseRecoveryCode(ctx micro.Context, uid string, hash string) (bool, error)
+	AddPasskey(ctx micro.Context, uid string, passkey *Passkey) error
+	/**
+	* 记录通行密钥的签名计数和使用时间, 计数没有增加时返回 ERRNO_LOGIN
+	**/
+	TouchPasskey(ctx micro.Context, uid string, id string, signCount uint32, atime int64) error
+	RemovePasskey(ctx micro.Context, uid string, id string) error
+
+	/**
+	* 同时更新 {scope}/{target}/webhooks.json
+	**/
+	PutWebhook(ctx micro.Context, webhook *Webhook) error
+	DelWebhook(ctx micro.Context, webhook *Webhook) error
+	/**
+	* 保存投递记录, 每个 Webhook 只保留最近 retention 条
+	**/
+	AddWebhookDelivery(ctx micro.Context, delivery *WebhookDelivery, retention int) error
+}
+
+func newStore(config *ConfigService) (Store, error) {
+	switch config.StoreDriver {
+	case STORE_DB:
+		return &objectStore{kv: &dbStore{db: config.Db, collection: config.Collection}, retention: config.ContainerHistoryRetention}, nil
+	case STORE_MEMORY:
+		return &objectStore{kv: newMemoryStore(), retention: config.ContainerHistoryRetention}, nil
+	}
+	return nil, fmt.Errorf("not support store %s", config.StoreDriver)
+}
+
+/**
+* 内存存储, 用于测试, 保留 20 个容器历史版本
+**/
+func NewMemoryStore() Store {
+	return &objectStore{kv: newMemoryStore(), retention: 20}
+}
+
+/**
+* 底层的 key/value 存储
+* Commit 在 reads 中的值都没有变化时写入 writes, 否则返回 false, 值为 nil 表示不存在或删除
+**/
+type kvStore interface {
+	Get(ctx micro.Context, key string) ([]byte, error)
+	Put(ctx micro.Context, key string, data []byte) error
+	Del(ctx micro.Context, key string) error
+	Commit(ctx micro.Context, reads map[string][]byte, writes map[string][]byte) (bool, error)
+}
+
+/**
+* 事务, 记录读到的值和要写入的值, 提交前不会写入
+**/
+type storeTx struct {
+	ctx    micro.Context
+	kv     kvStore
+	reads  map[string][]byte
+	writes map[string][]byte
+}
+
+func (t *storeTx) Get(key string) ([]byte, error) {
+
+	b, ok := t.writes[key]
+
+	if !ok {
+		b, ok = t.reads[key]
+	}
+
+	if ok {
+		if b == nil {
+			return nil, errors.Errorf(ERRNO_NOT_FOUND, "no such key")
+		}
+		return b, nil
+	}
+
+	b, err := t.kv.Get(t.ctx, key)
+
+	if err != nil {
+		if IsErrno(err, ERRNO_NOT_FOUND) {
+			t.reads[key] = nil
+		}
+		return nil, err
+	}
+
+	t.reads[key] = b
+
+	return b, nil
+}
+
+/**
+* 解析 JSON 到 object, abi-lib/json 解析 []string 等基本类型切片时会 panic
+* abi-lib/json 把超出 int32 的整数写成字符串, 先按 object 的类型转换后再解析
+**/
+func unmarshalObject(data []byte, object interface{}) error {
+
+	dec := stdjson.NewDecoder(bytes.NewReader(data))
+
+	dec.UseNumber()
+
+	var v interface{} = nil
+
+	err := dec.Decode(&v)
+
+	if err != nil {
+		return err
+	}
+
+	b, err := stdjson.Marshal(normalizeValue(reflect.TypeOf(object), v))
+
+	if err != nil {
+		return err
+	}
+
+	dec = stdjson.NewDecoder(bytes.NewReader(b))
+
+	dec.UseNumber()
+
+	return dec.Decode(object)
+}
+
+/**
+* 按类型 t 转换 v 中的值, 与 abi-lib/dynamic 相同, 数字可以是字符串
+**/
+func normalizeValue(t reflect.Type, v interface{}) interface{} {
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if _, ok := v.(string); ok {
+			return dynamic.IntValue(v, 0)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if _, ok := v.(string); ok {
+			return dynamic.UintValue(v, 0)
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, ok := v.(string); ok {
+			return dynamic.FloatValue(v, 0)
+		}
+	case reflect.Bool:
+		if _, ok := v.(string); ok {
+			return dynamic.BooleanValue(v, false)
+		}
+	case reflect.String:
+		switch v.(type) {
+		case stdjson.Number, bool:
+			return dynamic.StringValue(v, "")
+		}
+	case reflect.Slice:
+		if items, ok := v.([]interface{}); ok {
+			for i, item := range items {
+				items[i] = normalizeValue(t.Elem(), item)
+			}
+		}
+	case reflect.Map:
+		if m, ok := v.(map[string]interface{}); ok {
+			for key, item := range m {
+				m[key] = normalizeValue(t.Elem(), item)
+			}
+		}
+	case reflect.Struct:
+		if m, ok := v.(map[string]interface{}); ok {
+			normalizeFields(t, m)
+		}
+	}
+
+	return v
+}
+
+func normalizeFields(t reflect.Type, m map[string]interface{}) {
+
+	for i := 0; i < t.NumField(); i++ {
+
+		fd := t.Field(i)
+
+		name := strings.Split(fd.Tag.Get("json"), ",")[0]
+
+		if name == "-" {
+			continue
+		}
+
+		if name == "" && fd.Anonymous && fd.Type.Kind() == reflect.Struct {
+			normalizeFields(fd.Type, m)
+			continue
+		}
+
+		if name == "" {
+			name = fd.Name
+		}
+
+		if item, ok := m[name]; ok {
+			m[name] = normalizeValue(fd.Type, item)
+		}
+	}
+}
+
+/**
+* 读取对象, 不存在时返回 false
+**/
+func (t *storeTx) GetObject(key string, object interface{}) (bool, error) {
+
+	b, err := t.Get(key)
+
+	if err != nil {
+		if IsErrno(err, ERRNO_NOT_FOUND) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, unmarshalObject(b, object)
+}
+
+/**
+* 读取对象, 不存在时返回 ERRNO_NOT_FOUND 和 errmsg
+**/
+func (t *storeTx) MustObject(key string, object interface{}, errmsg string) error {
+
+	ok, err := t.GetObject(key, object)
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errors.Errorf(ERRNO_NOT_FOUND, "%s", errmsg)
+	}
+
+	return nil
+}
+
+func (t *storeTx) PutObject(key string, object interface{}) error {
+
+	b, err := json.Marshal(object)
+
+	if err != nil {
+		return err
+	}
+
+	t.writes[key] = b
+
+	return nil
+}
+
+func (t *storeTx) Del(key string) {
+	t.writes[key] = nil
+}
+
+/**
+* 在 kvStore 上实现对象的读写, retention 为保留的容器历史版本数
+**/
+type objectStore struct {
+	kv        kvStore
+	retention int
+}
+
+/**
+* 执行事务, 读到的值在提交前被修改时重新执行 fn, 多次冲突后返回 ERRNO_CONFLICT
+**/
+func (s *objectStore) update(ctx micro.Context, fn func(tx *storeTx) error) error {
+
+	for i := 0; i < STORE_TX_RETRY; i++ {
+
+		tx := &storeTx{ctx: ctx, kv: s.kv, reads: map[string][]byte{}, writes: map[string][]byte{}}
+
+		err := fn(tx)
+
+		if err != nil {
+			return err
+		}
+
+		if len(tx.writes) == 0 {
+			return nil
+		}
+
+		ok, err := s.kv.Commit(ctx, tx.reads, tx.writes)
+
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			return nil
+		}
+	}
+
+	return errors.Errorf(ERRNO_CONFLICT, "Too many concurrent modifications, please try again")
+}
+
+func (s *objectStore) Get(ctx micro.Context, key string) ([]byte, error) {
+	return s.kv.Get(ctx, key)
+}
+
+func (s *objectStore) GetObject(ctx micro.Context, key string) (interface{}, error) {
+
+	b, err := s.kv.Get(ctx, key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var object interface{} = nil
+
+	err = unmarshalObject(b, &object)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return object, nil
+}
+
+func (s *objectStore) Put(ctx micro.Context, key string, data []byte) error {
+	return s.kv.Put(ctx, key, data)
+}
+
+func (s *objectStore) PutObject(ctx micro.Context, key string, object interface{}) error {
+
+	b, err := json.Marshal(object)
+
+	if err != nil {
+		return err
+	}
+
+	return s.kv.Put(ctx, key, b)
+}
+
+func (s *objectStore) Del(ctx micro.Context, key string) error {
+	return s.kv.Del(ctx, key)
+}
+
+func (s *objectStore) getObject(ctx micro.Context, key string, object interface{}) error {
+
+	b, err := s.kv.Get(ctx, key)
+
+	if err != nil {
+		return err
+	}
+
+	return unmarshalObject(b, object)
+}
+
+func (s *objectStore) GetApp(ctx micro.Context, id string) (*App, error) {
+
+	app := &App{}
+
+	err := s.getObject(ctx, fmt.Sprintf("app/%s/info.json", id), app)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return app, nil
+}
+
+func (s *objectStore) PutApp(ctx micro.Context, app *App) error {
+	return s.PutObject(ctx, fmt.Sprintf("app/%s/info.json", app.Id), app)
+}
+
+func (s *objectStore) UpdateApp(ctx micro.Context, id string, fn func(app *App) error) (*App, error) {
+
+	var app *App = nil
+
+	err := s.update(ctx, func(tx *storeTx) error {
+
+		app = &App{}
+
+		err := tx.MustObject(fmt.Sprintf("app/%s/info.json", id), app, "App that does not exist")
+
+		if err != nil {
+			return err
+		}
+
+		err = fn(app)
+
+		if err != nil {
+			return err
+		}
+
+		return tx.PutObject(fmt.Sprintf("app/%s/info.json", id), app)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return app, nil
+}
+
+func (s *objectStore) GetContainer(ctx micro.Context, id string) (*Container, error) {
+
+	container := &Container{}
+
+	err := s.getObject(ctx, fmt.Sprintf("container/%s/meta.json", id), container)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return container, nil
+}
+
+func (s *objectStore) PutContainer(ctx micro.Context, container *Container) error {
+	return s.PutObject(ctx, fmt.Sprintf("container/%s/meta.json", container.Id), container)
+}
+
+/**
+* 在事务中修改容器, 修改前的版本保存到历史, 版本加一
+**/
+func (s *objectStore) updateContainer(tx *storeTx, id string, uid string, mtime int64, fn func(container *Container) error) (*Container, error) {
+
+	container := &Container{}
+
+	err := tx.MustObject(fmt.Sprintf("container/%s/meta.json", id), container, "Container that does not exist")
+
+	if err != nil {
+		return nil, err
+	}
+
+	h := &ContainerHistory{Ver: container.Ver, Info: container.Info, Uid: uid, Mtime: mtime}
+
+	err = fn(container)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.pushHistory(tx, id, h)
+
+	if err != nil {
+		return nil, err
+	}
+
+	container.Ver = h.Ver + 1
+
+	err = tx.PutObject(fmt.Sprintf("container/%s/meta.json", id), container)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return container, nil
+}
+
+func (s *objectStore) UpdateContainer(ctx micro.Context, id string, uid string, fn func(container *Container) error) (*Container, error) {
+
+	var container *Container = nil
+
+	err := s.update(ctx, func(tx *storeTx) error {
+
+		c, err := s.updateContainer(tx, id, uid, time.Now().Unix(), fn)
+
+		container = c
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return container, nil
+}
+
+func (s *objectStore) GetTemplate(ctx micro.Context, id string) (*Template, error) {
+
+	tpl := &Template{}
+
+	err := s.getObject(ctx, fmt.Sprintf("template/%s/meta.json", id), tpl)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return tpl, nil
+}
+
+func (s *objectStore) PutTemplate(ctx micro.Context, tpl *Template) error {
+	return s.PutObject(ctx, fmt.Sprintf("template/%s/meta.json", tpl.Id), tpl)
+}
+
+/**
+* 容器成员保存在 container/{id}/{uid}, 其它在 {kind}/{id}/member/{uid}
+**/
+func memberKey(kind string, id string, uid string) string {
+	if kind == "container" {
+		return fmt.Sprintf("container/%s/%s", id, uid)
+	}
+	return fmt.Sprintf("%s/%s/member/%s", kind, id, uid)
+}
+
+func (s *objectStore) GetMember(ctx micro.Context, kind string, id string, uid string) (*Member, error) {
+
+	member := &Member{}
+
+	err := s.getObject(ctx, memberKey(kind, id, uid), member)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return member, nil
+}
+
+/**
+* 在事务中修改成员索引, role 为空时移除
+**/
+func indexMember(tx *storeTx, kind string, id string, uid string, role string) error {
+
+	key := fmt.Sprintf("%s/%s/members.json", kind, id)
+
+	members := map[string]string{}
+
+	ok, err := tx.GetObject(key, &members)
+
+	if err != nil {
+		return err
+	}
+
+	if ok && members[uid] == role {
+		return nil
+	}
+
+	if role == "" {
+		delete(members, uid)
+	} else {
+		members[uid] = role
+	}
+
+	return tx.PutObject(key, members)
+}
+
+func (s *objectStore) PutMember(ctx micro.Context, kind string, id string, member *Member) error {
+	return s.update(ctx, func(tx *storeTx) error {
+
+		err := tx.PutObject(memberKey(kind, id, member.Id), member)
+
+		if err != nil {
+			return err
+		}
+
+		return indexMember(tx, kind, id, member.Id, member.Role)
+	})
+}
+
+func (s *objectStore) IndexMember(ctx micro.Context, kind string, id string, member *Member) error {
+	return s.update(ctx, func(tx *storeTx) error {
+		return indexMember(tx, kind, id, member.Id, member.Role)
+	})
+}
+
+func (s *objectStore) DelMember(ctx micro.Context, kind string, id string, uid string) error {
+	return s.update(ctx, func(tx *storeTx) error {
+
+		tx.Del(memberKey(kind, id, uid))
+
+		return indexMember(tx, kind, id, uid, "")
+	})
+}
+
+func (s *objectStore) ListMembers(ctx micro.Context, kind string, id string) (map[string]string, error) {
+
+	rs := map[string]string{}
+
+	err := s.getObject(ctx, fmt.Sprintf("%s/%s/members.json", kind, id), &rs)
+
+	if err != nil {
+		if IsErrno(err, ERRNO_NOT_FOUND) {
+			return rs, nil
+		}
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+/**
+* abi-db 服务, db 为服务名
+**/
+type dbStore struct {
+	db         string
+	collection string
+}
+
+func (s *dbStore) getCollection(ctx micro.Context) (*dbCollection, error) {
+
+	client, err := service.GetClient(ctx, s.db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &dbCollection{cc: grpc.NewGRPCContext(ctx), Collection: client.Collection(s.collection)}, nil
+}
+
+func (s *dbStore) Get(ctx micro.Context, key string) ([]byte, error) {
+
+	c, err := s.getCollection(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Get(c.cc, key)
+}
+
+func (s *dbStore) Put(ctx micro.Context, key string, data []byte) error {
+
+	c, err := s.getCollection(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	return c.Put(c.cc, key, data)
+}
+
+func (s *dbStore) Del(ctx micro.Context, key string) error {
+
+	c, err := s.getCollection(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	return c.Del(c.cc, key)
+}
+
+/**
+* abi-db 中同一个 collection 的脚本依次执行, 脚本中比较读到的值后写入, get 不存在的 key 返回空字符串
+**/
+func (s *dbStore) Commit(ctx micro.Context, reads map[string][]byte, writes map[string][]byte) (bool, error) {
+
+	c, err := s.getCollection(ctx)
+
+	if err != nil {
+		return false, err
+	}
+
+	r := map[string]string{}
+
+	for key, b := range reads {
+		r[key] = string(b)
+	}
+
+	w := map[string]interface{}{}
+
+	for key, b := range writes {
+		if b == nil {
+			w[key] = nil
+		} else {
+			w[key] = string(b)
+		}
+	}
+
+	text, err := c.Exec(c.cc, `
+	(function(){
+		var reads = ${reads};
+		var writes = ${writes};
+		for(var key in reads) {
+			if(get(collection + key) !== reads[key]) {
+				return 'conflict';
+			}
+		}
+		for(var key in writes) {
+			if(writes[key] === null) {
+				del(collection + key);
+			} else {
+				put(collection + key,writes[key]);
+			}
+		}
+		return 'ok';
+	})()
+	`, map[string]interface{}{"reads": r, "writes": w})
+
+	if err != nil {
+		return false, err
+	}
+
+	return text == "ok", nil
+}
+
+/**
+* 内存 key/value, 读写时复制
+**/
+type memoryStore struct {
+	lock sync.Mutex
+	data map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{data: map[string][]byte{}}
+}
+
+func (s *memoryStore) Get(ctx micro.Context, key string) ([]byte, error) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b, ok := s.data[key]
+
+	if !ok {
+		return nil, errors.Errorf(ERRNO_NOT_FOUND, "no such key")
+	}
+
+	return append([]byte{}, b...), nil
+}
+
+func (s *memoryStore) Put(ctx micro.Context, key string, data []byte) error {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.data[key] = append([]byte{}, data...)
+
+	return nil
+}
+
+func (s *memoryStore) Del(ctx micro.Context, key string) error {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.data, key)
+
+	return nil
+}
+
+func (s *memoryStore) Commit(ctx micro.Context, reads map[string][]byte, writes map[string][]byte) (bool, error) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key, b := range reads {
+
+		v, ok := s.data[key]
+
+		if ok != (b != nil) || !bytes.Equal(v, b) {
+			return false, nil
+		}
+	}
+
+	for key, b := range writes {
+		if b == nil {
+			delete(s.data, key)
+		} else {
+			s.data[key] = append([]byte{}, b...)
+		}
+	}
+
+	return true, nil
+}
+
+type dbCollection struct {
+	cc context.Context
+	*client.Collection
+}
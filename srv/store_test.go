@@ -0,0 +1,182 @@
+package srv
+
+import (
+	"testing"
+
+	"github.com/ability-sh/abi-lib/json"
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+func TestUnmarshalObject(t *testing.T) {
+
+	type object struct {
+		Mtime int64       `json:"mtime"`
+		Tags  []string    `json:"tags"`
+		Steps []int       `json:"steps"`
+		Info  interface{} `json:"info"`
+	}
+
+	b, err := json.Marshal(&object{Mtime: 1700000000000, Tags: []string{"a", "b"}, Steps: []int{50, 100}, Info: map[string]interface{}{"n": 1}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := &object{}
+
+	err = unmarshalObject(b, v)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.Mtime != 1700000000000 || len(v.Tags) != 2 || v.Tags[1] != "b" || len(v.Steps) != 2 || v.Steps[1] != 100 {
+		t.Fatalf("unexpected object %+v", v)
+	}
+
+	ids := []string{}
+
+	err = unmarshalObject([]byte(`["x","y"]`), &ids)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ids) != 2 || ids[0] != "x" {
+		t.Fatalf("unexpected ids %v", ids)
+	}
+}
+
+func TestStoreUpdate(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	s := NewMemoryStore().(*objectStore)
+
+	e.ctx(func(ctx micro.Context) {
+
+		n := 0
+
+		err := s.update(ctx, func(tx *storeTx) error {
+
+			n = n + 1
+
+			v := map[string]int{}
+
+			_, err := tx.GetObject("counter.json", &v)
+
+			if err != nil {
+				return err
+			}
+
+			if n == 1 {
+				// 提交前被其他请求修改, 需要重新执行
+				err = s.PutObject(ctx, "counter.json", map[string]int{"n": 10})
+				if err != nil {
+					return err
+				}
+			}
+
+			v["n"] = v["n"] + 1
+
+			return tx.PutObject("counter.json", v)
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v := map[string]int{}
+
+		err = s.getObject(ctx, "counter.json", &v)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != 2 || v["n"] != 11 {
+			t.Fatalf("unexpected n %d, counter %v", n, v)
+		}
+
+		n = 0
+
+		err = s.update(ctx, func(tx *storeTx) error {
+
+			n = n + 1
+
+			_, err := tx.Get("counter.json")
+
+			if err != nil {
+				return err
+			}
+
+			err = s.PutObject(ctx, "counter.json", map[string]int{"n": n})
+
+			if err != nil {
+				return err
+			}
+
+			tx.Del("counter.json")
+
+			return nil
+		})
+
+		assertErrno(t, err, ERRNO_CONFLICT)
+
+		if n != STORE_TX_RETRY {
+			t.Fatalf("expected %d attempts, got %d", STORE_TX_RETRY, n)
+		}
+	})
+}
+
+func TestContainerHistoryRetention(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	s := &objectStore{kv: newMemoryStore(), retention: 2}
+
+	e.ctx(func(ctx micro.Context) {
+
+		err := s.PutContainer(ctx, &Container{Id: "c1", Ver: 1})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 4; i++ {
+			_, err = s.UpdateContainer(ctx, "c1", "u1", func(container *Container) error {
+				container.Info = map[string]interface{}{"i": i}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		c, err := s.GetContainer(ctx, "c1")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.Ver != 5 {
+			t.Fatalf("expected ver 5, got %d", c.Ver)
+		}
+
+		items := []*ContainerHistory{}
+
+		err = s.getObject(ctx, "container/c1/history.json", &items)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(items) != 2 || items[0].Ver != 3 || items[1].Ver != 4 {
+			t.Fatalf("unexpected history %+v", items)
+		}
+
+		_, err = s.Get(ctx, "container/c1/history/2.json")
+
+		assertErrno(t, err, ERRNO_NOT_FOUND)
+	})
+}
@@ -0,0 +1,158 @@
+package srv
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-lib/json"
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+type containerInfoStream struct {
+	s        *Server
+	p        micro.Payload
+	clientIp func(r *http.Request) string
+}
+
+/**
+* 容器配置变更事件流(SSE), 参数与签名同 ContainerInfoGet
+* 建立连接按 ContainerInfoStream 限流, clientIp 返回限流使用的客户端地址
+**/
+func NewContainerInfoStream(s *Server, p micro.Payload, clientIp func(r *http.Request) string) http.Handler {
+	return &containerInfoStream{s: s, p: p, clientIp: clientIp}
+}
+
+func writeStreamEvent(w http.ResponseWriter, event string, data interface{}) {
+	b, _ := json.Marshal(data)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	w.(http.Flusher).Flush()
+}
+
+func writeStreamError(w http.ResponseWriter, err error) {
+	e, ok := err.(*errors.Error)
+	if ok {
+		writeStreamEvent(w, "error", e)
+	} else {
+		writeStreamEvent(w, "error", map[string]interface{}{"errno": ERRNO_INTERNAL_SERVER, "errmsg": err.Error()})
+	}
+}
+
+func (h *containerInfoStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	_, ok := w.(http.Flusher)
+
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	trace := r.Header.Get("Trace")
+
+	if trace == "" {
+		trace = micro.NewTrace()
+	}
+
+	ctx, err := h.p.NewContext(r.URL.Path, trace)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer ctx.Recycle()
+
+	ctx.SetValue("clientIp", h.clientIp(r))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Trace", trace)
+
+	q := r.URL.Query()
+
+	task := &ContainerInfoGetTask{Id: q.Get("id"), Sign: q.Get("sign")}
+	task.Timestamp, _ = strconv.ParseInt(q.Get("timestamp"), 10, 64)
+	task.Ver, _ = strconv.Atoi(q.Get("ver"))
+	task.Encrypt = q.Get("encrypt") == "true"
+
+	err = h.s.checkRateLimit(ctx, routeName("ContainerInfoStream"), map[string]interface{}{"id": task.Id})
+
+	if err != nil {
+		writeStreamError(w, err)
+		return
+	}
+
+	container, err := h.s.getContainer(ctx, task.Id)
+
+	if err != nil {
+		writeStreamError(w, err)
+		return
+	}
+
+	// 签名使用的密钥, 轮换后关闭事件流, 客户端需要使用新密钥重新连接
+	secret := container.Secret
+
+	rs, err := h.s.ContainerInfoGet(ctx, task)
+
+	if err != nil {
+		writeStreamError(w, err)
+		return
+	}
+
+	ver := task.Ver
+
+	if rs.Ver > ver {
+		writeStreamEvent(w, "info", rs)
+		ver = rs.Ver
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		writeStreamError(w, err)
+		return
+	}
+
+	done := r.Context().Done()
+
+	for {
+
+		container, err := h.s.waitContainer(ctx, task.Id, ver, time.Duration(config.ContainerWaitMax)*time.Second, done)
+
+		if err != nil {
+			writeStreamError(w, err)
+			return
+		}
+
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		if container.Secret != secret {
+			writeStreamError(w, errors.Errorf(ERRNO_SIGN, "The container secret has been rotated"))
+			return
+		}
+
+		if container.Ver <= ver {
+			fmt.Fprint(w, ": ping\n\n")
+			w.(http.Flusher).Flush()
+			continue
+		}
+
+		rs, err := h.s.newContainerInfoResult(ctx, container, task.Encrypt)
+
+		if err != nil {
+			writeStreamError(w, err)
+			return
+		}
+
+		writeStreamEvent(w, "info", rs)
+
+		ver = container.Ver
+	}
+}
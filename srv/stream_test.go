@@ -0,0 +1,145 @@
+package srv
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+/**
+* 读取下一个事件, 跳过注释
+**/
+func readStreamEvent(t *testing.T, r *bufio.Reader) (string, string) {
+
+	event := ""
+	data := ""
+
+	for {
+
+		line, err := r.ReadString('\n')
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		line = strings.TrimRight(line, "\n")
+
+		if line == "" {
+			if event != "" {
+				return event, data
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "event: ") {
+			event = line[7:]
+		} else if strings.HasPrefix(line, "data: ") {
+			data = line[6:]
+		}
+	}
+}
+
+func TestContainerInfoStream(t *testing.T) {
+
+	e := newTestEnvWith(t, map[string]interface{}{
+		"container-wait-max": 1,
+		"rate-limits":        map[string]interface{}{"ContainerInfoStream": "container:2/60"},
+	})
+
+	token := e.login("owner@example.com")
+
+	ts := httptest.NewServer(NewContainerInfoStream(e.s, e.p, func(r *http.Request) string {
+		return "127.0.0.1"
+	}))
+
+	defer ts.Close()
+
+	var c *Container = nil
+	var query url.Values = nil
+
+	e.ctx(func(ctx micro.Context) {
+
+		var err error
+
+		c, err = e.s.ContainerCreate(ctx, &ContainerCreateTask{Token: token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		now := time.Now().Unix()
+
+		query = url.Values{}
+		query.Set("id", c.Id)
+		query.Set("timestamp", fmt.Sprint(now))
+		query.Set("ver", "0")
+		query.Set("sign", e.config(ctx).Sign(c.Secret, map[string]interface{}{"id": c.Id, "timestamp": now, "ver": 0}))
+	})
+
+	res, err := http.Get(ts.URL + "?" + query.Encode())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	r := bufio.NewReader(res.Body)
+
+	event, data := readStreamEvent(t, r)
+
+	if event != "info" || !strings.Contains(data, fmt.Sprintf(`"ver":%d`, c.Ver)) {
+		t.Fatalf("unexpected event %s %s", event, data)
+	}
+
+	e.ctx(func(ctx micro.Context) {
+
+		_, err := e.s.ContainerSet(ctx, &ContainerSetTask{Token: token, Id: c.Id, Secret: true})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	event, data = readStreamEvent(t, r)
+
+	if event != "error" || !strings.Contains(data, fmt.Sprintf(`"errno":%d`, ERRNO_SIGN)) {
+		t.Fatalf("expected the stream to close after the secret rotation, got %s %s", event, data)
+	}
+
+	// 第二次连接使用旧密钥签名
+	res2, err := http.Get(ts.URL + "?" + query.Encode())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res2.Body.Close()
+
+	event, data = readStreamEvent(t, bufio.NewReader(res2.Body))
+
+	if event != "error" || !strings.Contains(data, fmt.Sprintf(`"errno":%d`, ERRNO_SIGN)) {
+		t.Fatalf("expected a signature error, got %s %s", event, data)
+	}
+
+	res3, err := http.Get(ts.URL + "?" + query.Encode())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res3.Body.Close()
+
+	event, data = readStreamEvent(t, bufio.NewReader(res3.Body))
+
+	if event != "error" || !strings.Contains(data, fmt.Sprintf(`"errno":%d`, ERRNO_AGAIN)) {
+		t.Fatalf("expected the stream setup to be rate limited, got %s %s", event, data)
+	}
+}
@@ -0,0 +1,607 @@
+package srv
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-lib/eval"
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+/**
+* 合并模版信息, 对象逐个键合并, 其他类型以容器信息为准
+**/
+func mergeInfo(base interface{}, info interface{}) interface{} {
+
+	if info == nil {
+		return base
+	}
+
+	b, ok := base.(map[string]interface{})
+
+	if !ok {
+		return info
+	}
+
+	i, ok := info.(map[string]interface{})
+
+	if !ok {
+		return info
+	}
+
+	rs := map[string]interface{}{}
+
+	for key, value := range b {
+		rs[key] = value
+	}
+
+	for key, value := range i {
+		rs[key] = mergeInfo(b[key], value)
+	}
+
+	return rs
+}
+
+/**
+* 与 eval.ParseEval 相同, 一个字符串中有多个变量时也逐个替换
+* eval.ParseEval 匹配到最后一个 }, ${a}-${b} 的 key 为 a}-${b, 剩余部分继续替换
+**/
+func parseEval(text string, getValue func(key string) string) string {
+	return eval.ParseEval(text, func(key string) string {
+		i := strings.Index(key, "}")
+		if i < 0 {
+			return getValue(key)
+		}
+		return getValue(key[:i]) + parseEval(key[i+1:]+"}", getValue)
+	})
+}
+
+/**
+* 替换字符串中的 ${var}, 未定义的变量保持原样
+**/
+func interpolateInfo(info interface{}, vars map[string]string) interface{} {
+
+	switch v := info.(type) {
+	case string:
+		return parseEval(v, func(key string) string {
+			value, ok := vars[key]
+			if ok {
+				return value
+			}
+			return "${" + key + "}"
+		})
+	case map[string]interface{}:
+		rs := map[string]interface{}{}
+		for key, value := range v {
+			rs[key] = interpolateInfo(value, vars)
+		}
+		return rs
+	case []interface{}:
+		rs := make([]interface{}, len(v))
+		for i, value := range v {
+			rs[i] = interpolateInfo(value, vars)
+		}
+		return rs
+	}
+
+	return info
+}
+
+/**
+* 容器最终生效的信息: 模版信息 + 容器信息, 并替换变量
+**/
+func (s *Server) resolveContainerInfo(ctx micro.Context, container *Container) (interface{}, error) {
+
+	info := container.Info
+
+	if container.Template != "" {
+
+		tpl, err := s.getTemplate(ctx, container.Template)
+
+		if err != nil {
+			if !IsErrno(err, ERRNO_NOT_FOUND) {
+				return nil, err
+			}
+		} else {
+			info = mergeInfo(tpl.Info, info)
+		}
+	}
+
+	vars := map[string]string{"id": container.Id}
+
+	for key, value := range container.Vars {
+		vars[key] = value
+	}
+
+	return interpolateInfo(info, vars), nil
+}
+
+func (s *Server) getTemplateMember(ctx micro.Context, id string, uid string) (*Member, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	u := Member{}
+
+	err = config.Cache().GetObject(ctx, "template_member", fmt.Sprintf("%stm_%s_%s", config.Prefix, id, uid), &u, s.memberLoader(ctx, "template", id, uid))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+func (s *Server) addTemplateMember(ctx micro.Context, id string, uid string, role string) (*Member, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	member := &Member{Id: uid, Role: role}
+
+	err = config.Store().PutMember(ctx, "template", id, member)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key_tm := fmt.Sprintf("%stm_%s_%s", config.Prefix, id, uid)
+
+	config.Cache().Del(ctx, key_tm)
+
+	return member, nil
+}
+
+func (s *Server) removeTemplateMember(ctx micro.Context, id string, uid string) error {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return err
+	}
+
+	err = config.Store().DelMember(ctx, "template", id, uid)
+
+	if err != nil {
+		return err
+	}
+
+	key_tm := fmt.Sprintf("%stm_%s_%s", config.Prefix, id, uid)
+
+	config.Cache().Del(ctx, key_tm)
+
+	return nil
+}
+
+func (s *Server) getTemplate(ctx micro.Context, id string) (*Template, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	u := Template{}
+
+	err = config.Cache().GetObject(ctx, "template", fmt.Sprintf("%stp_%s", config.Prefix, id), &u, s.loader(ctx, fmt.Sprintf("template/%s/meta.json", id)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+func (s *Server) TemplateCreate(ctx micro.Context, task *TemplateCreateTask) (*Template, error) {
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tpl := &Template{Id: config.NewID(ctx), Info: task.Info, Ver: 1}
+
+	err = config.Store().PutTemplate(ctx, tpl)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.addTemplateMember(ctx, tpl.Id, uid, ROLE_OWNER)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return tpl, nil
+}
+
+/**
+* 模版的容器索引 template/{id}/containers.json, 容器的模版以 container/{id}/meta.json 为准
+**/
+func (s *objectStore) SetTemplate(ctx micro.Context, id string, info interface{}, uid string) (*Template, map[string]int, error) {
+
+	var tpl *Template = nil
+	var containers map[string]int = nil
+
+	err := s.update(ctx, func(tx *storeTx) error {
+
+		tpl = &Template{}
+
+		err := tx.MustObject(fmt.Sprintf("template/%s/meta.json", id), tpl, "Template that does not exist")
+
+		if err != nil {
+			return err
+		}
+
+		tpl.Ver = tpl.Ver + 1
+		tpl.Info = info
+
+		err = tx.PutObject(fmt.Sprintf("template/%s/meta.json", id), tpl)
+
+		if err != nil {
+			return err
+		}
+
+		deps := map[string]bool{}
+
+		_, err = tx.GetObject(fmt.Sprintf("template/%s/containers.json", id), &deps)
+
+		if err != nil {
+			return err
+		}
+
+		containers = map[string]int{}
+
+		mtime := time.Now().Unix()
+
+		for cid, _ := range deps {
+
+			container := &Container{}
+
+			ok, err := tx.GetObject(fmt.Sprintf("container/%s/meta.json", cid), container)
+
+			if err != nil {
+				return err
+			}
+
+			if !ok || container.Template != id {
+				continue
+			}
+
+			container, err = s.updateContainer(tx, cid, uid, mtime, func(container *Container) error {
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+
+			containers[cid] = container.Ver
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tpl, containers, nil
+}
+
+/**
+* 在事务中修改模版的容器索引
+**/
+func indexTemplate(tx *storeTx, tid string, id string, add bool) error {
+
+	key := fmt.Sprintf("template/%s/containers.json", tid)
+
+	deps := map[string]bool{}
+
+	_, err := tx.GetObject(key, &deps)
+
+	if err != nil {
+		return err
+	}
+
+	if add {
+		deps[id] = true
+	} else {
+		delete(deps, id)
+	}
+
+	return tx.PutObject(key, deps)
+}
+
+func (s *objectStore) SetContainerTemplate(ctx micro.Context, id string, template string, vars map[string]string, uid string) (*Container, error) {
+
+	var container *Container = nil
+
+	err := s.update(ctx, func(tx *storeTx) error {
+
+		c, err := s.updateContainer(tx, id, uid, time.Now().Unix(), func(container *Container) error {
+
+			if container.Template != template {
+
+				if container.Template != "" {
+
+					err := indexTemplate(tx, container.Template, id, false)
+
+					if err != nil {
+						return err
+					}
+				}
+
+				if template != "" {
+
+					_, err := tx.Get(fmt.Sprintf("template/%s/meta.json", template))
+
+					if err != nil {
+						if IsErrno(err, ERRNO_NOT_FOUND) {
+							return errors.Errorf(ERRNO_NOT_FOUND, "Template that does not exist")
+						}
+						return err
+					}
+
+					err = indexTemplate(tx, template, id, true)
+
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			container.Template = template
+			container.Vars = vars
+
+			return nil
+		})
+
+		container = c
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return container, nil
+}
+
+func (s *Server) TemplateSet(ctx micro.Context, task *TemplateSetTask) (*Template, error) {
+
+	if task.Id == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	member, err := s.getTemplateMember(ctx, task.Id, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if member.Role != ROLE_OWNER && member.Role != ROLE_READ_WRITE {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tpl, containers, err := config.Store().SetTemplate(ctx, task.Id, task.Info, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key_t := fmt.Sprintf("%stp_%s", config.Prefix, task.Id)
+
+	config.Cache().Del(ctx, key_t)
+
+	for cid, ver := range containers {
+
+		config.Cache().Del(ctx, fmt.Sprintf("%sc_%s", config.Prefix, cid))
+
+		err = s.publishContainerVer(ctx, cid, ver)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tpl, nil
+}
+
+func (s *Server) TemplateGet(ctx micro.Context, task *TemplateGetTask) (*Template, error) {
+
+	if task.Id == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	member, err := s.getTemplateMember(ctx, task.Id, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if member.Role != ROLE_OWNER && member.Role != ROLE_READ_WRITE && member.Role != ROLE_READ_ONLY {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
+
+	return s.getTemplate(ctx, task.Id)
+}
+
+func (s *Server) TemplateMemberAdd(ctx micro.Context, task *TemplateMemberAddTask) (*Member, error) {
+
+	if !re_email.MatchString(task.Email) {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter email is incorrect")
+	}
+
+	if task.Id == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	member, err := s.getTemplateMember(ctx, task.Id, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if member.Role != ROLE_OWNER {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
+
+	u, err := s.getUser(ctx, task.Email)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Id == uid {
+		return &Member{Id: uid, Role: ROLE_OWNER}, nil
+	}
+
+	return s.addTemplateMember(ctx, task.Id, u.Id, task.Role)
+}
+
+func (s *Server) TemplateMemberRemove(ctx micro.Context, task *TemplateMemberRemoveTask) (interface{}, error) {
+
+	if !re_email.MatchString(task.Email) {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter email is incorrect")
+	}
+
+	if task.Id == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	member, err := s.getTemplateMember(ctx, task.Id, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if member.Role != ROLE_OWNER {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
+
+	u, err := s.getUser(ctx, task.Email)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Id == uid {
+		return nil, errors.Errorf(ERRNO_MEMBER, "cannot delete owner member")
+	}
+
+	err = s.removeTemplateMember(ctx, task.Id, u.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (s *Server) ContainerTemplateSet(ctx micro.Context, task *ContainerTemplateSetTask) (*Container, error) {
+
+	if task.Id == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	member, err := s.getContainerMember(ctx, task.Id, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if member.Role != ROLE_OWNER && member.Role != ROLE_READ_WRITE {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
+
+	if task.Template != "" {
+
+		tm, err := s.getTemplateMember(ctx, task.Template, uid)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if tm.Role != ROLE_OWNER && tm.Role != ROLE_READ_WRITE && tm.Role != ROLE_READ_ONLY {
+			return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+		}
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	container, err := config.Store().SetContainerTemplate(ctx, task.Id, task.Template, task.Vars, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key_c := fmt.Sprintf("%sc_%s", config.Prefix, task.Id)
+
+	config.Cache().Del(ctx, key_c)
+
+	err = s.publishContainerVer(ctx, container.Id, container.Ver)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return memberContainer(container, member.Role), nil
+}
@@ -0,0 +1,141 @@
+package srv
+
+import (
+	"testing"
+
+	"github.com/ability-sh/abi-lib/dynamic"
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+func TestTemplate(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	token := e.login("owner@example.com")
+
+	e.ctx(func(ctx micro.Context) {
+
+		tpl, err := e.s.TemplateCreate(ctx, &TemplateCreateTask{Token: token, Info: map[string]interface{}{
+			"url":  "https://${region}.example.com/${id}",
+			"mode": "base",
+		}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := e.s.ContainerCreate(ctx, &ContainerCreateTask{Token: token, Info: map[string]interface{}{"mode": "own"}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.ContainerTemplateSet(ctx, &ContainerTemplateSetTask{Token: token, Id: c.Id, Template: "missing"})
+
+		assertErrno(t, err, ERRNO_NOT_FOUND)
+
+		c, err = e.s.ContainerTemplateSet(ctx, &ContainerTemplateSetTask{Token: token, Id: c.Id, Template: tpl.Id, Vars: map[string]string{"region": "eu"}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := e.s.resolveContainerInfo(ctx, c)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if dynamic.StringValue(dynamic.Get(info, "url"), "") != "https://eu.example.com/"+c.Id || dynamic.StringValue(dynamic.Get(info, "mode"), "") != "own" {
+			t.Fatalf("unexpected info %v", info)
+		}
+
+		ver := c.Ver
+
+		tpl, err = e.s.TemplateSet(ctx, &TemplateSetTask{Token: token, Id: tpl.Id, Info: map[string]interface{}{"url": "https://${region}.example.org"}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tpl.Ver != 2 {
+			t.Fatalf("unexpected template %+v", tpl)
+		}
+
+		c, err = e.s.getContainer(ctx, c.Id)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.Ver != ver+1 {
+			t.Fatalf("expected container ver %d, got %d", ver+1, c.Ver)
+		}
+
+		other := e.login("other@example.com")
+
+		_, err = e.s.TemplateGet(ctx, &TemplateGetTask{Token: other, Id: tpl.Id})
+
+		assertErrno(t, err, ERRNO_NOT_FOUND)
+
+		m, err := e.s.TemplateMemberAdd(ctx, &TemplateMemberAddTask{Token: token, Id: tpl.Id, Email: "other@example.com", Role: ROLE_READ_ONLY})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m.Role != ROLE_READ_ONLY {
+			t.Fatalf("unexpected member %+v", m)
+		}
+
+		_, err = e.s.TemplateGet(ctx, &TemplateGetTask{Token: other, Id: tpl.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.TemplateSet(ctx, &TemplateSetTask{Token: other, Id: tpl.Id, Info: map[string]interface{}{}})
+
+		assertErrno(t, err, ERRNO_NO_PERMISSION)
+
+		_, err = e.s.TemplateMemberAdd(ctx, &TemplateMemberAddTask{Token: other, Id: tpl.Id, Email: "third@example.com", Role: ROLE_READ_ONLY})
+
+		assertErrno(t, err, ERRNO_NO_PERMISSION)
+
+		_, err = e.s.TemplateMemberRemove(ctx, &TemplateMemberRemoveTask{Token: token, Id: tpl.Id, Email: "owner@example.com"})
+
+		assertErrno(t, err, ERRNO_MEMBER)
+
+		_, err = e.s.TemplateMemberRemove(ctx, &TemplateMemberRemoveTask{Token: token, Id: tpl.Id, Email: "other@example.com"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.TemplateGet(ctx, &TemplateGetTask{Token: other, Id: tpl.Id})
+
+		assertErrno(t, err, ERRNO_NOT_FOUND)
+	})
+}
+
+func TestInterpolateInfo(t *testing.T) {
+
+	vars := map[string]string{"a": "1", "b": "2"}
+
+	for text, expected := range map[string]string{
+		"${a}":           "1",
+		"${a}-${b}":      "1-2",
+		"x${a}}y${b}":    "x1}y2",
+		"${a}-${c}-${b}": "1-${c}-2",
+		"${a":            "${a",
+		"plain":          "plain",
+	} {
+		if v := interpolateInfo(text, vars); v != expected {
+			t.Fatalf("interpolate %s, expected %s, got %v", text, expected, v)
+		}
+	}
+
+	if v := evalTemplate("${a} ${c}.", vars); v != "1 ." {
+		t.Fatalf("unexpected template %s", v)
+	}
+}
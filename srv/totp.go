@@ -0,0 +1,660 @@
+package srv
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-micro/micro"
+	"github.com/ability-sh/abi-micro/redis"
+)
+
+const (
+	TOTP_PERIOD         = 30
+	TOTP_DIGITS         = 6
+	TOTP_WINDOW         = 1
+	TOTP_RECOVERY_CODES = 10
+	MFA_TICKET_EXPIRES  = 300
+	MFA_MAX_ATTEMPTS    = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+/**
+* RFC 6238, HMAC-SHA1
+**/
+func totpCode(secret []byte, counter int64) string {
+
+	b := make([]byte, 8)
+
+	binary.BigEndian.PutUint64(b, uint64(counter))
+
+	h := hmac.New(sha1.New, secret)
+	h.Write(b)
+	sum := h.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+
+	v := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", v%1000000)
+}
+
+/**
+* 恢复码只保存 sha256, 比较前去掉分隔符并转为小写
+**/
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRecoveryCodes() ([]string, []string, error) {
+
+	codes := []string{}
+	hashes := []string{}
+
+	for i := 0; i < TOTP_RECOVERY_CODES; i++ {
+
+		b := make([]byte, 5)
+
+		_, err := io.ReadFull(rand.Reader, b)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := hex.EncodeToString(b)
+
+		code = code[0:5] + "-" + code[5:]
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+/**
+* 获取用户 TOTP 设置 user/{uid}/totp.json, 未设置时返回 nil
+**/
+func (s *Server) getTotp(ctx micro.Context, uid string) (*Totp, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := config.Store().Get(ctx, fmt.Sprintf("user/%s/totp.json", uid))
+
+	if err != nil {
+		if IsErrno(err, ERRNO_NOT_FOUND) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	t := &Totp{}
+
+	unmarshalObject(text, t)
+
+	return t, nil
+}
+
+func (s *Server) hasTotp(ctx micro.Context, uid string) (bool, error) {
+
+	t, err := s.getTotp(ctx, uid)
+
+	if err != nil {
+		return false, err
+	}
+
+	return t != nil && t.Enabled, nil
+}
+
+/**
+* 校验 TOTP 验证码, 允许前后各 TOTP_WINDOW 个周期, 同一周期的验证码只能使用一次
+**/
+func (s *Server) verifyTotp(ctx micro.Context, uid string, t *Totp, code string) (bool, error) {
+
+	if len(code) != TOTP_DIGITS {
+		return false, nil
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return false, err
+	}
+
+	secret, err := config.DecryptSecret(t.Secret)
+
+	if err != nil {
+		return false, err
+	}
+
+	key, err := totpEncoding.DecodeString(secret)
+
+	if err != nil {
+		return false, err
+	}
+
+	cli, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		return false, err
+	}
+
+	counter := time.Now().Unix() / TOTP_PERIOD
+
+	for i := counter - TOTP_WINDOW; i <= counter+TOTP_WINDOW; i++ {
+
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, i)), []byte(code)) != 1 {
+			continue
+		}
+
+		ok, err := cli.SetNX(context.Background(), fmt.Sprintf("%stu_%s_%d", config.Prefix, uid, i), "1", time.Duration(TOTP_PERIOD*(2*TOTP_WINDOW+1))*time.Second).Result()
+
+		if err != nil {
+			return false, err
+		}
+
+		return ok, nil
+	}
+
+	return false, nil
+}
+
+/**
+* 使用恢复码, 每个恢复码只能使用一次
+**/
+func (s *Server) useRecoveryCode(ctx micro.Context, uid string, code string) (bool, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return false, err
+	}
+
+	return config.Store().UseRecoveryCode(ctx, uid, hashRecoveryCode(code))
+}
+
+func (s *objectStore) UseRecoveryCode(ctx micro.Context, uid string, hash string) (bool, error) {
+
+	used := false
+
+	err := s.update(ctx, func(tx *storeTx) error {
+
+		t := &Totp{}
+
+		ok, err := tx.GetObject(fmt.Sprintf("user/%s/totp.json", uid), t)
+
+		if err != nil || !ok || !t.Enabled {
+			used = false
+			return err
+		}
+
+		rs := []string{}
+
+		for _, v := range t.Recovery {
+			if v != hash {
+				rs = append(rs, v)
+			}
+		}
+
+		used = len(rs) < len(t.Recovery)
+
+		if !used {
+			return nil
+		}
+
+		t.Recovery = rs
+
+		return tx.PutObject(fmt.Sprintf("user/%s/totp.json", uid), t)
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	return used, nil
+}
+
+/**
+* 校验第二因素, 6 位数字为 TOTP 验证码, 否则为恢复码
+**/
+func (s *Server) checkSecondFactor(ctx micro.Context, uid string, t *Totp, code string) error {
+
+	code = strings.TrimSpace(code)
+
+	ok := false
+
+	var err error
+
+	if len(code) == TOTP_DIGITS {
+		ok, err = s.verifyTotp(ctx, uid, t, code)
+	} else {
+		ok, err = s.useRecoveryCode(ctx, uid, code)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errors.Errorf(ERRNO_LOGIN, "wrong verification code")
+	}
+
+	return nil
+}
+
+/**
+* 第一步登录成功后调用, 启用了两步验证时返回票据, 否则直接签发会话令牌
+**/
+func (s *Server) completeLogin(ctx micro.Context, u *User) (*LoginResult, error) {
+
+	enabled, err := s.hasTotp(ctx, u.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !enabled {
+		return s.newSession(ctx, u, false)
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cli, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ticket := config.NewToken()
+
+	key_mfa := fmt.Sprintf("%smfa_%s", config.Prefix, ticket)
+
+	err = cli.HSet(context.Background(), key_mfa, "uid", u.Id, "email", u.Email).Err()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = cli.Expire(context.Background(), key_mfa, time.Duration(MFA_TICKET_EXPIRES)*time.Second).Err()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoginResult{Mfa: true, Ticket: ticket}, nil
+}
+
+/**
+* 两步验证的第二步, 使用 TOTP 验证码或恢复码换取会话令牌
+**/
+func (s *Server) LoginTotp(ctx micro.Context, task *LoginTotpTask) (*LoginResult, error) {
+
+	if task.Ticket == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter ticket is incorrect")
+	}
+
+	if task.Code == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter code is incorrect")
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cli, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key_mfa := fmt.Sprintf("%smfa_%s", config.Prefix, task.Ticket)
+
+	vs, err := cli.HMGet(context.Background(), key_mfa, "uid", "email").Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	uid, _ := vs[0].(string)
+	email, _ := vs[1].(string)
+
+	if uid == "" {
+		return nil, errors.Errorf(ERRNO_LOGIN, "The login ticket has expired")
+	}
+
+	n, err := cli.HIncrBy(context.Background(), key_mfa, "attempts", 1).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if n > MFA_MAX_ATTEMPTS {
+		cli.Del(context.Background(), key_mfa)
+		return nil, errors.Errorf(ERRNO_LOGIN, "Too many attempts, please login again")
+	}
+
+	t, err := s.getTotp(ctx, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if t == nil || !t.Enabled {
+		return nil, errors.Errorf(ERRNO_LOGIN, "The login ticket has expired")
+	}
+
+	err = s.checkSecondFactor(ctx, uid, t, task.Code)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cli.Del(context.Background(), key_mfa)
+
+	return s.newSession(ctx, &User{Id: uid, Email: email}, true)
+}
+
+/**
+* 生成新的 TOTP 密钥, 确认前不生效
+**/
+func (s *Server) TotpEnroll(ctx micro.Context, task *TotpEnrollTask) (*TotpEnrollResult, error) {
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := s.getTotp(ctx, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if t != nil && t.Enabled {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "Two-factor authentication is already enabled")
+	}
+
+	u, err := s.getUserById(ctx, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, 20)
+
+	_, err = io.ReadFull(rand.Reader, key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	secret := totpEncoding.EncodeToString(key)
+
+	encrypted, err := config.EncryptSecret(secret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Store().PutObject(ctx, fmt.Sprintf("user/%s/totp.json", uid), &Totp{Secret: encrypted, Ctime: time.Now().Unix()})
+
+	if err != nil {
+		return nil, err
+	}
+
+	q := url.Values{}
+
+	q.Set("secret", secret)
+	q.Set("issuer", config.TotpIssuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprintf("%d", TOTP_DIGITS))
+	q.Set("period", fmt.Sprintf("%d", TOTP_PERIOD))
+
+	uri := fmt.Sprintf("otpauth://totp/%s:%s?%s", url.PathEscape(config.TotpIssuer), url.PathEscape(u.Email), q.Encode())
+
+	return &TotpEnrollResult{Secret: secret, Uri: uri}, nil
+}
+
+/**
+* 使用验证器中的验证码确认启用, 返回恢复码, 恢复码只返回这一次
+**/
+func (s *Server) TotpConfirm(ctx micro.Context, task *TotpConfirmTask) (*TotpConfirmResult, error) {
+
+	if task.Code == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter code is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := s.getTotp(ctx, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if t == nil {
+		return nil, errors.Errorf(ERRNO_NOT_FOUND, "Two-factor authentication is not enrolled")
+	}
+
+	if t.Enabled {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "Two-factor authentication is already enabled")
+	}
+
+	ok, err := s.verifyTotp(ctx, uid, t, strings.TrimSpace(task.Code))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, errors.Errorf(ERRNO_LOGIN, "wrong verification code")
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t.Enabled = true
+	t.Recovery = hashes
+
+	err = config.Store().PutObject(ctx, fmt.Sprintf("user/%s/totp.json", uid), t)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &TotpConfirmResult{RecoveryCodes: codes}, nil
+}
+
+/**
+* 关闭两步验证, 需要验证码或恢复码
+**/
+func (s *Server) TotpDisable(ctx micro.Context, task *TotpDisableTask) (interface{}, error) {
+
+	if task.Code == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter code is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := s.getTotp(ctx, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if t == nil || !t.Enabled {
+		return nil, errors.Errorf(ERRNO_NOT_FOUND, "Two-factor authentication is not enabled")
+	}
+
+	err = s.checkSecondFactor(ctx, uid, t, task.Code)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Store().Del(ctx, fmt.Sprintf("user/%s/totp.json", uid))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{}, nil
+}
+
+/**
+* 容器要求两步验证时, 当前会话需要在登录时完成两步验证或使用通行密钥登录
+**/
+func (s *Server) checkContainerMfa(ctx micro.Context, id string) error {
+
+	container, err := s.getContainer(ctx, id)
+
+	if err != nil {
+		return err
+	}
+
+	if !container.RequireMfa {
+		return nil
+	}
+
+	if ctx.GetValue(VALUE_SESSION_MFA) != "1" {
+		return errors.Errorf(ERRNO_NO_PERMISSION, "The container requires two-factor authentication, please login with two-factor authentication")
+	}
+
+	return nil
+}
+
+func (s *objectStore) SetContainerMfa(ctx micro.Context, id string, required bool) (*Container, error) {
+
+	var container *Container = nil
+
+	err := s.update(ctx, func(tx *storeTx) error {
+
+		container = &Container{}
+
+		err := tx.MustObject(fmt.Sprintf("container/%s/meta.json", id), container, "Container that does not exist")
+
+		if err != nil {
+			return err
+		}
+
+		container.RequireMfa = required
+
+		return tx.PutObject(fmt.Sprintf("container/%s/meta.json", id), container)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return container, nil
+}
+
+/**
+* 设置容器是否要求成员启用两步验证, 只有所有者可以设置
+**/
+func (s *Server) ContainerMfaSet(ctx micro.Context, task *ContainerMfaSetTask) (*Container, error) {
+
+	if task.Id == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	member, err := s.getContainerMember(ctx, task.Id, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if member.Role != ROLE_OWNER {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
+
+	if task.Required {
+
+		enabled, err := s.hasTotp(ctx, uid)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !enabled {
+			return nil, errors.Errorf(ERRNO_NO_PERMISSION, "Enable two-factor authentication before requiring it")
+		}
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	container, err := config.Store().SetContainerMfa(ctx, task.Id, task.Required)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config.Cache().Del(ctx, fmt.Sprintf("%sc_%s", config.Prefix, task.Id))
+
+	return memberContainer(container, member.Role), nil
+}
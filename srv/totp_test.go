@@ -0,0 +1,116 @@
+package srv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+func TestTotp(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	token := e.login("owner@example.com")
+
+	var key []byte = nil
+	var recovery []string = nil
+
+	counter := time.Now().Unix() / TOTP_PERIOD
+
+	e.ctx(func(ctx micro.Context) {
+
+		rs, err := e.s.TotpEnroll(ctx, &TotpEnrollTask{Token: token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key, err = totpEncoding.DecodeString(rs.Secret)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.TotpConfirm(ctx, &TotpConfirmTask{Token: token, Code: "000000"})
+
+		assertErrno(t, err, ERRNO_LOGIN)
+
+		r, err := e.s.TotpConfirm(ctx, &TotpConfirmTask{Token: token, Code: totpCode(key, counter)})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(r.RecoveryCodes) != TOTP_RECOVERY_CODES {
+			t.Fatalf("unexpected result %+v", r)
+		}
+
+		recovery = r.RecoveryCodes
+	})
+
+	rs := e.loginResult("owner@example.com")
+
+	if !rs.Mfa || rs.Ticket == "" || rs.Token != "" {
+		t.Fatalf("expected a two-factor ticket, got %+v", rs)
+	}
+
+	cid := ""
+
+	e.ctx(func(ctx micro.Context) {
+
+		_, err := e.s.LoginTotp(ctx, &LoginTotpTask{Ticket: rs.Ticket, Code: totpCode(key, counter)})
+
+		assertErrno(t, err, ERRNO_LOGIN)
+
+		r, err := e.s.LoginTotp(ctx, &LoginTotpTask{Ticket: rs.Ticket, Code: recovery[0]})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mfaToken := r.Token
+
+		c, err := e.s.ContainerCreate(ctx, &ContainerCreateTask{Token: mfaToken})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err = e.s.ContainerMfaSet(ctx, &ContainerMfaSetTask{Token: mfaToken, Id: c.Id, Required: true})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !c.RequireMfa {
+			t.Fatalf("unexpected container %+v", c)
+		}
+
+		cid = c.Id
+	})
+
+	e.ctx(func(ctx micro.Context) {
+
+		_, err := e.s.ContainerGet(ctx, &ContainerGetTask{Token: token, Id: cid})
+
+		assertErrno(t, err, ERRNO_NO_PERMISSION)
+	})
+
+	e.ctx(func(ctx micro.Context) {
+
+		_, err := e.s.TotpDisable(ctx, &TotpDisableTask{Token: token, Code: recovery[0]})
+
+		assertErrno(t, err, ERRNO_LOGIN)
+
+		_, err = e.s.TotpDisable(ctx, &TotpDisableTask{Token: token, Code: recovery[1]})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if e.login("owner@example.com") == "" {
+		t.Fatal("expected a session token after disabling two-factor authentication")
+	}
+}
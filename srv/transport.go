@@ -0,0 +1,345 @@
+package srv
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ability-sh/abi-lib/dynamic"
+	"github.com/ability-sh/abi-micro/micro"
+	"github.com/ability-sh/abi-micro/smtp"
+	"gopkg.in/gomail.v2"
+)
+
+const (
+	MAIL_TRANSPORT_SMTP   = "smtp"
+	MAIL_TRANSPORT_FILE   = "file"
+	MAIL_TRANSPORT_MEMORY = "memory"
+
+	MAIL_MEMORY_SIZE = 100
+)
+
+/**
+* 邮件发送方式
+**/
+type MailTransport interface {
+	Send(ctx micro.Context, m *Mail) error
+}
+
+/**
+* 本地发件箱, 只有 file 和 memory 发送方式支持, 用于开发和测试
+**/
+type MailOutbox interface {
+	/**
+	* 最近的邮件, 按时间倒序, to 不为空时只返回发给 to 的邮件
+	**/
+	List(to string, limit int) ([]*Mail, error)
+}
+
+func newMailTransport(config *ConfigService) (MailTransport, error) {
+	switch config.MailTransport {
+	case MAIL_TRANSPORT_SMTP:
+		return &smtpMailTransport{}, nil
+	case MAIL_TRANSPORT_FILE:
+		return newFileMailTransport(config.MailOutbox)
+	case MAIL_TRANSPORT_MEMORY:
+		return &memoryMailTransport{}, nil
+	}
+	return nil, fmt.Errorf("not support mail-transport %s", config.MailTransport)
+}
+
+func newMessage(from string, m *Mail) *gomail.Message {
+
+	msg := gomail.NewMessage()
+
+	if from != "" {
+		msg.SetHeader("From", from)
+	}
+
+	msg.SetHeader("To", m.To...)
+	msg.SetHeader("Subject", m.Subject)
+	msg.SetDateHeader("Date", time.Unix(m.Ctime, 0))
+
+	if m.Text != "" && m.Html != "" {
+		msg.SetBody("text/plain", m.Text)
+		msg.AddAlternative("text/html", m.Html)
+	} else if m.Html != "" {
+		msg.SetBody("text/html", m.Html)
+	} else {
+		msg.SetBody("text/plain", m.Text)
+	}
+
+	return msg
+}
+
+/**
+* 使用 smtp 服务的配置发送
+**/
+type smtpMailTransport struct {
+}
+
+func (t *smtpMailTransport) Send(ctx micro.Context, m *Mail) error {
+
+	mail, err := smtp.GetSMTPService(ctx, SERVICE_SMTP)
+
+	if err != nil {
+		return err
+	}
+
+	config := mail.Config()
+
+	d := gomail.NewDialer(dynamic.StringValue(dynamic.Get(config, "host"), ""),
+		int(dynamic.IntValue(dynamic.Get(config, "port"), 0)),
+		dynamic.StringValue(dynamic.Get(config, "user"), ""),
+		dynamic.StringValue(dynamic.Get(config, "password"), ""))
+
+	return d.DialAndSend(newMessage(dynamic.StringValue(dynamic.Get(config, "from"), ""), m))
+}
+
+/**
+* Maildir 格式的发件箱, 先写入 {dir}/tmp 再移动到 {dir}/new
+**/
+type fileMailTransport struct {
+	dir string
+}
+
+func newFileMailTransport(dir string) (*fileMailTransport, error) {
+
+	for _, name := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(dir, name), 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &fileMailTransport{dir: dir}, nil
+}
+
+func (t *fileMailTransport) Send(ctx micro.Context, m *Mail) error {
+
+	name := fmt.Sprintf("%d.%s.abi-app-store", time.Now().UnixNano(), m.Id)
+
+	tmp := filepath.Join(t.dir, "tmp", name)
+
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = newMessage("", m).WriteTo(fd)
+
+	fd.Close()
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(t.dir, "new", name))
+}
+
+func (t *fileMailTransport) List(to string, limit int) ([]*Mail, error) {
+
+	paths := []string{}
+
+	for _, name := range []string{"new", "cur"} {
+
+		es, err := os.ReadDir(filepath.Join(t.dir, name))
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range es {
+			if !e.IsDir() {
+				paths = append(paths, filepath.Join(t.dir, name, e.Name()))
+			}
+		}
+	}
+
+	// 文件名以纳秒时间开头
+	sort.Slice(paths, func(i, j int) bool {
+		return filepath.Base(paths[i]) > filepath.Base(paths[j])
+	})
+
+	rs := []*Mail{}
+
+	for _, path := range paths {
+
+		if len(rs) >= limit {
+			break
+		}
+
+		m, err := readMailFile(path)
+
+		if err != nil {
+			continue
+		}
+
+		if to == "" || m.hasRecipient(to) {
+			rs = append(rs, m)
+		}
+	}
+
+	return rs, nil
+}
+
+func decodePart(encoding string, r io.Reader) (string, error) {
+
+	switch strings.ToLower(encoding) {
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	}
+
+	b, err := io.ReadAll(r)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func readMailFile(path string) (*Mail, error) {
+
+	b, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+
+	if err != nil {
+		return nil, err
+	}
+
+	dec := &mime.WordDecoder{}
+
+	m := &Mail{Id: strings.Split(filepath.Base(path), ".")[1], To: []string{}}
+
+	m.Subject, _ = dec.DecodeHeader(msg.Header.Get("Subject"))
+
+	if rs, err := msg.Header.AddressList("To"); err == nil {
+		for _, a := range rs {
+			m.To = append(m.To, a.Address)
+		}
+	}
+
+	if date, err := msg.Header.Date(); err == nil {
+		m.Ctime = date.Unix()
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(mediaType, "multipart/") {
+
+		text, err := decodePart(msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if mediaType == "text/html" {
+			m.Html = text
+		} else {
+			m.Text = text
+		}
+
+		return m, nil
+	}
+
+	r := multipart.NewReader(msg.Body, params["boundary"])
+
+	for {
+
+		p, err := r.NextPart()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		text, err := decodePart(p.Header.Get("Content-Transfer-Encoding"), p)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(p.Header.Get("Content-Type"), "text/html") {
+			m.Html = text
+		} else {
+			m.Text = text
+		}
+	}
+
+	return m, nil
+}
+
+/**
+* 内存发件箱, 保留最近 MAIL_MEMORY_SIZE 封, 用于测试
+**/
+type memoryMailTransport struct {
+	lock  sync.Mutex
+	mails []*Mail
+}
+
+func (t *memoryMailTransport) Send(ctx micro.Context, m *Mail) error {
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.mails = append(t.mails, m)
+
+	if len(t.mails) > MAIL_MEMORY_SIZE {
+		t.mails = t.mails[len(t.mails)-MAIL_MEMORY_SIZE:]
+	}
+
+	return nil
+}
+
+func (t *memoryMailTransport) List(to string, limit int) ([]*Mail, error) {
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	rs := []*Mail{}
+
+	for i := len(t.mails) - 1; i >= 0 && len(rs) < limit; i-- {
+		if to == "" || t.mails[i].hasRecipient(to) {
+			rs = append(rs, t.mails[i])
+		}
+	}
+
+	return rs, nil
+}
+
+func (m *Mail) hasRecipient(to string) bool {
+	for _, v := range m.To {
+		if strings.EqualFold(v, to) {
+			return true
+		}
+	}
+	return false
+}
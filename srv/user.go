@@ -3,44 +3,47 @@ package srv
 import (
 	"fmt"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ability-sh/abi-lib/dynamic"
 	"github.com/ability-sh/abi-lib/errors"
-	"github.com/ability-sh/abi-lib/eval"
-	"github.com/ability-sh/abi-micro/http"
 	"github.com/ability-sh/abi-micro/micro"
 	"github.com/ability-sh/abi-micro/redis"
-	"github.com/ability-sh/abi-micro/smtp"
 )
 
 var re_email, _ = regexp.Compile(`^[a-zA-Z\.\-\_0-9]+@[a-zA-Z0-9\-\.]+$`)
 
+/**
+* 邮箱不区分大小写, 验证码, 用户目录和 OIDC 登录都使用规范化后的邮箱
+**/
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
 func (s *Server) getUid(ctx micro.Context, token string) (string, error) {
 
 	if token == "" {
 		return "", errors.Errorf(ERRNO_LOGIN, "Retry after logging in")
 	}
 
-	config, err := GetConfigService(ctx, SERVICE_CONFIG)
-
-	if err != nil {
-		return "", err
-	}
+	if isJwtToken(token) {
 
-	redis, err := redis.GetRedis(ctx, SERVICE_REDIS)
+		claims, err := s.parseJwt(ctx, token, TOKEN_TYPE_ACCESS)
 
-	if err != nil {
-		return "", err
-	}
+		if err != nil {
+			return "", err
+		}
 
-	id, err := redis.Get(fmt.Sprintf("%st_%s", config.Prefix, token))
+		if dynamic.BooleanValue(claims["mfa"], false) {
+			ctx.SetValue(VALUE_SESSION_MFA, "1")
+		}
 
-	if err != nil || id == "" {
-		return "", errors.Errorf(ERRNO_LOGIN, "Retry after logging in")
+		return dynamic.StringValue(claims["sub"], ""), nil
 	}
 
-	return id, nil
+	return s.getSessionUid(ctx, token)
 }
 
 func (s *Server) getUser(ctx micro.Context, email string) (*User, error) {
@@ -51,39 +54,33 @@ func (s *Server) getUser(ctx micro.Context, email string) (*User, error) {
 		return nil, err
 	}
 
-	HTTP, err := http.GetHTTPService(ctx, SERVICE_HTTP)
+	return config.Directory().GetUser(ctx, email, false)
+}
 
-	if err != nil {
-		return nil, err
-	}
+/**
+* 验证码邮件模版变量
+**/
+func captchaVars(ctx micro.Context, config *ConfigService, email string, code string, locale string) map[string]string {
 
-	res, err := HTTP.Request(ctx, "GET").
-		SetURL(fmt.Sprintf("%s/get.json", config.UserSvc), map[string]string{"name": email}).
-		Send()
+	minutes := config.EmailExpires / 60
 
-	if err != nil {
-		return nil, err
+	if minutes < 1 {
+		minutes = 1
 	}
 
-	data, err := res.PraseBody()
-
-	if err != nil {
-		return nil, err
+	return map[string]string{
+		"code":           code,
+		"email":          email,
+		"expiresMinutes": strconv.Itoa(minutes),
+		"ip":             ctx.GetValue("clientIp"),
+		"locale":         locale,
 	}
-
-	errno := dynamic.IntValue(dynamic.Get(data, "errno"), 0)
-
-	if errno != 200 {
-		return nil, errors.Errorf(int32(errno), dynamic.StringValue(dynamic.Get(data, "errmsg"), "Internal service error"))
-	}
-
-	uid := dynamic.StringValue(dynamic.GetWithKeys(data, []string{"data", "id"}), "")
-
-	return &User{Email: email, Id: uid}, nil
 }
 
 func (s *Server) MailSend(ctx micro.Context, task *SendMailTask) (interface{}, error) {
 
+	task.Email = normalizeEmail(task.Email)
+
 	if !re_email.MatchString(task.Email) {
 		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter email is incorrect")
 	}
@@ -109,29 +106,16 @@ func (s *Server) MailSend(ctx micro.Context, task *SendMailTask) (interface{}, e
 		return nil, errors.Errorf(ERRNO_AGAIN, "The operation is too frequent, try again later")
 	}
 
-	mail, err := smtp.GetSMTPService(ctx, SERVICE_SMTP)
-
-	if err != nil {
-		return nil, err
-	}
-
 	code := config.NewCode()
 
-	getValue := func(key string) string {
-		if key == "code" {
-			return code
-		}
-		return ""
-	}
+	locale, tpl := config.captchaTemplate(task.Locale)
 
-	if config.EmailEnabled {
+	subject, text, body := tpl.render(captchaVars(ctx, config, task.Email, code, locale))
 
-		err = mail.Send([]string{task.Email}, eval.ParseEval(config.EmailSubject, getValue), eval.ParseEval(config.EmailBody, getValue), config.EmailBodyType)
-
-		if err != nil {
-			return nil, err
-		}
+	err = sendMail(ctx, []string{task.Email}, subject, text, body)
 
+	if err != nil {
+		return nil, err
 	}
 
 	err = redis.Set(key_sr, code, time.Duration(config.EmailReExpires)*time.Second)
@@ -146,15 +130,13 @@ func (s *Server) MailSend(ctx micro.Context, task *SendMailTask) (interface{}, e
 		return nil, err
 	}
 
-	if config.EmailEnabled {
-		return map[string]interface{}{}, nil
-	}
-
-	return map[string]interface{}{"code": code}, nil
+	return map[string]interface{}{}, nil
 }
 
 func (s *Server) Login(ctx micro.Context, task *LoginTask) (*LoginResult, error) {
 
+	task.Email = normalizeEmail(task.Email)
+
 	if !re_email.MatchString(task.Email) {
 		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter email is incorrect")
 	}
@@ -184,57 +166,43 @@ func (s *Server) Login(ctx micro.Context, task *LoginTask) (*LoginResult, error)
 		return nil, errors.Errorf(ERRNO_AGAIN, "wrong captcha")
 	}
 
-	HTTP, err := http.GetHTTPService(ctx, SERVICE_HTTP)
+	u, err := config.Directory().GetUser(ctx, task.Email, true)
 
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := HTTP.Request(ctx, "GET").
-		SetURL(fmt.Sprintf("%s/get.json", config.UserSvc), map[string]string{"name": task.Email, "autoCreated": "true"}).
-		Send()
+	err = redis.Del(key_s)
 
 	if err != nil {
 		return nil, err
 	}
 
-	data, err := res.PraseBody()
+	err = redis.Del(key_sr)
 
 	if err != nil {
 		return nil, err
 	}
 
-	errno := dynamic.IntValue(dynamic.Get(data, "errno"), 0)
-
-	if errno != 200 {
-		return nil, errors.Errorf(int32(errno), dynamic.StringValue(dynamic.Get(data, "errmsg"), "Internal service error"))
-	}
-
-	uid := dynamic.StringValue(dynamic.GetWithKeys(data, []string{"data", "id"}), "")
-
-	u := &User{Email: task.Email, Id: uid}
-
-	token := config.NewToken()
-
-	err = redis.Set(fmt.Sprintf("%st_%s", config.Prefix, token), uid, time.Duration(config.TokenExpires)*time.Second)
+	return s.completeLogin(ctx, u)
+}
 
-	if err != nil {
-		return nil, err
-	}
+/**
+* 登录成功后签发会话令牌, mfa 表示本次登录完成了两步验证
+**/
+func (s *Server) newSession(ctx micro.Context, u *User, mfa bool) (*LoginResult, error) {
 
-	err = redis.Del(key_s)
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
 
 	if err != nil {
 		return nil, err
 	}
 
-	err = redis.Del(key_sr)
-
-	if err != nil {
-		return nil, err
+	if config.TokenMode == TOKEN_MODE_JWT {
+		return s.newJwtSession(ctx, u, time.Now().Unix(), mfa)
 	}
 
-	return &LoginResult{Token: token, User: u}, nil
+	return s.newRedisSession(ctx, u, time.Now().Unix(), mfa)
 }
 
 func (s *Server) UserGet(ctx micro.Context, task *UserGetTask) (*User, error) {
@@ -245,39 +213,50 @@ func (s *Server) UserGet(ctx micro.Context, task *UserGetTask) (*User, error) {
 		return nil, err
 	}
 
+	return s.getUserById(ctx, uid)
+}
+
+func (s *Server) getUserById(ctx micro.Context, uid string) (*User, error) {
+
 	config, err := GetConfigService(ctx, SERVICE_CONFIG)
 
 	if err != nil {
 		return nil, err
 	}
 
-	HTTP, err := http.GetHTTPService(ctx, SERVICE_HTTP)
+	return config.Directory().GetUserById(ctx, uid)
+}
 
-	if err != nil {
-		return nil, err
-	}
+/**
+* 预览验证码邮件, 只有管理员可以调用
+**/
+func (s *Server) MailPreview(ctx micro.Context, task *MailPreviewTask) (*MailPreviewResult, error) {
 
-	res, err := HTTP.Request(ctx, "GET").
-		SetURL(fmt.Sprintf("%s/get.json", config.UserSvc), map[string]string{"id": uid}).
-		Send()
+	uid, err := s.getUid(ctx, task.Token)
 
 	if err != nil {
 		return nil, err
 	}
 
-	data, err := res.PraseBody()
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
 
 	if err != nil {
 		return nil, err
 	}
 
-	errno := dynamic.IntValue(dynamic.Get(data, "errno"), 0)
+	if !config.IsAdmin(uid) {
+		return nil, errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
+
+	email := task.Email
 
-	if errno != 200 {
-		return nil, errors.Errorf(int32(errno), dynamic.StringValue(dynamic.Get(data, "errmsg"), "Internal service error"))
+	if email == "" {
+		email = "user@example.com"
 	}
 
-	name := dynamic.StringValue(dynamic.GetWithKeys(data, []string{"data", "name"}), "")
+	locale, tpl := config.captchaTemplate(task.Locale)
+
+	subject, text, body := tpl.render(captchaVars(ctx, config, email, strings.Repeat("0", config.CodeLength), locale))
 
-	return &User{Email: name, Id: uid}, nil
+	return &MailPreviewResult{Locale: locale, Subject: subject, Text: text, Html: body}, nil
 }
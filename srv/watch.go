@@ -0,0 +1,196 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ability-sh/abi-micro/micro"
+	"github.com/ability-sh/abi-micro/redis"
+	R "github.com/go-redis/redis/v8"
+)
+
+const (
+	VALUE_CONTAINER_WATCHER = "abi-app-store-container-watcher"
+)
+
+/**
+* 订阅容器版本变更, 每个进程只建立一个 Redis 订阅
+**/
+type containerWatcher struct {
+	lock    sync.Mutex
+	prefix  string
+	waiters map[string]map[chan int]bool
+	ps      *R.PubSub
+}
+
+var containerWatcherLock sync.Mutex
+
+func getContainerWatcher(ctx micro.Context) (*containerWatcher, error) {
+
+	containerWatcherLock.Lock()
+	defer containerWatcherLock.Unlock()
+
+	p := ctx.Payload()
+
+	w, ok := p.GetValue(VALUE_CONTAINER_WATCHER).(*containerWatcher)
+
+	if ok {
+		return w, nil
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		return nil, err
+	}
+
+	w = &containerWatcher{prefix: fmt.Sprintf("%scv_", config.Prefix), waiters: map[string]map[chan int]bool{}}
+
+	w.ps = client.PSubscribe(context.Background(), w.prefix+"*")
+
+	go w.run()
+
+	p.SetValue(VALUE_CONTAINER_WATCHER, w)
+
+	return w, nil
+}
+
+func (w *containerWatcher) run() {
+	for msg := range w.ps.Channel() {
+		ver, err := strconv.Atoi(msg.Payload)
+		if err != nil {
+			continue
+		}
+		w.notify(msg.Channel[len(w.prefix):], ver)
+	}
+}
+
+func (w *containerWatcher) notify(id string, ver int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for C, _ := range w.waiters[id] {
+		select {
+		case C <- ver:
+		default:
+		}
+	}
+}
+
+func (w *containerWatcher) watch(id string) chan int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	C := make(chan int, 1)
+	vs, ok := w.waiters[id]
+	if !ok {
+		vs = map[chan int]bool{}
+		w.waiters[id] = vs
+	}
+	vs[C] = true
+	return C
+}
+
+func (w *containerWatcher) unwatch(id string, C chan int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	vs, ok := w.waiters[id]
+	if ok {
+		delete(vs, C)
+		if len(vs) == 0 {
+			delete(w.waiters, id)
+		}
+	}
+}
+
+func (w *containerWatcher) Recycle() {
+	w.ps.Close()
+}
+
+/**
+* 广播容器版本变更, 同时触发 container.updated 事件
+**/
+func (s *Server) publishContainerVer(ctx micro.Context, id string, ver int) error {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return err
+	}
+
+	client, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		return err
+	}
+
+	err = client.Publish(context.Background(), fmt.Sprintf("%scv_%s", config.Prefix, id), ver).Err()
+
+	if err != nil {
+		return err
+	}
+
+	s.emitEvent(ctx, WEBHOOK_SCOPE_CONTAINER, id, EVENT_CONTAINER_UPDATED, map[string]interface{}{"id": id, "ver": ver})
+
+	return nil
+}
+
+/**
+* 等待容器版本大于 ver, 超时或 done 关闭时返回当前容器
+**/
+func (s *Server) waitContainer(ctx micro.Context, id string, ver int, timeout time.Duration, done <-chan struct{}) (*Container, error) {
+
+	w, err := getContainerWatcher(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	C := w.watch(id)
+
+	defer w.unwatch(id, C)
+
+	container, err := s.getContainer(ctx, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if container.Ver > ver {
+		return container, nil
+	}
+
+	T := time.NewTimer(timeout)
+
+	defer T.Stop()
+
+	for {
+		select {
+		case v := <-C:
+			if v > ver {
+
+				config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+				if err != nil {
+					return nil, err
+				}
+
+				// 版本通知可能早于缓存删除广播到达, 先删除进程内缓存再读取
+				config.Cache().Evict(fmt.Sprintf("%sc_%s", config.Prefix, id))
+
+				return s.getContainer(ctx, id)
+			}
+		case <-T.C:
+			return container, nil
+		case <-done:
+			return container, nil
+		}
+	}
+}
@@ -0,0 +1,796 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-lib/json"
+	"github.com/ability-sh/abi-micro/micro"
+	"github.com/ability-sh/abi-micro/redis"
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	WEBAUTHN_CHALLENGE_EXPIRES = 300
+	WEBAUTHN_CREATE            = "webauthn.create"
+	WEBAUTHN_GET               = "webauthn.get"
+
+	COSE_ALG_ES256 = -7
+	COSE_ALG_RS256 = -257
+
+	AUTH_FLAG_UP = 0x01
+	AUTH_FLAG_UV = 0x04
+	AUTH_FLAG_AT = 0x40
+)
+
+var b64url = base64.RawURLEncoding
+
+type webauthnChallenge struct {
+	Type string `json:"type"`
+	Uid  string `json:"uid"`
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type attestationObject struct {
+	Fmt      string          `cbor:"fmt"`
+	AttStmt  cbor.RawMessage `cbor:"attStmt"`
+	AuthData []byte          `cbor:"authData"`
+}
+
+type authenticatorData struct {
+	RpIdHash  []byte
+	Flags     byte
+	SignCount uint32
+	CredId    []byte
+	Key       *JWK
+}
+
+/**
+* 解析 authenticatorData, 包含 attestedCredentialData 时解析凭证 ID 和 COSE 公钥
+**/
+func parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+
+	if len(b) < 37 {
+		return nil, fmt.Errorf("authenticator data too short")
+	}
+
+	d := &authenticatorData{RpIdHash: b[0:32], Flags: b[32], SignCount: binary.BigEndian.Uint32(b[33:37])}
+
+	if d.Flags&AUTH_FLAG_AT == 0 {
+		return d, nil
+	}
+
+	if len(b) < 55 {
+		return nil, fmt.Errorf("attested credential data too short")
+	}
+
+	n := int(binary.BigEndian.Uint16(b[53:55]))
+
+	if len(b) < 55+n {
+		return nil, fmt.Errorf("attested credential data too short")
+	}
+
+	d.CredId = b[55 : 55+n]
+
+	key := map[int]interface{}{}
+
+	err := cbor.NewDecoder(bytes.NewReader(b[55+n:])).Decode(&key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	d.Key, err = coseKey(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func coseInt(v interface{}) int64 {
+	switch i := v.(type) {
+	case int64:
+		return i
+	case uint64:
+		return int64(i)
+	}
+	return 0
+}
+
+func coseBytes(v interface{}) string {
+	b, _ := v.([]byte)
+	return b64url.EncodeToString(b)
+}
+
+/**
+* COSE 公钥转换为 JWK, 支持 ES256(P-256) 和 RS256
+**/
+func coseKey(key map[int]interface{}) (*JWK, error) {
+
+	switch coseInt(key[3]) {
+	case COSE_ALG_ES256:
+		if coseInt(key[1]) != 2 || coseInt(key[-1]) != 1 {
+			return nil, fmt.Errorf("unsupported EC key")
+		}
+		return &JWK{Kty: "EC", Alg: "ES256", Crv: "P-256", X: coseBytes(key[-2]), Y: coseBytes(key[-3])}, nil
+	case COSE_ALG_RS256:
+		if coseInt(key[1]) != 3 {
+			return nil, fmt.Errorf("unsupported RSA key")
+		}
+		return &JWK{Kty: "RSA", Alg: "RS256", N: coseBytes(key[-1]), E: coseBytes(key[-2])}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported alg %d", coseInt(key[3]))
+}
+
+/**
+* 校验断言签名, 签名数据为 authenticatorData || sha256(clientDataJSON)
+**/
+func verifyAssertion(key *JWK, authData []byte, clientDataJSON []byte, sig []byte) error {
+
+	pub, err := key.publicKey()
+
+	if err != nil {
+		return err
+	}
+
+	h := sha256.Sum256(clientDataJSON)
+
+	digest := sha256.Sum256(append(append([]byte{}, authData...), h[:]...))
+
+	switch p := pub.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(p, digest[:], sig) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(p, crypto.SHA256, digest[:], sig)
+	}
+
+	return fmt.Errorf("unsupported key")
+}
+
+func (s *ConfigService) webauthnEnabled() error {
+	if s.WebauthnRpId == "" || s.WebauthnOrigin == "" {
+		return errors.Errorf(ERRNO_NO_PERMISSION, "Passkey login is not enabled")
+	}
+	return nil
+}
+
+/**
+* 生成挑战, 保存到 {prefix}wa_{challenge}
+**/
+func (s *Server) newWebauthnChallenge(ctx micro.Context, typ string, uid string) (string, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return "", err
+	}
+
+	redis, err := redis.GetRedis(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		return "", err
+	}
+
+	b := make([]byte, 32)
+
+	_, err = io.ReadFull(rand.Reader, b)
+
+	if err != nil {
+		return "", err
+	}
+
+	challenge := b64url.EncodeToString(b)
+
+	text, _ := json.Marshal(&webauthnChallenge{Type: typ, Uid: uid})
+
+	err = redis.Set(fmt.Sprintf("%swa_%s", config.Prefix, challenge), string(text), time.Duration(WEBAUTHN_CHALLENGE_EXPIRES)*time.Second)
+
+	if err != nil {
+		return "", err
+	}
+
+	return challenge, nil
+}
+
+/**
+* 校验 clientDataJSON 的 type, origin 并取出挑战, 挑战只能使用一次
+**/
+func (s *Server) takeWebauthnChallenge(ctx micro.Context, typ string, raw []byte) (*webauthnChallenge, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cd := &clientData{}
+
+	err = unmarshalObject(raw, cd)
+
+	if err != nil || cd.Type != typ || cd.Challenge == "" {
+		return nil, errors.Errorf(ERRNO_LOGIN, "Invalid client data")
+	}
+
+	if cd.Origin != config.WebauthnOrigin {
+		return nil, errors.Errorf(ERRNO_LOGIN, "Invalid client data origin")
+	}
+
+	cli, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// 读取并删除挑战, 并发使用同一个挑战时只有一个请求能拿到
+	text, err := getDelScript.Run(context.Background(), cli, []string{fmt.Sprintf("%swa_%s", config.Prefix, cd.Challenge)}).Text()
+
+	if err != nil && !redis.IsNil(err) {
+		return nil, err
+	}
+
+	if text == "" {
+		return nil, errors.Errorf(ERRNO_LOGIN, "The challenge has expired")
+	}
+
+	c := &webauthnChallenge{}
+
+	unmarshalObject([]byte(text), c)
+
+	if c.Type != typ {
+		return nil, errors.Errorf(ERRNO_LOGIN, "Invalid challenge")
+	}
+
+	return c, nil
+}
+
+func (s *ConfigService) checkRpIdHash(h []byte) error {
+
+	rp := sha256.Sum256([]byte(s.WebauthnRpId))
+
+	if subtle.ConstantTimeCompare(rp[:], h) != 1 {
+		return errors.Errorf(ERRNO_LOGIN, "Invalid rp id hash")
+	}
+
+	return nil
+}
+
+/**
+* 用户的通行密钥 user/{uid}/passkeys.json, {id: Passkey}
+**/
+func (s *Server) getPasskeys(ctx micro.Context, uid string) (map[string]*Passkey, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rs := map[string]*Passkey{}
+
+	text, err := config.Store().Get(ctx, fmt.Sprintf("user/%s/passkeys.json", uid))
+
+	if err != nil {
+		if IsErrno(err, ERRNO_NOT_FOUND) {
+			return rs, nil
+		}
+		return nil, err
+	}
+
+	unmarshalObject(text, &rs)
+
+	return rs, nil
+}
+
+func passkeyIds(passkeys map[string]*Passkey) []map[string]interface{} {
+
+	ids := []string{}
+
+	for id := range passkeys {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	rs := []map[string]interface{}{}
+
+	for _, id := range ids {
+		rs = append(rs, map[string]interface{}{"type": "public-key", "id": id})
+	}
+
+	return rs
+}
+
+/**
+* 开始注册通行密钥, 返回 PublicKeyCredentialCreationOptions, 二进制字段使用 base64url
+**/
+func (s *Server) PasskeyRegisterBegin(ctx micro.Context, task *PasskeyRegisterBeginTask) (interface{}, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.webauthnEnabled()
+
+	if err != nil {
+		return nil, err
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := s.getUserById(ctx, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	passkeys, err := s.getPasskeys(ctx, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := s.newWebauthnChallenge(ctx, WEBAUTHN_CREATE, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"challenge": challenge,
+		"rp":        map[string]interface{}{"id": config.WebauthnRpId, "name": config.WebauthnRpName},
+		"user":      map[string]interface{}{"id": b64url.EncodeToString([]byte(uid)), "name": u.Email, "displayName": u.Email},
+		"pubKeyCredParams": []map[string]interface{}{
+			{"type": "public-key", "alg": COSE_ALG_ES256},
+			{"type": "public-key", "alg": COSE_ALG_RS256},
+		},
+		"timeout":                WEBAUTHN_CHALLENGE_EXPIRES * 1000,
+		"attestation":            "none",
+		"excludeCredentials":     passkeyIds(passkeys),
+		"authenticatorSelection": map[string]interface{}{"residentKey": "preferred", "userVerification": "required"},
+	}, nil
+}
+
+/**
+* 完成注册, 校验 attestationObject 后保存公钥, 不校验 attestation 声明
+**/
+func (s *Server) PasskeyRegisterFinish(ctx micro.Context, task *PasskeyRegisterFinishTask) (*Passkey, error) {
+
+	clientDataJSON, err := b64url.DecodeString(task.ClientDataJSON)
+
+	if err != nil || len(clientDataJSON) == 0 {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter clientDataJSON is incorrect")
+	}
+
+	attestation, err := b64url.DecodeString(task.AttestationObject)
+
+	if err != nil || len(attestation) == 0 {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter attestationObject is incorrect")
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.webauthnEnabled()
+
+	if err != nil {
+		return nil, err
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := s.takeWebauthnChallenge(ctx, WEBAUTHN_CREATE, clientDataJSON)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Uid != uid {
+		return nil, errors.Errorf(ERRNO_LOGIN, "Invalid challenge")
+	}
+
+	att := &attestationObject{}
+
+	err = cbor.Unmarshal(attestation, att)
+
+	if err != nil {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter attestationObject is incorrect")
+	}
+
+	d, err := parseAuthenticatorData(att.AuthData)
+
+	if err != nil {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter attestationObject is incorrect, %s", err.Error())
+	}
+
+	err = config.checkRpIdHash(d.RpIdHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Flags&AUTH_FLAG_UP == 0 {
+		return nil, errors.Errorf(ERRNO_LOGIN, "User presence is required")
+	}
+
+	// 通行密钥可以跳过两步验证登录, 注册时同样要求用户验证
+	if d.Flags&AUTH_FLAG_UV == 0 {
+		return nil, errors.Errorf(ERRNO_LOGIN, "User verification is required")
+	}
+
+	if d.Key == nil {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter attestationObject has no credential")
+	}
+
+	id := b64url.EncodeToString(d.CredId)
+
+	if task.Id != "" && task.Id != id {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	name := task.Name
+
+	if name == "" {
+		name = "Passkey"
+	}
+
+	p := &Passkey{Id: id, Name: name, Key: d.Key, SignCount: d.SignCount, Ctime: time.Now().Unix()}
+
+	err = config.Store().AddPasskey(ctx, uid, p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p.Key = nil
+
+	return p, nil
+}
+
+/**
+* 开始通行密钥登录, email 为空时使用可发现凭证
+**/
+func (s *Server) PasskeyLoginBegin(ctx micro.Context, task *PasskeyLoginBeginTask) (interface{}, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.webauthnEnabled()
+
+	if err != nil {
+		return nil, err
+	}
+
+	uid := ""
+
+	allow := []map[string]interface{}{}
+
+	if task.Email != "" {
+
+		if !re_email.MatchString(task.Email) {
+			return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter email is incorrect")
+		}
+
+		u, err := config.Directory().GetUser(ctx, task.Email, false)
+
+		if err != nil {
+			if IsErrno(err, ERRNO_NOT_FOUND) {
+				return nil, errors.Errorf(ERRNO_LOGIN, "No passkey registered")
+			}
+			return nil, err
+		}
+
+		passkeys, err := s.getPasskeys(ctx, u.Id)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(passkeys) == 0 {
+			return nil, errors.Errorf(ERRNO_LOGIN, "No passkey registered")
+		}
+
+		uid = u.Id
+		allow = passkeyIds(passkeys)
+	}
+
+	challenge, err := s.newWebauthnChallenge(ctx, WEBAUTHN_GET, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"challenge":        challenge,
+		"rpId":             config.WebauthnRpId,
+		"timeout":          WEBAUTHN_CHALLENGE_EXPIRES * 1000,
+		"allowCredentials": allow,
+		"userVerification": "required",
+	}, nil
+}
+
+/**
+* 校验断言并签发会话令牌
+**/
+func (s *Server) PasskeyLoginFinish(ctx micro.Context, task *PasskeyLoginFinishTask) (*LoginResult, error) {
+
+	if task.Id == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	clientDataJSON, err := b64url.DecodeString(task.ClientDataJSON)
+
+	if err != nil || len(clientDataJSON) == 0 {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter clientDataJSON is incorrect")
+	}
+
+	authData, err := b64url.DecodeString(task.AuthenticatorData)
+
+	if err != nil || len(authData) == 0 {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter authenticatorData is incorrect")
+	}
+
+	sig, err := b64url.DecodeString(task.Signature)
+
+	if err != nil || len(sig) == 0 {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter signature is incorrect")
+	}
+
+	userHandle, err := b64url.DecodeString(task.UserHandle)
+
+	if err != nil {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter userHandle is incorrect")
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.webauthnEnabled()
+
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := s.takeWebauthnChallenge(ctx, WEBAUTHN_GET, clientDataJSON)
+
+	if err != nil {
+		return nil, err
+	}
+
+	uid := c.Uid
+
+	if len(userHandle) > 0 {
+		if uid != "" && uid != string(userHandle) {
+			return nil, errors.Errorf(ERRNO_LOGIN, "Invalid user handle")
+		}
+		uid = string(userHandle)
+	}
+
+	if uid == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter userHandle is incorrect")
+	}
+
+	d, err := parseAuthenticatorData(authData)
+
+	if err != nil {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter authenticatorData is incorrect, %s", err.Error())
+	}
+
+	err = config.checkRpIdHash(d.RpIdHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Flags&AUTH_FLAG_UP == 0 {
+		return nil, errors.Errorf(ERRNO_LOGIN, "User presence is required")
+	}
+
+	// 通行密钥登录跳过两步验证, 必须经过用户验证 (PIN 或生物识别)
+	if d.Flags&AUTH_FLAG_UV == 0 {
+		return nil, errors.Errorf(ERRNO_LOGIN, "User verification is required")
+	}
+
+	passkeys, err := s.getPasskeys(ctx, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p := passkeys[task.Id]
+
+	if p == nil || p.Key == nil {
+		return nil, errors.Errorf(ERRNO_LOGIN, "Unknown passkey")
+	}
+
+	err = verifyAssertion(p.Key, authData, clientDataJSON, sig)
+
+	if err != nil {
+		return nil, errors.Errorf(ERRNO_LOGIN, "Invalid passkey signature")
+	}
+
+	err = config.Store().TouchPasskey(ctx, uid, task.Id, d.SignCount, time.Now().Unix())
+
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := s.getUserById(ctx, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// 经过用户验证的通行密钥同时满足持有和验证两个因素
+	return s.newSession(ctx, u, true)
+}
+
+func (s *Server) PasskeyList(ctx micro.Context, task *PasskeyListTask) ([]*Passkey, error) {
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	passkeys, err := s.getPasskeys(ctx, uid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rs := []*Passkey{}
+
+	for _, p := range passkeys {
+		p.Key = nil
+		rs = append(rs, p)
+	}
+
+	sort.Slice(rs, func(i, j int) bool {
+		return rs[i].Ctime < rs[j].Ctime
+	})
+
+	return rs, nil
+}
+
+func (s *Server) PasskeyRemove(ctx micro.Context, task *PasskeyRemoveTask) (interface{}, error) {
+
+	if task.Id == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, task.Token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Store().RemovePasskey(ctx, uid, strings.TrimSpace(task.Id))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{}, nil
+}
+
+/**
+* 通行密钥保存在 user/{uid}/passkeys.json, {id: Passkey}
+**/
+func (s *objectStore) updatePasskeys(ctx micro.Context, uid string, fn func(passkeys map[string]*Passkey) error) error {
+	return s.update(ctx, func(tx *storeTx) error {
+
+		key := fmt.Sprintf("user/%s/passkeys.json", uid)
+
+		passkeys := map[string]*Passkey{}
+
+		_, err := tx.GetObject(key, &passkeys)
+
+		if err != nil {
+			return err
+		}
+
+		err = fn(passkeys)
+
+		if err != nil {
+			return err
+		}
+
+		return tx.PutObject(key, passkeys)
+	})
+}
+
+func (s *objectStore) AddPasskey(ctx micro.Context, uid string, passkey *Passkey) error {
+	return s.updatePasskeys(ctx, uid, func(passkeys map[string]*Passkey) error {
+
+		if passkeys[passkey.Id] != nil {
+			return errors.Errorf(ERRNO_CONFLICT, "The passkey is already registered")
+		}
+
+		passkeys[passkey.Id] = passkey
+
+		return nil
+	})
+}
+
+func (s *objectStore) TouchPasskey(ctx micro.Context, uid string, id string, signCount uint32, atime int64) error {
+	return s.updatePasskeys(ctx, uid, func(passkeys map[string]*Passkey) error {
+
+		p := passkeys[id]
+
+		if p == nil {
+			return errors.Errorf(ERRNO_LOGIN, "Unknown passkey")
+		}
+
+		if (signCount != 0 || p.SignCount != 0) && signCount <= p.SignCount {
+			return errors.Errorf(ERRNO_LOGIN, "The passkey may have been cloned")
+		}
+
+		p.SignCount = signCount
+		p.Atime = atime
+
+		return nil
+	})
+}
+
+func (s *objectStore) RemovePasskey(ctx micro.Context, uid string, id string) error {
+	return s.updatePasskeys(ctx, uid, func(passkeys map[string]*Passkey) error {
+
+		if passkeys[id] == nil {
+			return errors.Errorf(ERRNO_NOT_FOUND, "The passkey does not exist")
+		}
+
+		delete(passkeys, id)
+
+		return nil
+	})
+}
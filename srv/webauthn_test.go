@@ -0,0 +1,211 @@
+package srv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"github.com/ability-sh/abi-lib/dynamic"
+	"github.com/ability-sh/abi-lib/json"
+	"github.com/ability-sh/abi-micro/micro"
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	TEST_RP_ID   = "store.example.com"
+	TEST_ORIGIN  = "https://store.example.com"
+	TEST_CRED_ID = "credential-1"
+)
+
+/**
+* 软件认证器, 使用 P-256 密钥
+**/
+type testAuthenticator struct {
+	t         *testing.T
+	key       *ecdsa.PrivateKey
+	signCount uint32
+}
+
+func (a *testAuthenticator) clientData(typ string, challenge string) []byte {
+	b, _ := json.Marshal(map[string]interface{}{"type": typ, "challenge": challenge, "origin": TEST_ORIGIN})
+	return b
+}
+
+func (a *testAuthenticator) authData(flags byte, attested []byte) []byte {
+
+	h := sha256.Sum256([]byte(TEST_RP_ID))
+
+	b := append([]byte{}, h[:]...)
+	b = append(b, flags)
+	b = binary.BigEndian.AppendUint32(b, a.signCount)
+
+	return append(b, attested...)
+}
+
+func (a *testAuthenticator) register(challenge string) *PasskeyRegisterFinishTask {
+
+	key, err := cbor.Marshal(map[int]interface{}{
+		1:  2,
+		3:  COSE_ALG_ES256,
+		-1: 1,
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	attested := make([]byte, 16)
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(TEST_CRED_ID)))
+	attested = append(attested, []byte(TEST_CRED_ID)...)
+	attested = append(attested, key...)
+
+	att, err := cbor.Marshal(map[string]interface{}{"fmt": "none", "attStmt": map[string]interface{}{}, "authData": a.authData(AUTH_FLAG_UP|AUTH_FLAG_UV|AUTH_FLAG_AT, attested)})
+
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return &PasskeyRegisterFinishTask{
+		Id:                b64url.EncodeToString([]byte(TEST_CRED_ID)),
+		ClientDataJSON:    b64url.EncodeToString(a.clientData(WEBAUTHN_CREATE, challenge)),
+		AttestationObject: b64url.EncodeToString(att),
+	}
+}
+
+func (a *testAuthenticator) assert(challenge string, flags byte) *PasskeyLoginFinishTask {
+
+	a.signCount = a.signCount + 1
+
+	authData := a.authData(flags, nil)
+	clientData := a.clientData(WEBAUTHN_GET, challenge)
+
+	h := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), h[:]...))
+
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return &PasskeyLoginFinishTask{
+		Id:                b64url.EncodeToString([]byte(TEST_CRED_ID)),
+		ClientDataJSON:    b64url.EncodeToString(clientData),
+		AuthenticatorData: b64url.EncodeToString(authData),
+		Signature:         b64url.EncodeToString(sig),
+	}
+}
+
+func TestPasskey(t *testing.T) {
+
+	e := newTestEnvWith(t, map[string]interface{}{
+		"webauthn-rp-id":   TEST_RP_ID,
+		"webauthn-rp-name": "Store",
+		"webauthn-origin":  TEST_ORIGIN,
+	})
+
+	token := e.login("owner@example.com")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &testAuthenticator{t: t, key: key}
+
+	challenge := func(rs interface{}, err error) string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dynamic.StringValue(dynamic.Get(rs, "challenge"), "")
+	}
+
+	e.ctx(func(ctx micro.Context) {
+
+		task := a.register(challenge(e.s.PasskeyRegisterBegin(ctx, &PasskeyRegisterBeginTask{Token: token})))
+
+		task.Token = token
+		task.Name = "laptop"
+
+		p, err := e.s.PasskeyRegisterFinish(ctx, task)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if p.Id != task.Id || p.Name != "laptop" || p.Key != nil {
+			t.Fatalf("unexpected passkey %+v", p)
+		}
+
+		// 挑战只能使用一次
+		_, err = e.s.PasskeyRegisterFinish(ctx, task)
+
+		assertErrno(t, err, ERRNO_LOGIN)
+
+		login := a.assert(challenge(e.s.PasskeyLoginBegin(ctx, &PasskeyLoginBeginTask{Email: "owner@example.com"})), AUTH_FLAG_UP|AUTH_FLAG_UV)
+
+		rs, err := e.s.PasskeyLoginFinish(ctx, login)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rs.Token == "" || rs.User.Email != "owner@example.com" {
+			t.Fatalf("unexpected login %+v", rs)
+		}
+
+		_, err = e.s.PasskeyLoginFinish(ctx, login)
+
+		assertErrno(t, err, ERRNO_LOGIN)
+
+		// 可发现凭证, 通过 userHandle 确定用户
+		login = a.assert(challenge(e.s.PasskeyLoginBegin(ctx, &PasskeyLoginBeginTask{})), AUTH_FLAG_UP)
+		login.UserHandle = b64url.EncodeToString([]byte(rs.User.Id))
+
+		_, err = e.s.PasskeyLoginFinish(ctx, login)
+
+		assertErrno(t, err, ERRNO_LOGIN)
+
+		login = a.assert(challenge(e.s.PasskeyLoginBegin(ctx, &PasskeyLoginBeginTask{})), AUTH_FLAG_UP|AUTH_FLAG_UV)
+		login.UserHandle = b64url.EncodeToString([]byte(rs.User.Id))
+
+		_, err = e.s.PasskeyLoginFinish(ctx, login)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 签名计数没有增加
+		a.signCount = a.signCount - 1
+
+		_, err = e.s.PasskeyLoginFinish(ctx, a.assert(challenge(e.s.PasskeyLoginBegin(ctx, &PasskeyLoginBeginTask{Email: "owner@example.com"})), AUTH_FLAG_UP|AUTH_FLAG_UV))
+
+		assertErrno(t, err, ERRNO_LOGIN)
+
+		items, err := e.s.PasskeyList(ctx, &PasskeyListTask{Token: token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(items) != 1 || items[0].Atime == 0 || items[0].Key != nil {
+			t.Fatalf("unexpected passkeys %+v", items)
+		}
+
+		_, err = e.s.PasskeyRemove(ctx, &PasskeyRemoveTask{Token: token, Id: p.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.PasskeyLoginBegin(ctx, &PasskeyLoginBeginTask{Email: "owner@example.com"})
+
+		assertErrno(t, err, ERRNO_LOGIN)
+	})
+}
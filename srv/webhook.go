@@ -0,0 +1,819 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	nethttp "net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ability-sh/abi-lib/errors"
+	"github.com/ability-sh/abi-lib/json"
+	"github.com/ability-sh/abi-micro/micro"
+	"github.com/ability-sh/abi-micro/redis"
+	R "github.com/go-redis/redis/v8"
+)
+
+/**
+* 校验 Webhook 地址, 主机解析到回环, 链路本地, 内网或未指定地址时拒绝, WebhookAllowHosts 中的主机除外
+**/
+func (s *ConfigService) checkWebhookUrl(raw string) error {
+
+	u, err := url.Parse(raw)
+
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.Errorf(ERRNO_INPUT_DATA, "The parameter url is incorrect")
+	}
+
+	_, err = s.resolveWebhookHost(context.Background(), u.Hostname())
+
+	return err
+}
+
+func (s *ConfigService) isWebhookAllowHost(host string) bool {
+
+	for _, v := range strings.Split(s.WebhookAllowHosts, ",") {
+		if strings.TrimSpace(strings.ToLower(v)) == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast())
+}
+
+/**
+* 解析 Webhook 主机, 任一地址不是公网地址时拒绝, WebhookAllowHosts 中的主机除外
+**/
+func (s *ConfigService) resolveWebhookHost(ctx context.Context, host string) ([]net.IP, error) {
+
+	host = strings.ToLower(host)
+
+	ips := []net.IP{}
+
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil || len(addrs) == 0 {
+			return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter url is incorrect, %s cannot be resolved", host)
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	if s.isWebhookAllowHost(host) {
+		return ips, nil
+	}
+
+	for _, ip := range ips {
+		if !isPublicIP(ip) {
+			return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter url is incorrect, %s resolves to a non-public address", host)
+		}
+	}
+
+	return ips, nil
+}
+
+/**
+* 投递 Webhook 的客户端, 在建立连接时解析并校验地址, 然后连接校验过的地址, 避免 DNS 重新绑定
+* 不跟随重定向, 重定向响应按投递失败处理
+**/
+func newWebhookClient(s *ConfigService) *nethttp.Client {
+
+	dialer := &net.Dialer{Timeout: time.Duration(s.WebhookTimeout) * time.Second}
+
+	transport := &nethttp.Transport{
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+
+			host, port, err := net.SplitHostPort(addr)
+
+			if err != nil {
+				return nil, err
+			}
+
+			ips, err := s.resolveWebhookHost(ctx, host)
+
+			if err != nil {
+				return nil, err
+			}
+
+			var conn net.Conn = nil
+
+			for _, ip := range ips {
+				conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+				if err == nil {
+					return conn, nil
+				}
+			}
+
+			return nil, err
+		},
+		TLSHandshakeTimeout:   time.Duration(s.WebhookTimeout) * time.Second,
+		ResponseHeaderTimeout: time.Duration(s.WebhookTimeout) * time.Second,
+		MaxIdleConnsPerHost:   2,
+		IdleConnTimeout:       90 * time.Second,
+	}
+
+	return &nethttp.Client{
+		Transport: transport,
+		Timeout:   time.Duration(s.WebhookTimeout) * time.Second,
+		CheckRedirect: func(req *nethttp.Request, via []*nethttp.Request) error {
+			return nethttp.ErrUseLastResponse
+		},
+	}
+}
+
+func isWebhookEvent(event string) bool {
+	switch event {
+	case EVENT_VERSION_PUBLISHED, EVENT_APP_APPROVED, EVENT_APP_UNAPPROVED, EVENT_CONTAINER_UPDATED, EVENT_MEMBER_CHANGED:
+		return true
+	}
+	return false
+}
+
+/**
+* 签名 hex(hmac-sha256(secret, timestamp + "." + body))
+**/
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	m.Write([]byte("."))
+	m.Write(body)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+/**
+* 校验 Webhook 所属应用或容器的成员权限
+**/
+func (s *Server) checkWebhookMember(ctx micro.Context, token string, scope string, target string, write bool) (string, error) {
+
+	if target == "" {
+		return "", errors.Errorf(ERRNO_INPUT_DATA, "The parameter target is incorrect")
+	}
+
+	uid, err := s.getUid(ctx, token)
+
+	if err != nil {
+		return "", err
+	}
+
+	var member *Member = nil
+
+	switch scope {
+	case WEBHOOK_SCOPE_APP:
+		member, err = s.getAppMember(ctx, target, uid)
+	case WEBHOOK_SCOPE_CONTAINER:
+		member, err = s.getContainerMember(ctx, target, uid)
+	default:
+		return "", errors.Errorf(ERRNO_INPUT_DATA, "The parameter scope is incorrect")
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if member.Role != ROLE_OWNER && member.Role != ROLE_READ_WRITE && (write || member.Role != ROLE_READ_ONLY) {
+		return "", errors.Errorf(ERRNO_NO_PERMISSION, "No permission")
+	}
+
+	return uid, nil
+}
+
+func (s *Server) getWebhook(ctx micro.Context, id string) (*Webhook, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := config.Store().Get(ctx, fmt.Sprintf("webhook/%s/meta.json", id))
+
+	if err != nil {
+		if IsErrno(err, ERRNO_NOT_FOUND) {
+			return nil, errors.Errorf(ERRNO_NOT_FOUND, "Webhook that does not exist")
+		}
+		return nil, err
+	}
+
+	w := &Webhook{}
+
+	unmarshalObject(text, w)
+
+	return w, nil
+}
+
+func (s *Server) getWebhooks(ctx micro.Context, scope string, target string) (map[string]*Webhook, error) {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rs := map[string]*Webhook{}
+
+	text, err := config.Store().Get(ctx, fmt.Sprintf("%s/%s/webhooks.json", scope, target))
+
+	if err != nil {
+		if IsErrno(err, ERRNO_NOT_FOUND) {
+			return rs, nil
+		}
+		return nil, err
+	}
+
+	unmarshalObject(text, &rs)
+
+	return rs, nil
+}
+
+/**
+* 触发事件, 为每个订阅了该事件的 Webhook 创建投递记录并加入投递队列, 失败只记录日志不影响调用方
+**/
+func (s *Server) emitEvent(ctx micro.Context, scope string, target string, event string, data interface{}) {
+
+	err := s.emitEventWithError(ctx, scope, target, event, data)
+
+	if err != nil {
+		ctx.Println("webhook", event, scope, target, err)
+	}
+}
+
+func (s *Server) emitEventWithError(ctx micro.Context, scope string, target string, event string, data interface{}) error {
+
+	webhooks, err := s.getWebhooks(ctx, scope, target)
+
+	if err != nil {
+		return err
+	}
+
+	if len(webhooks) == 0 {
+		return nil
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return err
+	}
+
+	cli, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	e := &WebhookEvent{Id: config.NewID(ctx), Event: event, Scope: scope, Target: target, Time: now.Unix(), Data: data}
+
+	for _, w := range webhooks {
+
+		matched := false
+
+		for _, v := range w.Events {
+			if v == event {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			continue
+		}
+
+		d := &WebhookDelivery{Id: config.NewID(ctx), Webhook: w.Id, Event: e, State: DELIVERY_STATE_PENDING, Ctime: now.Unix(), Mtime: now.Unix()}
+
+		err = config.Store().AddWebhookDelivery(ctx, d, config.WebhookDeliveryRetention)
+
+		if err != nil {
+			return err
+		}
+
+		err = cli.ZAdd(context.Background(), fmt.Sprintf("%swh_queue", config.Prefix), &R.Z{Score: float64(now.UnixMilli()), Member: w.Id + "/" + d.Id}).Err()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/**
+* 投递一次, 失败时按指数退避重新加入队列, 超过最大次数标记为失败
+**/
+func (s *Server) deliverWebhook(ctx micro.Context, wid string, did string) error {
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("webhook/%s/delivery/%s.json", wid, did)
+
+	text, err := config.Store().Get(ctx, key)
+
+	if err != nil {
+		if IsErrno(err, ERRNO_NOT_FOUND) {
+			return nil
+		}
+		return err
+	}
+
+	d := &WebhookDelivery{}
+
+	unmarshalObject(text, d)
+
+	w, err := s.getWebhook(ctx, wid)
+
+	if err != nil {
+		if IsErrno(err, ERRNO_NOT_FOUND) {
+			d.State = DELIVERY_STATE_FAILED
+			d.Error = "webhook removed"
+			d.Next = 0
+			d.Mtime = time.Now().Unix()
+			return config.Store().PutObject(ctx, key, d)
+		}
+		return err
+	}
+
+	// 主机可能在创建后解析到了内网地址
+	err = config.checkWebhookUrl(w.Url)
+
+	if err != nil {
+		d.State = DELIVERY_STATE_FAILED
+		d.Error = err.Error()
+		d.Next = 0
+		d.Mtime = time.Now().Unix()
+		return config.Store().PutObject(ctx, key, d)
+	}
+
+	body, _ := json.Marshal(d.Event)
+
+	timestamp := time.Now().Unix()
+
+	d.Attempts = d.Attempts + 1
+	d.Code = 0
+	d.Error = ""
+
+	// 连接时客户端会再次解析并校验地址
+	req, err := nethttp.NewRequest("POST", w.Url, bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", w.Id)
+	req.Header.Set("X-Webhook-Event", d.Event.Event)
+	req.Header.Set("X-Webhook-Delivery", d.Id)
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(w.Secret, timestamp, body))
+
+	res, err := config.webhookClient.Do(req)
+
+	if err != nil {
+		d.Error = err.Error()
+	} else {
+		io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+		res.Body.Close()
+		d.Code = res.StatusCode
+		if d.Code < 200 || d.Code >= 300 {
+			d.Error = fmt.Sprintf("unexpected status %d", d.Code)
+		}
+	}
+
+	now := time.Now()
+
+	d.Mtime = now.Unix()
+	d.Next = 0
+
+	if d.Error == "" {
+		d.State = DELIVERY_STATE_SUCCEEDED
+	} else if d.Attempts >= config.WebhookRetry {
+		d.State = DELIVERY_STATE_FAILED
+	} else {
+
+		backoff := time.Duration(config.WebhookBackoff) * time.Second << (d.Attempts - 1)
+
+		if backoff > time.Hour {
+			backoff = time.Hour
+		}
+
+		next := now.Add(backoff)
+
+		d.Next = next.Unix()
+
+		cli, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+		if err != nil {
+			return err
+		}
+
+		err = cli.ZAdd(context.Background(), fmt.Sprintf("%swh_queue", config.Prefix), &R.Z{Score: float64(next.UnixMilli()), Member: wid + "/" + did}).Err()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return config.Store().PutObject(ctx, key, d)
+}
+
+type webhookWorker struct {
+	s    *Server
+	p    micro.Payload
+	done chan struct{}
+}
+
+/**
+* 后台投递 Webhook, 多个进程通过 ZREM 争抢队列中的投递
+**/
+func NewWebhookWorker(s *Server, p micro.Payload) micro.Recycle {
+	w := &webhookWorker{s: s, p: p, done: make(chan struct{})}
+	go w.run()
+	return w
+}
+
+func (w *webhookWorker) run() {
+
+	tk := time.NewTicker(time.Second)
+
+	defer tk.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-tk.C:
+			w.poll()
+		}
+	}
+}
+
+func (w *webhookWorker) poll() {
+
+	ctx, err := w.p.NewContext("__webhook__", micro.NewTrace())
+
+	if err != nil {
+		return
+	}
+
+	defer ctx.Recycle()
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		ctx.Println("webhook", err)
+		return
+	}
+
+	cli, err := redis.GetClient(ctx, SERVICE_REDIS)
+
+	if err != nil {
+		ctx.Println("webhook", err)
+		return
+	}
+
+	key := fmt.Sprintf("%swh_queue", config.Prefix)
+
+	items, err := cli.ZRangeByScore(context.Background(), key, &R.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(time.Now().UnixMilli(), 10), Count: 20}).Result()
+
+	if err != nil {
+		ctx.Println("webhook", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+
+	for _, item := range items {
+
+		n, err := cli.ZRem(context.Background(), key, item).Result()
+
+		if err != nil || n == 0 {
+			continue
+		}
+
+		vs := strings.SplitN(item, "/", 2)
+
+		if len(vs) != 2 {
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(wid string, did string) {
+			defer wg.Done()
+			w.deliver(wid, did)
+		}(vs[0], vs[1])
+	}
+
+	wg.Wait()
+}
+
+func (w *webhookWorker) deliver(wid string, did string) {
+
+	ctx, err := w.p.NewContext("__webhook__", micro.NewTrace())
+
+	if err != nil {
+		return
+	}
+
+	defer ctx.Recycle()
+
+	err = w.s.deliverWebhook(ctx, wid, did)
+
+	if err != nil {
+		ctx.Println("webhook", wid, did, err)
+	}
+}
+
+func (w *webhookWorker) Recycle() {
+	close(w.done)
+}
+
+func (s *Server) WebhookCreate(ctx micro.Context, task *WebhookCreateTask) (*Webhook, error) {
+
+	if len(task.Events) == 0 {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter events is incorrect")
+	}
+
+	for _, event := range task.Events {
+		if !isWebhookEvent(event) {
+			return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter events is incorrect")
+		}
+	}
+
+	uid, err := s.checkWebhookMember(ctx, task.Token, task.Scope, task.Target, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.checkWebhookUrl(task.Url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Webhook{
+		Id:     config.NewID(ctx),
+		Scope:  task.Scope,
+		Target: task.Target,
+		Url:    task.Url,
+		Secret: config.NewSecret(),
+		Events: task.Events,
+		Uid:    uid,
+		Ctime:  time.Now().Unix(),
+	}
+
+	err = config.Store().PutWebhook(ctx, w)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (s *Server) WebhookRemove(ctx micro.Context, task *WebhookRemoveTask) (interface{}, error) {
+
+	if task.Id == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	w, err := s.getWebhook(ctx, task.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.checkWebhookMember(ctx, task.Token, w.Scope, w.Target, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Store().DelWebhook(ctx, w)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (s *Server) WebhookList(ctx micro.Context, task *WebhookListTask) ([]*Webhook, error) {
+
+	_, err := s.checkWebhookMember(ctx, task.Token, task.Scope, task.Target, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks, err := s.getWebhooks(ctx, task.Scope, task.Target)
+
+	if err != nil {
+		return nil, err
+	}
+
+	items := []*Webhook{}
+
+	for _, w := range webhooks {
+		w.Secret = SECRET_MASK
+		items = append(items, w)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Ctime < items[j].Ctime
+	})
+
+	return items, nil
+}
+
+func (s *Server) WebhookDeliveryList(ctx micro.Context, task *WebhookDeliveryListTask) ([]*WebhookDelivery, error) {
+
+	if task.Id == "" {
+		return nil, errors.Errorf(ERRNO_INPUT_DATA, "The parameter id is incorrect")
+	}
+
+	w, err := s.getWebhook(ctx, task.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.checkWebhookMember(ctx, task.Token, w.Scope, w.Target, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := GetConfigService(ctx, SERVICE_CONFIG)
+
+	if err != nil {
+		return nil, err
+	}
+
+	limit := task.Limit
+
+	if limit <= 0 {
+		limit = 20
+	}
+
+	items := []*WebhookDelivery{}
+
+	text, err := config.Store().Get(ctx, fmt.Sprintf("webhook/%s/deliveries.json", task.Id))
+
+	if err != nil {
+		if IsErrno(err, ERRNO_NOT_FOUND) {
+			return items, nil
+		}
+		return nil, err
+	}
+
+	ids := []string{}
+
+	unmarshalObject(text, &ids)
+
+	for i := len(ids) - 1; i >= 0 && len(items) < limit; i-- {
+
+		text, err := config.Store().Get(ctx, fmt.Sprintf("webhook/%s/delivery/%s.json", task.Id, ids[i]))
+
+		if err != nil {
+			if IsErrno(err, ERRNO_NOT_FOUND) {
+				continue
+			}
+			return nil, err
+		}
+
+		d := &WebhookDelivery{}
+
+		unmarshalObject(text, d)
+
+		items = append(items, d)
+	}
+
+	return items, nil
+}
+
+/**
+* Webhook 保存在 webhook/{id}/meta.json, 索引 {scope}/{target}/webhooks.json 为 {id: Webhook}
+**/
+func (s *objectStore) PutWebhook(ctx micro.Context, webhook *Webhook) error {
+	return s.update(ctx, func(tx *storeTx) error {
+
+		key := fmt.Sprintf("%s/%s/webhooks.json", webhook.Scope, webhook.Target)
+
+		webhooks := map[string]*Webhook{}
+
+		_, err := tx.GetObject(key, &webhooks)
+
+		if err != nil {
+			return err
+		}
+
+		webhooks[webhook.Id] = webhook
+
+		err = tx.PutObject(key, webhooks)
+
+		if err != nil {
+			return err
+		}
+
+		return tx.PutObject(fmt.Sprintf("webhook/%s/meta.json", webhook.Id), webhook)
+	})
+}
+
+func (s *objectStore) DelWebhook(ctx micro.Context, webhook *Webhook) error {
+	return s.update(ctx, func(tx *storeTx) error {
+
+		key := fmt.Sprintf("%s/%s/webhooks.json", webhook.Scope, webhook.Target)
+
+		webhooks := map[string]*Webhook{}
+
+		ok, err := tx.GetObject(key, &webhooks)
+
+		if err != nil {
+			return err
+		}
+
+		if ok {
+
+			delete(webhooks, webhook.Id)
+
+			err = tx.PutObject(key, webhooks)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		tx.Del(fmt.Sprintf("webhook/%s/meta.json", webhook.Id))
+
+		return nil
+	})
+}
+
+/**
+* 投递记录保存在 webhook/{wid}/delivery/{id}.json, 索引 webhook/{wid}/deliveries.json 按时间排列
+**/
+func (s *objectStore) AddWebhookDelivery(ctx micro.Context, delivery *WebhookDelivery, retention int) error {
+	return s.update(ctx, func(tx *storeTx) error {
+
+		key := fmt.Sprintf("webhook/%s/deliveries.json", delivery.Webhook)
+
+		items := []string{}
+
+		_, err := tx.GetObject(key, &items)
+
+		if err != nil {
+			return err
+		}
+
+		err = tx.PutObject(fmt.Sprintf("webhook/%s/delivery/%s.json", delivery.Webhook, delivery.Id), delivery)
+
+		if err != nil {
+			return err
+		}
+
+		items = append(items, delivery.Id)
+
+		for len(items) > retention {
+			tx.Del(fmt.Sprintf("webhook/%s/delivery/%s.json", delivery.Webhook, items[0]))
+			items = items[1:]
+		}
+
+		return tx.PutObject(key, items)
+	})
+}
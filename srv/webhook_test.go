@@ -0,0 +1,176 @@
+package srv
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ability-sh/abi-micro/micro"
+)
+
+func TestWebhookPrivateUrl(t *testing.T) {
+
+	e := newTestEnv(t)
+
+	token := e.login("owner@example.com")
+
+	hits := int32(0)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+
+	defer ts.Close()
+
+	e.ctx(func(ctx micro.Context) {
+
+		c, err := e.s.ContainerCreate(ctx, &ContainerCreateTask{Token: token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.WebhookCreate(ctx, &WebhookCreateTask{Token: token, Scope: WEBHOOK_SCOPE_CONTAINER, Target: c.Id, Url: ts.URL, Events: []string{EVENT_MEMBER_CHANGED}})
+
+		assertErrno(t, err, ERRNO_INPUT_DATA)
+
+		// 绕过创建时的校验, 连接时仍然拒绝解析到回环地址的主机
+		_, err = e.config(ctx).webhookClient.Post(strings.Replace(ts.URL, "127.0.0.1", "localhost", 1), "application/json", nil)
+
+		if err == nil {
+			t.Fatal("expected the dial to be rejected")
+		}
+
+		if atomic.LoadInt32(&hits) != 0 {
+			t.Fatal("unexpected request to a loopback address")
+		}
+	})
+}
+
+func TestWebhookDelivery(t *testing.T) {
+
+	e := newTestEnvWith(t, map[string]interface{}{"webhook-allow-hosts": "127.0.0.1"})
+
+	token := e.login("owner@example.com")
+
+	secret := atomic.Value{}
+	hits := int32(0)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		atomic.AddInt32(&hits, 1)
+
+		body, _ := io.ReadAll(r.Body)
+
+		timestamp, _ := strconv.ParseInt(r.Header.Get("X-Webhook-Timestamp"), 10, 64)
+
+		if r.Header.Get("X-Webhook-Signature") != "sha256="+signWebhook(secret.Load().(string), timestamp, body) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+
+	defer ts.Close()
+
+	e.ctx(func(ctx micro.Context) {
+
+		c, err := e.s.ContainerCreate(ctx, &ContainerCreateTask{Token: token})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wh, err := e.s.WebhookCreate(ctx, &WebhookCreateTask{Token: token, Scope: WEBHOOK_SCOPE_CONTAINER, Target: c.Id, Url: ts.URL, Events: []string{EVENT_MEMBER_CHANGED}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		secret.Store(wh.Secret)
+
+		redirect, err := e.s.WebhookCreate(ctx, &WebhookCreateTask{Token: token, Scope: WEBHOOK_SCOPE_CONTAINER, Target: c.Id, Url: ts.URL + "/redirect", Events: []string{EVENT_MEMBER_CHANGED}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		items, err := e.s.WebhookList(ctx, &WebhookListTask{Token: token, Scope: WEBHOOK_SCOPE_CONTAINER, Target: c.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(items) != 2 {
+			t.Fatalf("expected 2 webhooks, got %d", len(items))
+		}
+
+		e.s.emitEvent(ctx, WEBHOOK_SCOPE_CONTAINER, c.Id, EVENT_MEMBER_CHANGED, map[string]interface{}{"action": "add"})
+
+		for _, id := range []string{wh.Id, redirect.Id} {
+
+			ds, err := e.s.WebhookDeliveryList(ctx, &WebhookDeliveryListTask{Token: token, Id: id})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(ds) != 1 || ds[0].State != DELIVERY_STATE_PENDING {
+				t.Fatalf("unexpected deliveries %+v", ds)
+			}
+
+			err = e.s.deliverWebhook(ctx, id, ds[0].Id)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ds, err := e.s.WebhookDeliveryList(ctx, &WebhookDeliveryListTask{Token: token, Id: wh.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ds[0].State != DELIVERY_STATE_SUCCEEDED || ds[0].Code != http.StatusOK || ds[0].Attempts != 1 {
+			t.Fatalf("unexpected delivery %+v", ds[0])
+		}
+
+		ds, err = e.s.WebhookDeliveryList(ctx, &WebhookDeliveryListTask{Token: token, Id: redirect.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ds[0].State != DELIVERY_STATE_PENDING || ds[0].Code != http.StatusFound || ds[0].Next == 0 {
+			t.Fatalf("expected the redirect not to be followed %+v", ds[0])
+		}
+
+		if atomic.LoadInt32(&hits) != 1 {
+			t.Fatalf("expected 1 request, got %d", hits)
+		}
+
+		_, err = e.s.WebhookRemove(ctx, &WebhookRemoveTask{Token: token, Id: redirect.Id})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = e.s.deliverWebhook(ctx, redirect.Id, ds[0].Id)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.s.WebhookDeliveryList(ctx, &WebhookDeliveryListTask{Token: token, Id: redirect.Id})
+
+		assertErrno(t, err, ERRNO_NOT_FOUND)
+	})
+}